@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/util"
+	"github.com/go-errors/errors"
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-simple-disk/volumemount"
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+	"github.com/wrouesnel/docker-simple-disk/volumesetup"
+)
+
+// Replaced by tests
+var (
+	initializeBlockDevice = volumesetup.InitializeBlockDevice
+	resetBlockDevice      = volumesetup.ResetBlockDevice
+)
+
+// Get the hostname
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return h
+}
+
+// Get the machine ID
+func machineid() string {
+	m, err := util.GetMachineID()
+	if err != nil {
+		return ""
+	}
+	return m
+}
+
+// findDisks returns the initialized disks which satisfy the query, and the
+// blank disks which could be initialized to satisfy it. Disks which the named
+// volume could not claim are excluded.
+func (this *SimpleVolumeDriver) findDisks(db *volumequery.DeviceDatabase, name string, query *volumequery.VolumeQuery) ([]string, []string, error) {
+	claimant := volumequery.Claimant{
+		Volume:    name,
+		Exclusive: query.Exclusive,
+	}
+	initialized, uninitialized, _, err := db.CandidateDisks(this.deviceSelectionRules, this.ledger, claimant)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	matched := []string{}
+	for _, diskPath := range initialized {
+		isMatch, err := db.MatchInitializedDisk(query, diskPath)
+		if err != nil {
+			log.Warnln("Skipping initialized disk which could not be matched:", diskPath, err)
+			continue
+		}
+		if isMatch {
+			matched = append(matched, diskPath)
+		}
+	}
+
+	blank := []string{}
+	if !query.Initialized {
+		for _, diskPath := range uninitialized {
+			isMatch, err := db.MatchBlankDisk(query, diskPath)
+			if err != nil {
+				log.Warnln("Skipping blank disk which could not be matched:", diskPath, err)
+				continue
+			}
+			if isMatch {
+				blank = append(blank, diskPath)
+			}
+		}
+	}
+
+	return matched, blank, nil
+}
+
+// selectDisks picks the disks a volume will be assembled from with the
+// volumequery selection engine. Disks which the named volume could not claim
+// are never selected.
+func (this *SimpleVolumeDriver) selectDisks(db *volumequery.DeviceDatabase, name string, query *volumequery.VolumeQuery) ([]string, error) {
+	claimant := volumequery.Claimant{
+		Volume:    name,
+		Exclusive: query.Exclusive,
+	}
+	initialized, uninitialized, _, err := db.CandidateDisks(this.deviceSelectionRules, this.ledger, claimant)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.SelectDisks(query, initialized, uninitialized, db.MatchInitializedDisk)
+}
+
+// claimDisks records the given disks as claimed by the volume in the ledger
+// and returns their identities.
+func (this *SimpleVolumeDriver) claimDisks(db *volumequery.DeviceDatabase, vol *SimpleVolume, diskPaths []string) ([]string, error) {
+	identities := make([]string, 0, len(diskPaths))
+	for _, diskPath := range diskPaths {
+		identity, err := db.DiskIdentity(diskPath)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	claimant := volumequery.Claimant{
+		Volume:    vol.Name,
+		Exclusive: vol.Query.Exclusive,
+	}
+	if err := this.ledger.Claim(identities, claimant); err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// initializeDisk initializes a blank disk claimed by a volume using the
+// volume's query. Returns false if initialization failed.
+func (this *SimpleVolumeDriver) initializeDisk(vol *SimpleVolume, diskPath string) bool {
+	log.Infoln("Initializing blank disk for volume", vol.Name, ":", diskPath)
+	if err := initializeBlockDevice(diskPath, vol.Query, hostname(), machineid()); err != nil {
+		log.Errorln("Failed to initialize blank disk:", diskPath, err)
+		return false
+	}
+	return true
+}
+
+// resolveDisks finds the current device paths of the disks a volume has
+// claimed, initializing any which are still blank. Disks which can't be found
+// are skipped provided enough remain to satisfy min-disks.
+//
+// Initializing a disk changes its partitions, so the returned device snapshot
+// should be used in place of db from then on.
+func (this *SimpleVolumeDriver) resolveDisks(db *volumequery.DeviceDatabase, vol *SimpleVolume) ([]string, *volumequery.DeviceDatabase, error) {
+	found, err := db.FindDisksByIdentity(this.deviceSelectionRules, vol.Disks)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	initialized := false
+
+	diskPaths := []string{}
+	for _, identity := range vol.Disks {
+		diskPath, ok := found[identity]
+		if !ok {
+			log.Warnln("Claimed disk is not present:", identity)
+			continue
+		}
+
+		isBlank, err := db.IsBlankCandidate(diskPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isBlank {
+			if !this.initializeDisk(vol, diskPath) {
+				continue
+			}
+			initialized = true
+		}
+		diskPaths = append(diskPaths, diskPath)
+	}
+
+	if len(diskPaths) < int(vol.Query.MinDisks) {
+		return nil, nil, errors.Errorf("volume requires %d disks but only %d of its claimed disks are usable",
+			vol.Query.MinDisks, len(diskPaths))
+	}
+
+	if initialized {
+		if db, err = volumequery.SnapshotDeviceDatabase(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return diskPaths, db, nil
+}
+
+// slotName returns the mountpoint name of a numeric slot.
+func slotName(query *volumequery.VolumeQuery, slot int) string {
+	return fmt.Sprintf("%s%d", query.Basename, slot)
+}
+
+// placeholderNames returns the mountpoint names which should exist in a volume
+// even when no disk fills them.
+func placeholderNames(query *volumequery.VolumeQuery) []string {
+	names := []string{}
+	if !query.PersistNumbering {
+		return names
+	}
+	for slot := 0; slot < int(query.MaxDisks); slot++ {
+		names = append(names, slotName(query, slot))
+	}
+	return names
+}
+
+// diskSources converts a list of selected disks into the sources to assemble a
+// volume from, naming each according to the query naming style. Names in
+// usedNames are already taken by disks in the volume and will not be reused.
+//
+// With numeric naming and persist-numbering, disks are given back the slot
+// recorded in their label where possible, and any newly assigned slot is
+// written back to the label.
+func diskSources(db *volumequery.DeviceDatabase, query *volumequery.VolumeQuery, diskPaths []string, usedNames map[string]struct{}) ([]volumemount.DiskSource, error) {
+	labelPaths := make([]string, len(diskPaths))
+	labels := make([]volumequery.VolumeLabel, len(diskPaths))
+	sources := make([]volumemount.DiskSource, len(diskPaths))
+	for idx, diskPath := range diskPaths {
+		labelPath, dataPath, err := db.DiskLabelAndVolumePath(diskPath)
+		if err != nil {
+			return nil, err
+		}
+		label, err := volumequery.DeserializeVolumeLabel(labelPath)
+		if err != nil {
+			return nil, err
+		}
+		labelPaths[idx] = labelPath
+		labels[idx] = label
+		sources[idx] = volumemount.DiskSource{
+			DiskPath:      diskPath,
+			DataPath:      dataPath,
+			EncryptionKey: query.EncryptionKey,
+			Filesystem:    query.Filesystem,
+		}
+	}
+
+	if query.NamingStyle == volumequery.NamingUUID {
+		for idx, source := range sources {
+			rule, err := db.Device(source.DataPath)
+			if err != nil {
+				return nil, err
+			}
+			partUUID, found := rule.Properties["ID_PART_ENTRY_UUID"]
+			if !found {
+				return nil, errors.Errorf("data partition has no partition UUID: %s", source.DataPath)
+			}
+			sources[idx].Name = fmt.Sprintf("%s%s", query.Basename, partUUID)
+		}
+		return sources, nil
+	}
+
+	// Numeric naming. Work out which slots are already in use.
+	taken := make(map[int]struct{}, len(usedNames))
+	for name, _ := range usedNames {
+		if !strings.HasPrefix(name, query.Basename) {
+			continue
+		}
+		if slot, err := strconv.Atoi(strings.TrimPrefix(name, query.Basename)); err == nil {
+			taken[slot] = struct{}{}
+		}
+	}
+
+	preferred := make([]int, len(labels))
+	for idx, label := range labels {
+		preferred[idx] = volumemount.NoSlot
+		if !query.PersistNumbering {
+			continue
+		}
+		if slot, err := strconv.Atoi(label.Numbering); err == nil {
+			preferred[idx] = slot
+		}
+	}
+
+	slots := volumemount.AllocateSlots(preferred, taken, int(query.MaxDisks))
+
+	named := make([]volumemount.DiskSource, 0, len(sources))
+	for idx, slot := range slots {
+		if slot == volumemount.NoSlot {
+			log.Warnln("No free slot for disk:", sources[idx].DiskPath)
+			continue
+		}
+		sources[idx].Name = slotName(query, slot)
+		named = append(named, sources[idx])
+
+		numbering := strconv.Itoa(slot)
+		if query.PersistNumbering && labels[idx].Numbering != numbering {
+			log.Infoln("Recording slot", numbering, "in label of", sources[idx].DiskPath)
+			labels[idx].Numbering = numbering
+			if err := volumesetup.WriteVolumeLabel(labelPaths[idx], &labels[idx]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return named, nil
+}
+
+// claimedByOthers checks if any of the given identities of a disk is claimed
+// by a volume other than the named one.
+func (this *SimpleVolumeDriver) claimedByOthers(name string, identities []string) bool {
+	for _, identity := range identities {
+		for _, claimant := range this.ledger.Claimants(identity) {
+			if claimant.Volume != name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// disposeDisks disposes of the disks of a volume being removed according to
+// its remove policy. Disks which are also claimed by other volumes, or which
+// are not present, are left alone.
+func (this *SimpleVolumeDriver) disposeDisks(db *volumequery.DeviceDatabase, vol *SimpleVolume) error {
+	policy := vol.Query.RemovePolicy
+	if policy == "" {
+		policy = this.removePolicy
+	}
+	if policy == volumequery.RemoveKeep {
+		return nil
+	}
+
+	found, err := db.FindDisksByIdentity(this.deviceSelectionRules, vol.Disks)
+	if err != nil {
+		return err
+	}
+
+	for _, identity := range vol.Disks {
+		diskPath, ok := found[identity]
+		if !ok {
+			log.Warnln("Claimed disk is not present and cannot be disposed of:", identity)
+			continue
+		}
+
+		// Other volumes may have claimed the disk by another of its
+		// identities, so check all of them.
+		identities, err := db.DiskIdentities(diskPath)
+		if err != nil {
+			return err
+		}
+		if this.claimedByOthers(vol.Name, append(identities, identity)) {
+			log.Warnln("Not disposing of disk claimed by other volumes:", identity)
+			continue
+		}
+
+		log.Infoln("Disposing of disk", diskPath, "of volume", vol.Name, "with policy", policy)
+		if err := resetBlockDevice(diskPath, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	. "gopkg.in/check.v1"
+
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+	"github.com/wrouesnel/docker-simple-disk/volumesetup"
+)
+
+type DisposeSuite struct {
+	driverFixture
+	// Snapshot of the test devices
+	db *volumequery.DeviceDatabase
+	// Disks which were reset, and the policy they were reset with
+	reset    map[string]volumequery.RemovePolicy
+	resetErr error
+}
+
+var _ = Suite(&DisposeSuite{})
+
+func (this *DisposeSuite) SetUpTest(c *C) {
+	this.driverFixture.SetUpTest(c)
+
+	db, err := volumequery.SnapshotDeviceDatabase()
+	c.Assert(err, IsNil)
+	this.db = db
+
+	this.reset = make(map[string]volumequery.RemovePolicy)
+	this.resetErr = nil
+	resetBlockDevice = func(diskPath string, policy volumequery.RemovePolicy) error {
+		if this.resetErr != nil {
+			return this.resetErr
+		}
+		this.reset[diskPath] = policy
+		return nil
+	}
+}
+
+func (this *DisposeSuite) TearDownTest(c *C) {
+	this.driverFixture.TearDownTest(c)
+	resetBlockDevice = volumesetup.ResetBlockDevice
+}
+
+func (this *DisposeSuite) volume(policy volumequery.RemovePolicy) *SimpleVolume {
+	return &SimpleVolume{
+		Name:  "vol",
+		Query: volumequery.VolumeQuery{RemovePolicy: policy},
+		Disks: []string{"wwn:0x5000000000000a", "serial:SIMPLE_DISK_B", "serial:GONE"},
+	}
+}
+
+func (this *DisposeSuite) TestKeepDisposesOfNothing(c *C) {
+	c.Assert(this.driver.disposeDisks(this.db, this.volume("")), IsNil)
+	c.Check(this.reset, HasLen, 0)
+
+	c.Assert(this.driver.disposeDisks(this.db, this.volume(volumequery.RemoveKeep)), IsNil)
+	c.Check(this.reset, HasLen, 0)
+}
+
+func (this *DisposeSuite) TestSkipsSharedAndMissingDisks(c *C) {
+	vol := this.volume(volumequery.RemoveWipe)
+	c.Assert(this.driver.ledger.Claim(vol.Disks, volumequery.Claimant{Volume: "vol"}), IsNil)
+	c.Assert(this.driver.ledger.Claim([]string{"serial:SIMPLE_DISK_B"}, volumequery.Claimant{Volume: "other"}), IsNil)
+
+	c.Assert(this.driver.disposeDisks(this.db, vol), IsNil)
+	c.Check(this.reset, DeepEquals, map[string]volumequery.RemovePolicy{
+		"/dev/sda": volumequery.RemoveWipe,
+	})
+}
+
+func (this *DisposeSuite) TestSkipsDisksSharedByAnotherIdentity(c *C) {
+	vol := this.volume(volumequery.RemoveWipe)
+	c.Assert(this.driver.ledger.Claim(vol.Disks, volumequery.Claimant{Volume: "vol"}), IsNil)
+	// /dev/sda is known by its serial as well as its WWN.
+	c.Assert(this.driver.ledger.Claim([]string{"serial:BLANK_DISK_A"}, volumequery.Claimant{Volume: "other"}), IsNil)
+
+	c.Assert(this.driver.disposeDisks(this.db, vol), IsNil)
+	c.Check(this.reset, DeepEquals, map[string]volumequery.RemovePolicy{
+		"/dev/sdb": volumequery.RemoveWipe,
+	})
+}
+
+func (this *DisposeSuite) TestDriverDefaultPolicy(c *C) {
+	this.driver.removePolicy = volumequery.RemoveRelease
+
+	c.Assert(this.driver.disposeDisks(this.db, this.volume("")), IsNil)
+	c.Check(this.reset, DeepEquals, map[string]volumequery.RemovePolicy{
+		"/dev/sda": volumequery.RemoveRelease,
+		"/dev/sdb": volumequery.RemoveRelease,
+	})
+}
+
+func (this *DisposeSuite) TestResetErrorFailsDisposal(c *C) {
+	this.resetErr = errors.New("device busy")
+	c.Check(this.driver.disposeDisks(this.db, this.volume(volumequery.RemoveCryptoErase)), Equals, this.resetErr)
+}
+
+func (this *DisposeSuite) TestRemoveRefusesMountedVolume(c *C) {
+	vol := this.volume(volumequery.RemoveWipe)
+	vol.MountIDs = []string{"a"}
+	c.Assert(this.driver.registry.Put(vol), IsNil)
+
+	resp := this.driver.Remove(volume.Request{Name: "vol"})
+	c.Check(resp.Err, Not(Equals), "")
+	_, found := this.driver.registry.Get("vol")
+	c.Check(found, Equals, true)
+	c.Check(this.reset, HasLen, 0)
+}
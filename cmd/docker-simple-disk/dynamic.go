@@ -0,0 +1,189 @@
+// Implements dynamic mounts: adding and removing disks from mounted volumes as
+// block devices come and go.
+
+package main
+
+import (
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+// rescanDynamicVolumes adds any newly available disks to mounted volumes with
+// dynamic mounts, and closes the mappings of removed disks which were busy.
+func (this *SimpleVolumeDriver) rescanDynamicVolumes() {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	db, err := volumequery.SnapshotDeviceDatabase()
+	if err != nil {
+		log.Errorln("Could not scan disks for dynamic volumes:", err)
+		return
+	}
+
+	changed := false
+	for _, vol := range this.registry.List() {
+		if !vol.Query.DynamicMounts || vol.Staged == nil {
+			continue
+		}
+		if deferred := len(vol.Staged.DeferredMappings); deferred > 0 {
+			vol.Staged.CloseDeferredMappings()
+			if len(vol.Staged.DeferredMappings) != deferred {
+				changed = true
+			}
+		}
+		var volChanged bool
+		if volChanged, db = this.addDynamicDisks(db, vol); volChanged {
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := this.registry.Save(); err != nil {
+			log.Errorln("Could not save registry after dynamic mount changes:", err)
+		}
+	}
+}
+
+// addDynamicDisks mounts newly available initialized disks which match a
+// mounted volume into it, up to its max-disks limit. Blank disks are only
+// initialized and added if the volume asks for it with dynamic-initialize,
+// since any spare disk the rules match would otherwise be formatted into the
+// volume as soon as it was plugged in. Returns true if the volume changed, and the
+// device snapshot to use in place of db from then on, since initializing a
+// disk changes its partitions. Caller must hold the driver mutex.
+func (this *SimpleVolumeDriver) addDynamicDisks(db *volumequery.DeviceDatabase, vol *SimpleVolume) (bool, *volumequery.DeviceDatabase) {
+	room := -1
+	if vol.Query.MaxDisks > 0 {
+		room = int(vol.Query.MaxDisks) - len(vol.Staged.Disks)
+		if room <= 0 {
+			return false, db
+		}
+	}
+
+	matched, blank, err := this.findDisks(db, vol.Name, &vol.Query)
+	if err != nil {
+		log.Errorln("Could not scan disks for dynamic volume", vol.Name, ":", err)
+		return false, db
+	}
+
+	// Skip disks the volume already has mounted.
+	mounted := make(map[string]struct{}, len(vol.Staged.Disks))
+	usedNames := make(map[string]struct{}, len(vol.Staged.Disks))
+	for _, disk := range vol.Staged.Disks {
+		mounted[disk.DiskPath] = struct{}{}
+		usedNames[disk.Name] = struct{}{}
+	}
+
+	candidates := matched
+	if vol.Query.DynamicInitialize {
+		candidates = append(candidates, blank...)
+	}
+
+	newDisks := []string{}
+	for _, diskPath := range candidates {
+		if room == 0 {
+			break
+		}
+		if _, found := mounted[diskPath]; found {
+			continue
+		}
+		newDisks = append(newDisks, diskPath)
+		room--
+	}
+	if len(newDisks) == 0 {
+		return false, db
+	}
+
+	identities, err := this.claimDisks(db, vol, newDisks)
+	if err != nil {
+		log.Errorln("Could not claim new disks for dynamic volume", vol.Name, ":", err)
+		return false, db
+	}
+	for _, identity := range identities {
+		alreadyClaimed := false
+		for _, existing := range vol.Disks {
+			if existing == identity {
+				alreadyClaimed = true
+				break
+			}
+		}
+		if !alreadyClaimed {
+			vol.Disks = append(vol.Disks, identity)
+		}
+	}
+
+	for _, diskPath := range newDisks {
+		isBlank, err := db.IsBlankCandidate(diskPath)
+		if err != nil {
+			log.Errorln("Could not inspect new disk for dynamic volume", vol.Name, ":", diskPath, err)
+			continue
+		}
+		if isBlank {
+			if !this.initializeDisk(vol, diskPath) {
+				continue
+			}
+			refreshed, err := volumequery.SnapshotDeviceDatabase()
+			if err != nil {
+				log.Errorln("Could not rescan disks for dynamic volume", vol.Name, ":", err)
+				continue
+			}
+			db = refreshed
+		}
+
+		sources, err := diskSources(db, &vol.Query, []string{diskPath}, usedNames)
+		if err != nil {
+			log.Errorln("Could not inspect new disk for dynamic volume", vol.Name, ":", diskPath, err)
+			continue
+		}
+		if len(sources) == 0 {
+			continue
+		}
+		if err := vol.Staged.AddDisk(sources[0]); err != nil {
+			log.Errorln("Could not add disk to dynamic volume", vol.Name, ":", diskPath, err)
+			continue
+		}
+		usedNames[sources[0].Name] = struct{}{}
+		log.Infoln("Added disk", diskPath, "to dynamic volume", vol.Name, "as", sources[0].Name)
+	}
+
+	// Claims were recorded against the volume even if mounting failed, so the
+	// registry needs saving either way.
+	return true, db
+}
+
+// removeDynamicDisk lazily unmounts a disappeared device from any mounted
+// volumes with dynamic mounts.
+func (this *SimpleVolumeDriver) removeDynamicDisk(devnode string) {
+	if devnode == "" {
+		return
+	}
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	changed := false
+	for _, vol := range this.registry.List() {
+		if !vol.Query.DynamicMounts || vol.Staged == nil {
+			continue
+		}
+		for _, disk := range vol.Staged.Disks {
+			if disk.DiskPath != devnode && disk.DataPath != devnode {
+				continue
+			}
+			if err := vol.Staged.RemoveDisk(disk.Name); err != nil {
+				log.Errorln("Could not remove disappeared disk from dynamic volume", vol.Name, ":", devnode, err)
+			} else {
+				log.Infoln("Removed disappeared disk", devnode, "from dynamic volume", vol.Name)
+			}
+			changed = true
+			break
+		}
+	}
+
+	if changed {
+		if err := this.registry.Save(); err != nil {
+			log.Errorln("Could not save registry after dynamic mount changes:", err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/wrouesnel/docker-simple-disk/volumemount"
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+	"github.com/wrouesnel/docker-simple-disk/volumesetup"
+)
+
+type DynamicSuite struct {
+	driverFixture
+	db  *volumequery.DeviceDatabase
+	vol *SimpleVolume
+	// Disks which initialization was attempted on
+	initialized []string
+}
+
+var _ = Suite(&DynamicSuite{})
+
+func (this *DynamicSuite) SetUpTest(c *C) {
+	this.driverFixture.SetUpTest(c)
+
+	db, err := volumequery.SnapshotDeviceDatabase()
+	c.Assert(err, IsNil)
+	this.db = db
+
+	query := volumequery.NewVolumeQuery()
+	query.Label = "new"
+	query.DynamicMounts = true
+	this.vol = &SimpleVolume{
+		Name:   "vol",
+		Query:  query,
+		Staged: &volumemount.StagedVolume{Root: filepath.Join(this.driver.volumeRoot, "vol")},
+	}
+
+	this.initialized = nil
+	initializeBlockDevice = func(blockDevice string, query volumequery.VolumeQuery, hostname string, machineId string) error {
+		this.initialized = append(this.initialized, blockDevice)
+		return errors.New("disks are not initialized in tests")
+	}
+}
+
+func (this *DynamicSuite) TearDownTest(c *C) {
+	this.driverFixture.TearDownTest(c)
+	initializeBlockDevice = volumesetup.InitializeBlockDevice
+}
+
+func (this *DynamicSuite) TestBlankDisksAreNotAddedByDefault(c *C) {
+	changed, _ := this.driver.addDynamicDisks(this.db, this.vol)
+	c.Check(changed, Equals, false)
+	c.Check(this.initialized, HasLen, 0)
+	c.Check(this.vol.Disks, HasLen, 0)
+	c.Check(this.driver.ledger.Claimants("wwn:0x5000000000000a"), HasLen, 0)
+}
+
+func (this *DynamicSuite) TestDynamicInitializeAddsBlankDisks(c *C) {
+	this.vol.Query.DynamicInitialize = true
+
+	changed, _ := this.driver.addDynamicDisks(this.db, this.vol)
+	c.Check(changed, Equals, true)
+	c.Check(this.initialized, DeepEquals, []string{"/dev/sda"})
+	c.Check(this.vol.Disks, DeepEquals, []string{"wwn:0x5000000000000a"})
+}
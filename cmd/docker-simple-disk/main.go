@@ -12,9 +12,12 @@ import (
 	"github.com/wrouesnel/go.log"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 	"github.com/wrouesnel/docker-simple-disk/volumequery"
 	"github.com/wrouesnel/docker-simple-disk/config"
+	"github.com/wrouesnel/docker-simple-disk/volumemount"
 )
 
 const (
@@ -28,80 +31,327 @@ type SimpleVolumeDriver struct {
 	volumeRoot string
 	// Device selection rules
 	deviceSelectionRules []volumequery.DeviceSelectionRule
+	// Volumes docker has created
+	registry *VolumeRegistry
+	// Disks claimed by volumes
+	ledger *volumequery.ClaimLedger
+	// Signals the dynamic mount watcher to rescan disks
+	rescanCh chan struct{}
+	// Remove policy for volumes which don't specify one
+	removePolicy volumequery.RemovePolicy
 	// Mutex to serialize volume operations
 	mtx sync.RWMutex
 }
 
-type SimpleVolume struct {
-	// Canonical docker name used to create us
-	name string
-	// Compact UUID type format of the volume
-	typeid string
+// errorResponse converts an error to a docker plugin response.
+func errorResponse(err error) volume.Response {
+	log.Errorln(err)
+	return volume.Response{
+		Err: err.Error(),
+	}
 }
 
-// On create, check we can service the request, setup the staging volume
-// for the request.
+// On create, check we can service the request and record the volume in the
+// registry.
 func (this *SimpleVolumeDriver) Create(req volume.Request) volume.Response {
 	log.Debugln("Create:", req)
-	return volume.Response{
-		Err: errors.Errorf("Not implemented: %v", req).Error(),
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if _, found := this.registry.Get(req.Name); found {
+		log.Debugln("Volume already exists:", req.Name)
+		return volume.Response{}
+	}
+
+	query, err := volumequery.ParseVolumeQuery(req.Name, req.Options)
+	if err != nil {
+		return errorResponse(errors.WrapPrefix(err, "could not parse volume query", 0))
+	}
+
+	if err := query.Validate(); err != nil {
+		return errorResponse(errors.WrapPrefix(err, "invalid volume query", 0))
+	}
+
+	db, err := volumequery.SnapshotDeviceDatabase()
+	if err != nil {
+		return errorResponse(errors.WrapPrefix(err, "could not scan disks", 0))
+	}
+
+	diskPaths, err := this.selectDisks(db, req.Name, &query)
+	if err != nil {
+		return errorResponse(errors.WrapPrefix(err, "could not select disks for volume", 0))
+	}
+
+	vol := &SimpleVolume{
+		Name:      req.Name,
+		Query:     query,
+		CreatedAt: time.Now(),
 	}
+
+	identities, err := this.claimDisks(db, vol, diskPaths)
+	if err != nil {
+		return errorResponse(errors.WrapPrefix(err, "could not claim disks for volume", 0))
+	}
+	vol.Disks = identities
+
+	if err := this.registry.Put(vol); err != nil {
+		this.ledger.Release(vol.Name)
+		return errorResponse(err)
+	}
+
+	log.Infoln("Created volume:", req.Name)
+	return volume.Response{}
 }
 
 func (this *SimpleVolumeDriver) List(req volume.Request) volume.Response {
 	log.Debugln("List:", req)
+	this.mtx.RLock()
+	defer this.mtx.RUnlock()
+
+	registered := this.registry.List()
+	statuses := this.volumeStatuses(registered)
+
+	vols := []*volume.Volume{}
+	for _, vol := range registered {
+		vols = append(vols, &volume.Volume{
+			Name:       vol.Name,
+			Mountpoint: this.mountpoint(vol.Name),
+			Status:     statuses[vol.Name],
+		})
+	}
+
 	return volume.Response{
-		Err: errors.Errorf("Not implemented: %v", req).Error(),
+		Volumes: vols,
 	}
 }
 
 func (this *SimpleVolumeDriver) Get(req volume.Request) volume.Response {
 	log.Debugln("Get:", req)
+	this.mtx.RLock()
+	defer this.mtx.RUnlock()
+
+	vol, found := this.registry.Get(req.Name)
+	if !found {
+		return errorResponse(errors.Errorf("no such volume: %s", req.Name))
+	}
+
 	return volume.Response{
-		Err: errors.Errorf("Not implemented: %v", req).Error(),
+		Volume: &volume.Volume{
+			Name:       vol.Name,
+			Mountpoint: this.mountpoint(vol.Name),
+			Status:     this.volumeStatuses([]*SimpleVolume{vol})[vol.Name],
+		},
 	}
 }
 
+// On remove, dispose of the volume's disks according to its remove policy,
+// release its disk claims and forget it.
 func (this *SimpleVolumeDriver) Remove(req volume.Request) volume.Response {
 	log.Debugln("Remove:", req)
-	return volume.Response{
-		Err: errors.Errorf("Not implemented: %v", req).Error(),
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	vol, found := this.registry.Get(req.Name)
+	if !found {
+		return errorResponse(errors.Errorf("no such volume: %s", req.Name))
+	}
+
+	if len(vol.MountIDs) > 0 {
+		return errorResponse(errors.Errorf("volume %s is in use by %d mounts", req.Name, len(vol.MountIDs)))
+	}
+
+	// Disks are disposed of before the volume is forgotten, so if disposal
+	// fails the remove can be retried.
+	db, err := volumequery.SnapshotDeviceDatabase()
+	if err != nil {
+		return errorResponse(errors.WrapPrefix(err, "could not scan disks", 0))
+	}
+	if err := this.disposeDisks(db, vol); err != nil {
+		return errorResponse(errors.WrapPrefix(err, "could not dispose of volume disks", 0))
 	}
+
+	// If the volume can't be forgotten it stays registered with its claims,
+	// so the remove can be retried.
+	if err := this.registry.Delete(vol.Name); err != nil {
+		return errorResponse(err)
+	}
+
+	released := this.ledger.Release(vol.Name)
+	log.Infoln("Removed volume", vol.Name, "and released", len(released), "disk claims")
+	return volume.Response{}
+}
+
+// mountpoint returns the staging directory of a volume if it is mounted, or
+// a blank string if it is not.
+func (this *SimpleVolumeDriver) mountpoint(name string) string {
+	if vol, found := this.registry.Get(name); found && vol.Staged != nil {
+		return vol.Staged.Root
+	}
+	return ""
 }
 
 func (this *SimpleVolumeDriver) Path(req volume.Request) volume.Response {
 	log.Debugln("Path:", req)
+	this.mtx.RLock()
+	defer this.mtx.RUnlock()
+
+	if _, found := this.registry.Get(req.Name); !found {
+		return errorResponse(errors.Errorf("no such volume: %s", req.Name))
+	}
+
 	return volume.Response{
-		Err: errors.Errorf("Not implemented: %v", req).Error(),
+		Mountpoint: this.mountpoint(req.Name),
 	}
 }
 
+// On mount, record the mount ID using the volume. The first mount ID to use a
+// volume selects disks for it and assembles them under a staging directory.
 func (this *SimpleVolumeDriver) Mount(req volume.MountRequest) volume.Response {
 	log.Debugln("Mount:", req)
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	vol, found := this.registry.Get(req.Name)
+	if !found {
+		return errorResponse(errors.Errorf("no such volume: %s", req.Name))
+	}
+
+	if vol.Staged == nil {
+		db, err := volumequery.SnapshotDeviceDatabase()
+		if err != nil {
+			return errorResponse(errors.WrapPrefix(err, "could not scan disks", 0))
+		}
+
+		diskPaths, db, err := this.resolveDisks(db, vol)
+		if err != nil {
+			return errorResponse(errors.WrapPrefix(err, "could not find disks for volume", 0))
+		}
+
+		sources, err := diskSources(db, &vol.Query, diskPaths, nil)
+		if err != nil {
+			return errorResponse(errors.WrapPrefix(err, "could not inspect selected disks", 0))
+		}
+
+		staged, err := volumemount.Assemble(filepath.Join(this.volumeRoot, vol.Name), sources, placeholderNames(&vol.Query))
+		if err != nil {
+			return errorResponse(errors.WrapPrefix(err, "could not assemble volume", 0))
+		}
+		vol.Staged = staged
+		log.Infoln("Assembled volume", vol.Name, "at", staged.Root, "with", len(staged.Disks), "disks")
+
+		// Pick up any disks which arrived while the volume was unmounted.
+		if vol.Query.DynamicMounts {
+			this.addDynamicDisks(db, vol)
+		}
+	}
+
+	vol.AddMountID(req.ID)
+	if err := this.registry.Save(); err != nil {
+		// Without a persisted mount count the volume could be torn down from
+		// under a container after a restart, so refuse the mount.
+		vol.RemoveMountID(req.ID)
+		if len(vol.MountIDs) == 0 {
+			if terr := vol.Staged.Teardown(); terr != nil {
+				log.Errorln("Error tearing down volume after failing to persist mount:", terr)
+			}
+			vol.Staged = nil
+		}
+		return errorResponse(err)
+	}
+
+	log.Infoln("Mounted volume", vol.Name, "for", req.ID, "- active mounts:", len(vol.MountIDs))
 	return volume.Response{
-		Err: errors.Errorf("Not implemented: %v", req).Error(),
+		Mountpoint: vol.Staged.Root,
 	}
 }
 
+// On unmount, remove the mount ID from the volume. When the last mount ID is
+// removed, tear down the staging directory and the disks mounted in it.
 func (this *SimpleVolumeDriver) Unmount(req volume.UnmountRequest) volume.Response {
 	log.Debugln("Unmount:", req)
-	return volume.Response{
-		Err: errors.Errorf("Not implemented: %v", req).Error(),
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	vol, found := this.registry.Get(req.Name)
+	if !found {
+		return errorResponse(errors.Errorf("no such volume: %s", req.Name))
 	}
+
+	if !vol.RemoveMountID(req.ID) {
+		return errorResponse(errors.Errorf("volume %s is not mounted for %s", req.Name, req.ID))
+	}
+
+	if len(vol.MountIDs) == 0 && vol.Staged != nil {
+		if err := vol.Staged.Teardown(); err != nil {
+			// Keep the mount ID so the teardown can be retried. Disks which
+			// were torn down are gone from the volume either way.
+			vol.AddMountID(req.ID)
+			if serr := this.registry.Save(); serr != nil {
+				log.Errorln("Could not save registry after failed teardown:", serr)
+			}
+			return errorResponse(errors.WrapPrefix(err, "could not tear down volume", 0))
+		}
+		vol.Staged = nil
+		log.Infoln("Tore down volume", vol.Name)
+	}
+
+	if err := this.registry.Save(); err != nil {
+		return errorResponse(err)
+	}
+
+	log.Infoln("Unmounted volume", vol.Name, "for", req.ID, "- active mounts:", len(vol.MountIDs))
+	return volume.Response{}
 }
 
 func (this *SimpleVolumeDriver) Capabilities(req volume.Request) volume.Response {
 	log.Debugln("Capabilities:", req)
+	// Volumes are assembled from disks attached to this host.
 	return volume.Response{
-		Err: errors.Errorf("Not implemented: %v", req).Error(),
+		Capabilities: volume.Capability{Scope: "local"},
 	}
 }
 
-func NewSimpleVolumeDriver(volumeRoot string, deviceSelectionRules []volumequery.DeviceSelectionRule) *SimpleVolumeDriver {
-	return &SimpleVolumeDriver{
+func NewSimpleVolumeDriver(volumeRoot string, deviceSelectionRules []volumequery.DeviceSelectionRule, removePolicy volumequery.RemovePolicy) (*SimpleVolumeDriver, error) {
+	if !removePolicy.Valid() {
+		return nil, errors.Errorf("unknown remove policy: %s", removePolicy)
+	}
+
+	registry, err := LoadVolumeRegistry(volumeRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rebuild the claim ledger from the volumes which hold claims.
+	ledger := volumequery.NewClaimLedger()
+	for _, vol := range registry.List() {
+		claimant := volumequery.Claimant{
+			Volume:    vol.Name,
+			Exclusive: vol.Query.Exclusive,
+		}
+		if err := ledger.Claim(vol.Disks, claimant); err != nil {
+			log.Errorln("Conflicting disk claims found for volume", vol.Name, ":", err)
+		}
+	}
+
+	driver := &SimpleVolumeDriver{
 		volumeRoot:           volumeRoot,
 		deviceSelectionRules: deviceSelectionRules,
+		registry:             registry,
+		ledger:               ledger,
+		rescanCh:             make(chan struct{}, 1),
+		removePolicy:         removePolicy,
 	}
+
+	// Volumes which were mounted when we last exited may still be in use by
+	// containers, and anything else we left behind needs cleaning up.
+	log.Infoln("Reconciling volume registry with system state")
+	driver.reconcile().Log()
+
+	// Volumes with dynamic mounts may have missed device changes while we
+	// weren't running.
+	driver.rescanDynamicVolumes()
+
+	return driver, nil
 }
 
 func main() {
@@ -110,12 +360,16 @@ func main() {
 
 	dockerPluginPath := app.Flag("docker-plugins", "Listen path for the plugin.").Default(fmt.Sprintf("unix:///run/docker/plugins/%s.sock", PluginName)).URL()
 	volumeRoot := app.Flag("volume-root", "Path where mounted volumes should be created").Default("/tmp/docker-simple").String()
+	removePolicy := app.Flag("remove-policy", "What to do with the disks of removed volumes which don't specify a remove-policy").
+		Default(string(volumequery.RemoveKeep)).
+		Enum(string(volumequery.RemoveKeep), string(volumequery.RemoveRelease),
+			string(volumequery.RemoveCryptoErase), string(volumequery.RemoveWipe))
 
 	// Various udev matching options and some sane defaults for most users
-	cmdlineSelectionRule := volumequery.NewDeviceSelectionRule()
-	config.DefaultAppFlags(app, &cmdlineSelectionRule)
+	selectionRules := []volumequery.DeviceSelectionRule{}
+	config.DefaultAppFlags(app, &selectionRules)
 
-	kingpin.Parse()
+	kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	// Check for the programs we need to actually work
 	fsutil.MustLookupPaths(
@@ -123,6 +377,9 @@ func main() {
 		"mkfs",
 		"cryptsetup",
 		"partprobe",
+		"blkdiscard",
+		"mount",
+		"umount",
 	)
 
 	if !fsutil.PathExists(*volumeRoot) {
@@ -137,8 +394,16 @@ func main() {
 	log.Infoln("Volume mount root:", *volumeRoot)
 	log.Infoln("Docker Plugin Path:", *dockerPluginPath)
 
-	driver := NewSimpleVolumeDriver(*volumeRoot,
-		[]volumequery.DeviceSelectionRule{cmdlineSelectionRule})
+	driver, err := NewSimpleVolumeDriver(*volumeRoot,
+		selectionRules,
+		volumequery.RemovePolicy(*removePolicy))
+	if err != nil {
+		log.Panicln("Could not initialize volume driver:", err)
+	}
+	if err := driver.WatchDevices(make(chan struct{})); err != nil {
+		log.Panicln("Could not start udev monitor:", err)
+	}
+
 	handler := volume.NewHandler(driver)
 
 	if err := handler.ServeUnix("root", PluginName); err != nil {
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	. "gopkg.in/check.v1"
+
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+// testSnapshotPath is the device snapshot the volumequery tests use.
+var testSnapshotPath = filepath.Join("..", "..", "volumequery", "testdata", "devices.json")
+
+// driverFixture is embedded by suites which exercise the driver. Each test
+// gets a driver with an empty registry under a temporary volume root, which
+// finds the whole disks of the test device snapshot. The driver is not
+// reconciled against the system.
+type driverFixture struct {
+	driver              *SimpleVolumeDriver
+	previousSource      volumequery.DeviceSource
+	previousUsageSource volumequery.DiskUsageSource
+}
+
+func (this *driverFixture) SetUpTest(c *C) {
+	snapshot, err := volumequery.LoadSnapshotDeviceSource(testSnapshotPath)
+	c.Assert(err, IsNil)
+	this.previousSource = volumequery.GetDeviceSource()
+	this.previousUsageSource = volumequery.GetDiskUsageSource()
+	volumequery.SetDeviceSource(snapshot)
+	volumequery.SetDiskUsageSource(volumequery.NewStaticDiskUsageSource(nil))
+
+	root := c.MkDir()
+	registry, err := LoadVolumeRegistry(root)
+	c.Assert(err, IsNil)
+	this.driver = &SimpleVolumeDriver{
+		volumeRoot: root,
+		deviceSelectionRules: []volumequery.DeviceSelectionRule{
+			volumequery.DeviceSelectionRule{
+				Subsystems: []string{"block"},
+				Name:       []string{"sd*"},
+				Properties: map[string]string{"DEVTYPE": "disk"},
+			},
+		},
+		registry:     registry,
+		ledger:       volumequery.NewClaimLedger(),
+		rescanCh:     make(chan struct{}, 1),
+		removePolicy: volumequery.RemoveKeep,
+	}
+}
+
+func (this *driverFixture) TearDownTest(c *C) {
+	volumequery.SetDeviceSource(this.previousSource)
+	volumequery.SetDiskUsageSource(this.previousUsageSource)
+}
+
+type MountIDSuite struct {
+	driverFixture
+}
+
+var _ = Suite(&MountIDSuite{})
+
+func (this *MountIDSuite) TestMountIDs(c *C) {
+	vol := &SimpleVolume{Name: "vol"}
+	vol.AddMountID("a")
+	vol.AddMountID("b")
+	vol.AddMountID("a")
+	c.Check(vol.MountIDs, DeepEquals, []string{"a", "b"})
+	c.Check(vol.HasMountID("b"), Equals, true)
+
+	c.Check(vol.RemoveMountID("a"), Equals, true)
+	c.Check(vol.RemoveMountID("a"), Equals, false)
+	c.Check(vol.MountIDs, DeepEquals, []string{"b"})
+}
+
+func (this *MountIDSuite) TestUnmountPersistsMountIDs(c *C) {
+	c.Assert(this.driver.registry.Put(&SimpleVolume{Name: "vol", MountIDs: []string{"a", "b"}}), IsNil)
+
+	resp := this.driver.Unmount(volume.UnmountRequest{Name: "vol", ID: "c"})
+	c.Check(resp.Err, Not(Equals), "")
+
+	resp = this.driver.Unmount(volume.UnmountRequest{Name: "vol", ID: "a"})
+	c.Check(resp.Err, Equals, "")
+
+	registry, err := LoadVolumeRegistry(this.driver.volumeRoot)
+	c.Assert(err, IsNil)
+	vol, found := registry.Get("vol")
+	c.Assert(found, Equals, true)
+	c.Check(vol.MountIDs, DeepEquals, []string{"b"})
+}
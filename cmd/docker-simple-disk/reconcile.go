@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-simple-disk/fsutil"
+	"github.com/wrouesnel/docker-simple-disk/volumeaccess"
+	"github.com/wrouesnel/docker-simple-disk/volumemount"
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+// Replaced by tests
+var (
+	mountInfoPath = fsutil.ProcSelfMountInfo
+	listMappings  = volumeaccess.ListMappings
+	closeMapping  = volumeaccess.CloseMapping
+	unmountOrphan = volumemount.Unmount
+)
+
+// ReconcileReport summarizes what startup reconciliation found and did.
+type ReconcileReport struct {
+	// Volumes whose mounts were adopted intact
+	Adopted []string
+	// Volumes adopted without some of their disks
+	Degraded []string
+	// Volumes whose mount state could not be recovered and was cleared
+	Reset []string
+	// Orphaned mountpoints which were unmounted
+	UnmountedOrphans []string
+	// Orphaned encrypted mappings which were closed
+	ClosedMappings []string
+	// Problems which could not be resolved automatically
+	Errors []string
+}
+
+// errorf records and logs an unresolved problem.
+func (this *ReconcileReport) errorf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Errorln("Reconcile:", msg)
+	this.Errors = append(this.Errors, msg)
+}
+
+// Log writes a summary of the report.
+func (this *ReconcileReport) Log() {
+	log.Infof("Reconcile summary: %d adopted, %d degraded, %d reset, %d orphan mounts unmounted, %d orphan mappings closed, %d errors",
+		len(this.Adopted), len(this.Degraded), len(this.Reset),
+		len(this.UnmountedOrphans), len(this.ClosedMappings), len(this.Errors))
+	if len(this.Degraded) > 0 {
+		log.Warnln("Reconcile: degraded volumes:", strings.Join(this.Degraded, " "))
+	}
+	if len(this.Reset) > 0 {
+		log.Warnln("Reconcile: reset volumes:", strings.Join(this.Reset, " "))
+	}
+	for _, msg := range this.Errors {
+		log.Errorln("Reconcile: unresolved:", msg)
+	}
+}
+
+// mountsByMountpoint indexes a mount table by mountpoint. Where mounts are
+// stacked the topmost mount wins.
+func mountsByMountpoint(mounts []fsutil.MountInfo) map[string]fsutil.MountInfo {
+	index := make(map[string]fsutil.MountInfo, len(mounts))
+	for _, mount := range mounts {
+		index[mount.Mountpoint] = mount
+	}
+	return index
+}
+
+// isSimpleDataPartition checks if a device is the data partition of an
+// initialized simple disk.
+func isSimpleDataPartition(db *volumequery.DeviceDatabase, devicePath string) bool {
+	disks, err := db.ParentDisk(devicePath)
+	if err != nil {
+		return false
+	}
+	for diskPath, _ := range disks {
+		_, dataPath, err := db.DiskLabelAndVolumePath(diskPath)
+		if err != nil {
+			return false
+		}
+		if dataPath == devicePath {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcile compares the persisted registry with the live mount table and
+// device-mapper tables. Mounts which are still valid are adopted, and anything
+// left behind by a previous run which is no longer valid is cleaned up.
+func (this *SimpleVolumeDriver) reconcile() *ReconcileReport {
+	report := &ReconcileReport{}
+
+	root, err := filepath.EvalSymlinks(this.volumeRoot)
+	if err != nil {
+		report.errorf("could not resolve volume root %s: %v", this.volumeRoot, err)
+		return report
+	}
+
+	mounts, err := fsutil.ReadMountInfo(mountInfoPath)
+	if err != nil {
+		report.errorf("could not read mount table: %v", err)
+		return report
+	}
+	mountIndex := mountsByMountpoint(mounts)
+
+	mappings, err := listMappings()
+	if err != nil {
+		report.errorf("could not read device-mapper table: %v", err)
+		return report
+	}
+	mappingIndex := make(map[string]volumeaccess.Mapping, len(mappings))
+	for _, mapping := range mappings {
+		mappingIndex[mapping.Name] = mapping
+	}
+
+	// Mountpoints and mappings which belong to adopted volumes.
+	claimedMounts := make(map[string]struct{})
+	claimedMappings := make(map[string]struct{})
+
+	for _, vol := range this.registry.List() {
+		if vol.Staged == nil {
+			continue
+		}
+
+		if len(vol.MountIDs) == 0 {
+			log.Warnln("Reconcile: volume", vol.Name, "has mount state but no users. Resetting.")
+			vol.Staged = nil
+			report.Reset = append(report.Reset, vol.Name)
+			continue
+		}
+
+		// Without the staging tmpfs there is nothing to adopt.
+		stagedRoot, err := filepath.EvalSymlinks(vol.Staged.Root)
+		if err != nil {
+			stagedRoot = vol.Staged.Root
+		}
+		if mount, found := mountIndex[stagedRoot]; !found || mount.FSType != "tmpfs" {
+			log.Warnln("Reconcile: volume", vol.Name, "staging tmpfs is not mounted. Resetting.")
+			vol.Staged = nil
+			vol.MountIDs = nil
+			report.Reset = append(report.Reset, vol.Name)
+			continue
+		}
+
+		validDisks := []*volumemount.DiskMount{}
+		for _, disk := range vol.Staged.Disks {
+			mountpoint := filepath.Join(stagedRoot, disk.Name)
+			if _, found := mountIndex[mountpoint]; !found {
+				log.Warnln("Reconcile: volume", vol.Name, "disk", disk.DataPath, "is no longer mounted. Dropping.")
+				continue
+			}
+			if disk.MappingName != "" {
+				if _, found := mappingIndex[disk.MappingName]; !found {
+					log.Warnln("Reconcile: volume", vol.Name, "disk", disk.DataPath, "mapping", disk.MappingName, "no longer exists. Dropping.")
+					continue
+				}
+			}
+			validDisks = append(validDisks, disk)
+		}
+
+		// A volume is never assembled from fewer disks than its query
+		// requires, so one which has lost too many isn't adopted either.
+		if len(validDisks) < int(vol.Query.MinDisks) {
+			log.Warnln("Reconcile: volume", vol.Name, "has", len(validDisks), "of the", vol.Query.MinDisks, "disks it requires. Resetting.")
+			vol.Staged = nil
+			vol.MountIDs = nil
+			report.Reset = append(report.Reset, vol.Name)
+			continue
+		}
+
+		degraded := len(validDisks) != len(vol.Staged.Disks)
+		vol.Staged.Disks = validDisks
+		if err := vol.Staged.Attach(); err != nil {
+			report.errorf("could not reattach volume %s: %v", vol.Name, err)
+			vol.Staged = nil
+			vol.MountIDs = nil
+			report.Reset = append(report.Reset, vol.Name)
+			continue
+		}
+
+		claimedMounts[stagedRoot] = struct{}{}
+		for _, disk := range vol.Staged.Disks {
+			claimedMounts[filepath.Join(stagedRoot, disk.Name)] = struct{}{}
+			if disk.MappingName != "" {
+				claimedMappings[disk.MappingName] = struct{}{}
+			}
+		}
+		// Mappings of removed disks may still be busy, so are closed by
+		// the volume when they can be rather than as orphans.
+		for _, name := range vol.Staged.DeferredMappings {
+			claimedMappings[name] = struct{}{}
+		}
+		vol.Staged.CloseDeferredMappings()
+
+		if degraded {
+			log.Warnln("Reconcile: adopted degraded volume", vol.Name, "with", len(vol.Staged.Disks), "disks")
+			report.Degraded = append(report.Degraded, vol.Name)
+		} else {
+			log.Infoln("Reconcile: adopted volume", vol.Name, "with", len(vol.Staged.Disks), "disks")
+			report.Adopted = append(report.Adopted, vol.Name)
+		}
+	}
+
+	// Unmount anything under the volume root we did not adopt. Unmount the
+	// deepest mountpoints first so disks come off before their staging tmpfs.
+	orphanMounts := []string{}
+	for mountpoint, _ := range mountIndex {
+		if !strings.HasPrefix(mountpoint, root+string(filepath.Separator)) {
+			continue
+		}
+		if _, found := claimedMounts[mountpoint]; found {
+			continue
+		}
+		orphanMounts = append(orphanMounts, mountpoint)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(orphanMounts)))
+	for _, mountpoint := range orphanMounts {
+		log.Infoln("Reconcile: unmounting orphaned mountpoint", mountpoint)
+		if err := unmountOrphan(mountpoint); err != nil {
+			report.errorf("could not unmount orphaned mountpoint %s: %v", mountpoint, err)
+			continue
+		}
+		report.UnmountedOrphans = append(report.UnmountedOrphans, mountpoint)
+	}
+
+	// Remove empty staging directories left behind. Non-empty directories are
+	// never removed.
+	entries, err := filepath.Glob(filepath.Join(root, "*"))
+	if err != nil {
+		report.errorf("could not list volume root: %v", err)
+	}
+	for _, entry := range entries {
+		if _, found := claimedMounts[entry]; found || !fsutil.PathIsDir(entry) {
+			continue
+		}
+		if err := os.Remove(entry); err == nil {
+			log.Infoln("Reconcile: removed stale staging directory", entry)
+		}
+	}
+
+	// Close encrypted mappings of simple disks which nothing is using. Only
+	// mappings named the way OpenEncryptedDevice names them are considered.
+	if len(report.UnmountedOrphans) > 0 {
+		if mounts, err = fsutil.ReadMountInfo(mountInfoPath); err != nil {
+			report.errorf("could not reread mount table: %v", err)
+			mounts = nil
+		}
+	}
+	mountedDevnums := make(map[string]struct{}, len(mounts))
+	for _, mount := range mounts {
+		mountedDevnums[fmt.Sprintf("%d:%d", mount.Major, mount.Minor)] = struct{}{}
+	}
+
+	db, err := volumequery.SnapshotDeviceDatabase()
+	if err != nil {
+		report.errorf("could not scan disks for orphaned mappings: %v", err)
+		mappings = nil
+	}
+
+	for _, mapping := range mappings {
+		if !mapping.IsCrypt() {
+			continue
+		}
+		if _, found := claimedMappings[mapping.Name]; found {
+			continue
+		}
+		if _, err := uuid.FromString(mapping.Name); err != nil {
+			continue
+		}
+		if _, found := mountedDevnums[mapping.Devnum]; found {
+			log.Debugln("Reconcile: ignoring mounted mapping", mapping.Name)
+			continue
+		}
+		if len(mapping.Slaves) != 1 || !isSimpleDataPartition(db, mapping.Slaves[0]) {
+			log.Debugln("Reconcile: ignoring mapping which is not of a simple disk", mapping.Name)
+			continue
+		}
+
+		log.Infoln("Reconcile: closing orphaned mapping", mapping.Name, "of", mapping.Slaves[0])
+		if err := closeMapping(mapping.Name); err != nil {
+			report.errorf("could not close orphaned mapping %s: %v", mapping.Name, err)
+			continue
+		}
+		report.ClosedMappings = append(report.ClosedMappings, mapping.Name)
+	}
+
+	if err := this.registry.Save(); err != nil {
+		report.errorf("could not save reconciled registry: %v", err)
+	}
+
+	return report
+}
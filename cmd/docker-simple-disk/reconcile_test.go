@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/wrouesnel/docker-simple-disk/fsutil"
+	"github.com/wrouesnel/docker-simple-disk/volumeaccess"
+	"github.com/wrouesnel/docker-simple-disk/volumemount"
+)
+
+type ReconcileSuite struct {
+	driverFixture
+	root     string
+	mounts   []string
+	mappings []volumeaccess.Mapping
+	// Mountpoints and mappings the reconcile removed
+	unmounted []string
+	closed    []string
+}
+
+var _ = Suite(&ReconcileSuite{})
+
+func (this *ReconcileSuite) SetUpTest(c *C) {
+	this.driverFixture.SetUpTest(c)
+	root, err := filepath.EvalSymlinks(this.driver.volumeRoot)
+	c.Assert(err, IsNil)
+	this.root = root
+	this.mounts = []string{"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw"}
+	this.mappings = nil
+	this.unmounted = nil
+	this.closed = nil
+
+	mountInfoPath = filepath.Join(c.MkDir(), "mountinfo")
+	listMappings = func() ([]volumeaccess.Mapping, error) {
+		return this.mappings, nil
+	}
+	closeMapping = func(name string) error {
+		this.closed = append(this.closed, name)
+		return nil
+	}
+	unmountOrphan = func(path string) error {
+		this.unmounted = append(this.unmounted, path)
+		return nil
+	}
+}
+
+func (this *ReconcileSuite) TearDownTest(c *C) {
+	this.driverFixture.TearDownTest(c)
+	mountInfoPath = fsutil.ProcSelfMountInfo
+	listMappings = volumeaccess.ListMappings
+	closeMapping = volumeaccess.CloseMapping
+	unmountOrphan = volumemount.Unmount
+}
+
+// mount adds a mount under the volume root to the fake mount table.
+func (this *ReconcileSuite) mount(devnum string, fstype string, path ...string) {
+	mountpoint := filepath.Join(append([]string{this.root}, path...)...)
+	this.mounts = append(this.mounts, fmt.Sprintf("%d 22 %s / %s rw,relatime - %s %s rw",
+		len(this.mounts)+30, devnum, mountpoint, fstype, fstype))
+}
+
+// stage registers a mounted volume whose disks are mounted under its staging
+// directory.
+func (this *ReconcileSuite) stage(c *C, name string, mountIDs []string, disks ...string) {
+	staged := &volumemount.StagedVolume{Root: filepath.Join(this.root, name)}
+	for _, disk := range disks {
+		staged.Disks = append(staged.Disks, &volumemount.DiskMount{
+			DiskSource: volumemount.DiskSource{Name: disk, DataPath: "/dev/sdb2"},
+			Mountpoint: filepath.Join(staged.Root, disk),
+		})
+	}
+	c.Assert(this.driver.registry.Put(&SimpleVolume{Name: name, MountIDs: mountIDs, Staged: staged}), IsNil)
+}
+
+func (this *ReconcileSuite) reconcile(c *C) *ReconcileReport {
+	data := strings.Join(this.mounts, "\n") + "\n"
+	c.Assert(ioutil.WriteFile(mountInfoPath, []byte(data), os.FileMode(0644)), IsNil)
+	return this.driver.reconcile()
+}
+
+func (this *ReconcileSuite) TestAdoptsMountedVolumes(c *C) {
+	this.stage(c, "intact", []string{"m1"}, "simple0")
+	this.mount("0:40", "tmpfs", "intact")
+	this.mount("8:18", "ext4", "intact", "simple0")
+
+	this.stage(c, "degraded", []string{"m2"}, "simple0", "simple1")
+	this.mount("0:41", "tmpfs", "degraded")
+	this.mount("8:34", "ext4", "degraded", "simple1")
+
+	report := this.reconcile(c)
+	c.Check(report.Errors, HasLen, 0)
+	c.Check(report.Adopted, DeepEquals, []string{"intact"})
+	c.Check(report.Degraded, DeepEquals, []string{"degraded"})
+	c.Check(this.unmounted, HasLen, 0)
+
+	vol, _ := this.driver.registry.Get("degraded")
+	c.Assert(vol.Staged, NotNil)
+	c.Assert(vol.Staged.Disks, HasLen, 1)
+	c.Check(vol.Staged.Disks[0].Name, Equals, "simple1")
+}
+
+func (this *ReconcileSuite) TestResetsUnrecoverableVolumes(c *C) {
+	this.stage(c, "unused", nil, "simple0")
+	this.mount("0:40", "tmpfs", "unused")
+	this.stage(c, "unmounted", []string{"m1"}, "simple0")
+
+	report := this.reconcile(c)
+	sort.Strings(report.Reset)
+	c.Check(report.Reset, DeepEquals, []string{"unmounted", "unused"})
+
+	// The reset state is persisted.
+	registry, err := LoadVolumeRegistry(this.driver.volumeRoot)
+	c.Assert(err, IsNil)
+	for _, vol := range registry.List() {
+		c.Check(vol.Staged, IsNil)
+		c.Check(vol.MountIDs, HasLen, 0)
+	}
+
+	// The tmpfs of the volume nothing was using is an orphan.
+	c.Check(this.unmounted, DeepEquals, []string{filepath.Join(this.root, "unused")})
+}
+
+func (this *ReconcileSuite) TestResetsVolumesBelowMinDisks(c *C) {
+	this.stage(c, "short", []string{"m1"}, "simple0", "simple1")
+	vol, _ := this.driver.registry.Get("short")
+	vol.Query.MinDisks = 2
+	c.Assert(this.driver.registry.Put(vol), IsNil)
+	this.mount("0:40", "tmpfs", "short")
+	this.mount("8:18", "ext4", "short", "simple0")
+
+	report := this.reconcile(c)
+	c.Check(report.Adopted, HasLen, 0)
+	c.Check(report.Degraded, HasLen, 0)
+	c.Check(report.Reset, DeepEquals, []string{"short"})
+
+	vol, _ = this.driver.registry.Get("short")
+	c.Check(vol.Staged, IsNil)
+	c.Check(vol.MountIDs, HasLen, 0)
+
+	// Its remaining mounts are orphans.
+	c.Check(this.unmounted, DeepEquals, []string{
+		filepath.Join(this.root, "short", "simple0"),
+		filepath.Join(this.root, "short"),
+	})
+}
+
+func (this *ReconcileSuite) TestCleansUpOrphans(c *C) {
+	this.mount("0:40", "tmpfs", "orphan")
+	this.mount("8:18", "ext4", "orphan", "simple0")
+	this.mount("253:7", "ext4", "orphan", "simple1")
+
+	c.Assert(os.Mkdir(filepath.Join(this.root, "empty"), os.FileMode(0755)), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(this.root, "nonempty"), os.FileMode(0755)), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(this.root, "nonempty", "data"), nil, os.FileMode(0644)), IsNil)
+
+	crypt := volumeaccess.CryptUUIDPrefix + "test"
+	this.mappings = []volumeaccess.Mapping{
+		// Orphaned mapping of a simple disk
+		{Name: "0b5e3c2f-1d9e-4a4e-9c67-2b3e1cf3f0a1", UUID: crypt, Devnum: "253:5", Slaves: []string{"/dev/sdb2"}},
+		// Still mounted
+		{Name: "1b5e3c2f-1d9e-4a4e-9c67-2b3e1cf3f0a1", UUID: crypt, Devnum: "253:7", Slaves: []string{"/dev/sdb2"}},
+		// Not on a simple disk
+		{Name: "2b5e3c2f-1d9e-4a4e-9c67-2b3e1cf3f0a1", UUID: crypt, Devnum: "253:9", Slaves: []string{"/dev/sda"}},
+		// Not dm-crypt
+		{Name: "3b5e3c2f-1d9e-4a4e-9c67-2b3e1cf3f0a1", UUID: "LVM-test", Devnum: "253:10", Slaves: []string{"/dev/sdb2"}},
+	}
+
+	report := this.reconcile(c)
+	c.Check(report.Errors, HasLen, 0)
+
+	// Disks come off before their staging tmpfs.
+	c.Check(this.unmounted, DeepEquals, []string{
+		filepath.Join(this.root, "orphan", "simple1"),
+		filepath.Join(this.root, "orphan", "simple0"),
+		filepath.Join(this.root, "orphan"),
+	})
+	c.Check(this.closed, DeepEquals, []string{"0b5e3c2f-1d9e-4a4e-9c67-2b3e1cf3f0a1"})
+	c.Check(report.ClosedMappings, DeepEquals, this.closed)
+
+	_, err := os.Stat(filepath.Join(this.root, "empty"))
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(filepath.Join(this.root, "nonempty"))
+	c.Check(err, IsNil)
+}
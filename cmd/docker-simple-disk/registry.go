@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/wrouesnel/docker-simple-disk/fsutil"
+	"github.com/wrouesnel/docker-simple-disk/volumemount"
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+	"github.com/wrouesnel/go.log"
+)
+
+// Docker volume names must start with an alphanumeric character, so a leading
+// "." guarantees the registry can never collide with a volume directory.
+const registryFilename string = ".simple-volumes.json"
+
+var (
+	errRegistryLoadFailed = errors.New("could not load volume registry")
+	errRegistrySaveFailed = errors.New("could not save volume registry")
+)
+
+// SimpleVolume is the persisted record of a volume created through the driver.
+type SimpleVolume struct {
+	// Canonical docker name used to create us
+	Name string `json:"name"`
+	// Query the volume was created with
+	Query volumequery.VolumeQuery `json:"query"`
+	// Time the volume was created
+	CreatedAt time.Time `json:"created_at"`
+	// Identities of the disks claimed by the volume
+	Disks []string `json:"disks"`
+	// Docker mount IDs currently using the volume
+	MountIDs []string `json:"mount_ids"`
+	// Assembled volume while there are mount IDs using it
+	Staged *volumemount.StagedVolume `json:"staged,omitempty"`
+}
+
+// HasMountID checks if the given docker mount ID is using the volume.
+func (this *SimpleVolume) HasMountID(id string) bool {
+	for _, mountID := range this.MountIDs {
+		if mountID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// AddMountID records a docker mount ID as using the volume.
+func (this *SimpleVolume) AddMountID(id string) {
+	if !this.HasMountID(id) {
+		this.MountIDs = append(this.MountIDs, id)
+	}
+}
+
+// RemoveMountID removes a docker mount ID from the volume. Returns false if
+// the ID was not using the volume.
+func (this *SimpleVolume) RemoveMountID(id string) bool {
+	for idx, mountID := range this.MountIDs {
+		if mountID == id {
+			this.MountIDs = append(this.MountIDs[:idx], this.MountIDs[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// volumeRegistryFile is the on-disk format of the registry.
+type volumeRegistryFile struct {
+	Volumes []*SimpleVolume `json:"volumes"`
+}
+
+// VolumeRegistry holds the set of volumes docker knows about. It is persisted
+// under the volume root so volumes survive plugin restarts. It does no locking
+// of its own - callers serialize access via the driver mutex.
+type VolumeRegistry struct {
+	// Path the registry is persisted to
+	path string
+	// Volumes by docker name
+	volumes map[string]*SimpleVolume
+}
+
+// LoadVolumeRegistry loads the registry from the given volume root, returning
+// an empty registry if none has been saved yet.
+func LoadVolumeRegistry(volumeRoot string) (*VolumeRegistry, error) {
+	registry := &VolumeRegistry{
+		path:    filepath.Join(volumeRoot, registryFilename),
+		volumes: make(map[string]*SimpleVolume),
+	}
+
+	if !fsutil.PathExists(registry.path) {
+		log.Infoln("No volume registry found. Starting with an empty registry:", registry.path)
+		return registry, nil
+	}
+
+	data, err := ioutil.ReadFile(registry.path)
+	if err != nil {
+		return nil, errwrap.Wrap(errRegistryLoadFailed, err)
+	}
+
+	registryFile := volumeRegistryFile{}
+	if err := json.Unmarshal(data, &registryFile); err != nil {
+		return nil, errwrap.Wrap(errRegistryLoadFailed, err)
+	}
+
+	for _, vol := range registryFile.Volumes {
+		registry.volumes[vol.Name] = vol
+	}
+
+	log.Infoln("Loaded", len(registry.volumes), "volumes from registry:", registry.path)
+	return registry, nil
+}
+
+// Get returns the named volume if it is registered.
+func (this *VolumeRegistry) Get(name string) (*SimpleVolume, bool) {
+	vol, found := this.volumes[name]
+	return vol, found
+}
+
+// List returns all registered volumes sorted by name.
+func (this *VolumeRegistry) List() []*SimpleVolume {
+	return sortedVolumes(this.volumes)
+}
+
+// sortedVolumes returns the volumes of a registry map sorted by name.
+func sortedVolumes(volumes map[string]*SimpleVolume) []*SimpleVolume {
+	names := make([]string, 0, len(volumes))
+	for name, _ := range volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vols := make([]*SimpleVolume, 0, len(names))
+	for _, name := range names {
+		vols = append(vols, volumes[name])
+	}
+	return vols
+}
+
+// Put adds or replaces a volume and persists the registry. If the registry
+// can't be persisted it is left unchanged.
+func (this *VolumeRegistry) Put(vol *SimpleVolume) error {
+	volumes := this.copyVolumes()
+	volumes[vol.Name] = vol
+	return this.replace(volumes)
+}
+
+// Delete removes a volume and persists the registry. If the registry can't be
+// persisted it is left unchanged.
+func (this *VolumeRegistry) Delete(name string) error {
+	volumes := this.copyVolumes()
+	delete(volumes, name)
+	return this.replace(volumes)
+}
+
+// copyVolumes returns a copy of the registry map.
+func (this *VolumeRegistry) copyVolumes() map[string]*SimpleVolume {
+	volumes := make(map[string]*SimpleVolume, len(this.volumes)+1)
+	for name, vol := range this.volumes {
+		volumes[name] = vol
+	}
+	return volumes
+}
+
+// replace persists a new registry map, and only then makes it the registry so
+// the registry never holds changes which weren't persisted.
+func (this *VolumeRegistry) replace(volumes map[string]*SimpleVolume) error {
+	if err := this.write(volumes); err != nil {
+		return err
+	}
+	this.volumes = volumes
+	return nil
+}
+
+// Save persists the registry.
+func (this *VolumeRegistry) Save() error {
+	return this.write(this.volumes)
+}
+
+// write persists a registry map. The registry is written to a temporary file
+// and renamed into place so a crash never leaves a partially written file.
+func (this *VolumeRegistry) write(volumes map[string]*SimpleVolume) error {
+	data, err := json.MarshalIndent(volumeRegistryFile{Volumes: sortedVolumes(volumes)}, "", "  ")
+	if err != nil {
+		return errwrap.Wrap(errRegistrySaveFailed, err)
+	}
+
+	// The registry holds encryption passphrases, so keep it private.
+	tmpPath := this.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, os.FileMode(0600)); err != nil {
+		return errwrap.Wrap(errRegistrySaveFailed, err)
+	}
+
+	if err := os.Rename(tmpPath, this.path); err != nil {
+		return errwrap.Wrap(errRegistrySaveFailed, err)
+	}
+
+	return nil
+}
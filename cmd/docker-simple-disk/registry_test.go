@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hashicorp/errwrap"
+	. "gopkg.in/check.v1"
+
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type RegistrySuite struct {
+	root string
+}
+
+var _ = Suite(&RegistrySuite{})
+
+func (this *RegistrySuite) SetUpTest(c *C) {
+	this.root = c.MkDir()
+}
+
+func (this *RegistrySuite) TestLoadMissingRegistry(c *C) {
+	registry, err := LoadVolumeRegistry(this.root)
+	c.Assert(err, IsNil)
+	c.Check(registry.List(), HasLen, 0)
+}
+
+func (this *RegistrySuite) TestRegistryPersists(c *C) {
+	registry, err := LoadVolumeRegistry(this.root)
+	c.Assert(err, IsNil)
+
+	created := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.Assert(registry.Put(&SimpleVolume{
+		Name:      "vol2",
+		Query:     volumequery.VolumeQuery{Label: "two", EncryptionKey: "secret"},
+		CreatedAt: created,
+	}), IsNil)
+	c.Assert(registry.Put(&SimpleVolume{
+		Name:      "vol1",
+		CreatedAt: created,
+		MountIDs:  []string{"mount1"},
+	}), IsNil)
+
+	// The registry holds encryption passphrases.
+	info, err := os.Stat(filepath.Join(this.root, registryFilename))
+	c.Assert(err, IsNil)
+	c.Check(info.Mode().Perm(), Equals, os.FileMode(0600))
+
+	loaded, err := LoadVolumeRegistry(this.root)
+	c.Assert(err, IsNil)
+	vols := loaded.List()
+	c.Assert(vols, HasLen, 2)
+	c.Check(vols[0].Name, Equals, "vol1")
+	c.Check(vols[0].MountIDs, DeepEquals, []string{"mount1"})
+	c.Check(vols[1].Name, Equals, "vol2")
+	c.Check(vols[1].Query.Label, Equals, "two")
+	c.Check(vols[1].Query.EncryptionKey, Equals, "secret")
+	c.Check(vols[1].CreatedAt.Equal(created), Equals, true)
+
+	c.Assert(loaded.Delete("vol1"), IsNil)
+	loaded, err = LoadVolumeRegistry(this.root)
+	c.Assert(err, IsNil)
+	_, found := loaded.Get("vol1")
+	c.Check(found, Equals, false)
+	_, found = loaded.Get("vol2")
+	c.Check(found, Equals, true)
+}
+
+func (this *RegistrySuite) TestLoadCorruptRegistry(c *C) {
+	path := filepath.Join(this.root, registryFilename)
+	c.Assert(ioutil.WriteFile(path, []byte("{not json"), os.FileMode(0600)), IsNil)
+
+	_, err := LoadVolumeRegistry(this.root)
+	c.Check(errwrap.Contains(err, errRegistryLoadFailed.Error()), Equals, true)
+}
+
+func (this *RegistrySuite) TestFailedSaveLeavesRegistryUnchanged(c *C) {
+	registry, err := LoadVolumeRegistry(this.root)
+	c.Assert(err, IsNil)
+	c.Assert(registry.Put(&SimpleVolume{Name: "vol1"}), IsNil)
+
+	registry.path = filepath.Join(this.root, "missing", registryFilename)
+	c.Check(errwrap.Contains(registry.Put(&SimpleVolume{Name: "vol2"}), errRegistrySaveFailed.Error()), Equals, true)
+	_, found := registry.Get("vol2")
+	c.Check(found, Equals, false)
+
+	c.Check(errwrap.Contains(registry.Delete("vol1"), errRegistrySaveFailed.Error()), Equals, true)
+	_, found = registry.Get("vol1")
+	c.Check(found, Equals, true)
+}
+
+type RegistrySaveSuite struct {
+	driverFixture
+	registryPath string
+}
+
+var _ = Suite(&RegistrySaveSuite{})
+
+func (this *RegistrySaveSuite) SetUpTest(c *C) {
+	this.driverFixture.SetUpTest(c)
+	this.registryPath = this.driver.registry.path
+}
+
+// breakRegistry makes saving the registry fail until it is restored.
+func (this *RegistrySaveSuite) breakRegistry(c *C) {
+	this.driver.registry.path = filepath.Join(c.MkDir(), "missing", registryFilename)
+}
+
+func (this *RegistrySaveSuite) restoreRegistry() {
+	this.driver.registry.path = this.registryPath
+}
+
+func (this *RegistrySaveSuite) TestCreateSaveFailure(c *C) {
+	req := volume.Request{Name: "label.new_min-disks.1"}
+
+	this.breakRegistry(c)
+	resp := this.driver.Create(req)
+	c.Check(resp.Err, Not(Equals), "")
+	_, found := this.driver.registry.Get(req.Name)
+	c.Check(found, Equals, false)
+	c.Check(this.driver.ledger.Claimants("wwn:0x5000000000000a"), HasLen, 0)
+
+	// A retry creates the volume rather than finding it already exists.
+	this.restoreRegistry()
+	resp = this.driver.Create(req)
+	c.Assert(resp.Err, Equals, "")
+
+	registry, err := LoadVolumeRegistry(this.driver.volumeRoot)
+	c.Assert(err, IsNil)
+	vol, found := registry.Get(req.Name)
+	c.Assert(found, Equals, true)
+	c.Check(vol.Disks, DeepEquals, []string{"wwn:0x5000000000000a"})
+	c.Check(this.driver.ledger.Claimants("wwn:0x5000000000000a"), HasLen, 1)
+}
+
+func (this *RegistrySaveSuite) TestRemoveSaveFailure(c *C) {
+	vol := &SimpleVolume{Name: "vol", Disks: []string{"wwn:0x5000000000000a"}}
+	c.Assert(this.driver.registry.Put(vol), IsNil)
+	c.Assert(this.driver.ledger.Claim(vol.Disks, volumequery.Claimant{Volume: "vol"}), IsNil)
+
+	this.breakRegistry(c)
+	resp := this.driver.Remove(volume.Request{Name: "vol"})
+	c.Check(resp.Err, Not(Equals), "")
+	_, found := this.driver.registry.Get("vol")
+	c.Check(found, Equals, true)
+	c.Check(this.driver.ledger.Claimants("wwn:0x5000000000000a"), HasLen, 1)
+
+	this.restoreRegistry()
+	resp = this.driver.Remove(volume.Request{Name: "vol"})
+	c.Assert(resp.Err, Equals, "")
+
+	registry, err := LoadVolumeRegistry(this.driver.volumeRoot)
+	c.Assert(err, IsNil)
+	_, found = registry.Get("vol")
+	c.Check(found, Equals, false)
+	c.Check(this.driver.ledger.Claimants("wwn:0x5000000000000a"), HasLen, 0)
+}
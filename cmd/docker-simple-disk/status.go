@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+const (
+	// Replaces the encryption passphrase in reported queries.
+	redactedPassphrase string = "<redacted>"
+)
+
+// DiskStatus describes a member disk of a volume in Get/List responses.
+type DiskStatus struct {
+	// Stable identity the disk is claimed by
+	Identity string `json:"identity"`
+	// Whether the disk is currently attached
+	Present bool `json:"present"`
+	// Current device path of the disk
+	DiskPath string `json:"disk_path,omitempty"`
+	// Serial number reported by the disk
+	Serial string `json:"serial,omitempty"`
+	// Size of the disk
+	SizeBytes uint64 `json:"size_bytes,omitempty"`
+	// Whether the disk's data partition is encrypted
+	Encrypted bool `json:"encrypted"`
+	// Path the disk is mounted at in the volume, if it is
+	Mountpoint string `json:"mountpoint,omitempty"`
+}
+
+// redactQuery returns a copy of a query which is safe to report.
+func redactQuery(query volumequery.VolumeQuery) volumequery.VolumeQuery {
+	if query.EncryptionKey != "" {
+		query.EncryptionKey = redactedPassphrase
+	}
+	return query
+}
+
+// diskStatus inspects a present disk of a volume.
+func diskStatus(db *volumequery.DeviceDatabase, vol *SimpleVolume, identity string, diskPath string) DiskStatus {
+	status := DiskStatus{
+		Identity:  identity,
+		Present:   true,
+		DiskPath:  diskPath,
+		Encrypted: vol.Query.EncryptionKey != "",
+	}
+
+	if rule, err := db.Device(diskPath); err == nil {
+		status.Serial = rule.Properties["ID_SERIAL"]
+		status.SizeBytes, _ = volumequery.DeviceSizeBytes(rule)
+	} else {
+		log.Debugln("Could not query disk for status:", diskPath, err)
+	}
+
+	// The label is authoritative for encryption since blank disks are
+	// initialized from the query but matched disks may predate it.
+	if labelPath, _, err := db.DiskLabelAndVolumePath(diskPath); err == nil {
+		if label, err := volumequery.DeserializeVolumeLabel(labelPath); err == nil {
+			status.Encrypted = label.Encrypted
+		}
+	}
+
+	if vol.Staged != nil {
+		for _, disk := range vol.Staged.Disks {
+			if disk.DiskPath == diskPath {
+				status.Mountpoint = disk.Mountpoint
+				break
+			}
+		}
+	}
+
+	return status
+}
+
+// volumeStatus builds the docker Status map of a volume. found maps the disk
+// identities of the volume to their current device paths. scanErr is the
+// error, if any, from scanning for the volume's disks, and db the device
+// snapshot the disks were found in.
+func volumeStatus(db *volumequery.DeviceDatabase, vol *SimpleVolume, found map[string]string, scanErr error) map[string]interface{} {
+	disks := make([]DiskStatus, 0, len(vol.Disks))
+	degraded := []string{}
+
+	for _, identity := range vol.Disks {
+		diskPath, present := found[identity]
+		if !present {
+			disks = append(disks, DiskStatus{Identity: identity})
+			if scanErr == nil {
+				degraded = append(degraded, fmt.Sprintf("disk %s is not present", identity))
+			}
+			continue
+		}
+
+		status := diskStatus(db, vol, identity, diskPath)
+		if vol.Staged != nil && status.Mountpoint == "" {
+			degraded = append(degraded, fmt.Sprintf("disk %s is present but not mounted", identity))
+		}
+		disks = append(disks, status)
+	}
+
+	if len(vol.Disks) < int(vol.Query.MinDisks) {
+		degraded = append(degraded, fmt.Sprintf("volume has %d disks but requires %d", len(vol.Disks), vol.Query.MinDisks))
+	}
+	if scanErr != nil {
+		degraded = append(degraded, fmt.Sprintf("could not scan for disks: %v", scanErr))
+	}
+
+	return map[string]interface{}{
+		"query":      redactQuery(vol.Query),
+		"created_at": vol.CreatedAt,
+		"disks":      disks,
+		"mounted":    vol.Staged != nil,
+		"refcount":   len(vol.MountIDs),
+		"mount_ids":  vol.MountIDs,
+		"degraded":   degraded,
+	}
+}
+
+// volumeStatuses builds the docker Status maps of the given volumes, keyed by
+// volume name. The disks of every volume are found in a single scan.
+func (this *SimpleVolumeDriver) volumeStatuses(vols []*SimpleVolume) map[string]map[string]interface{} {
+	identities := []string{}
+	for _, vol := range vols {
+		identities = append(identities, vol.Disks...)
+	}
+
+	found := map[string]string{}
+	db, err := volumequery.SnapshotDeviceDatabase()
+	if err == nil {
+		found, err = db.FindDisksByIdentity(this.deviceSelectionRules, identities)
+	}
+	if err != nil {
+		log.Errorln("Could not scan for disks to report volume status:", err)
+		found = map[string]string{}
+	}
+
+	statuses := make(map[string]map[string]interface{}, len(vols))
+	for _, vol := range vols {
+		statuses[vol.Name] = volumeStatus(db, vol, found, err)
+	}
+	return statuses
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/wrouesnel/docker-simple-disk/volumemount"
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+type StatusSuite struct {
+	db  *volumequery.DeviceDatabase
+	vol *SimpleVolume
+}
+
+var _ = Suite(&StatusSuite{})
+
+func (this *StatusSuite) SetUpTest(c *C) {
+	snapshot, err := volumequery.LoadSnapshotDeviceSource(testSnapshotPath)
+	c.Assert(err, IsNil)
+	devices, err := snapshot.Devices()
+	c.Assert(err, IsNil)
+	this.db = volumequery.NewDeviceDatabase(devices)
+
+	this.vol = &SimpleVolume{
+		Name: "vol",
+		Query: volumequery.VolumeQuery{
+			Label:         "test",
+			EncryptionKey: "secret",
+			MinDisks:      4,
+		},
+		Disks:    []string{"wwn:0x5000000000000a", "serial:SIMPLE_DISK_B", "serial:GONE"},
+		MountIDs: []string{"m1"},
+		Staged: &volumemount.StagedVolume{
+			Root: "/run/simple/vol",
+			Disks: []*volumemount.DiskMount{
+				&volumemount.DiskMount{
+					DiskSource: volumemount.DiskSource{DiskPath: "/dev/sdb", Name: "simple0"},
+					Mountpoint: "/run/simple/vol/simple0",
+				},
+			},
+		},
+	}
+}
+
+func (this *StatusSuite) found() map[string]string {
+	return map[string]string{
+		"wwn:0x5000000000000a": "/dev/sda",
+		"serial:SIMPLE_DISK_B": "/dev/sdb",
+	}
+}
+
+func (this *StatusSuite) TestVolumeStatus(c *C) {
+	status := volumeStatus(this.db, this.vol, this.found(), nil)
+
+	query := status["query"].(volumequery.VolumeQuery)
+	c.Check(query.EncryptionKey, Equals, redactedPassphrase)
+	c.Check(this.vol.Query.EncryptionKey, Equals, "secret")
+	c.Check(status["mounted"], Equals, true)
+	c.Check(status["refcount"], Equals, 1)
+
+	disks := status["disks"].([]DiskStatus)
+	c.Assert(disks, HasLen, 3)
+	c.Check(disks[0].Present, Equals, true)
+	c.Check(disks[0].Serial, Equals, "BLANK_DISK_A")
+	c.Check(disks[0].SizeBytes, Equals, uint64(2097152)*volumequery.SysfsSectorSize)
+	c.Check(disks[0].Mountpoint, Equals, "")
+	c.Check(disks[1].DiskPath, Equals, "/dev/sdb")
+	c.Check(disks[1].Mountpoint, Equals, "/run/simple/vol/simple0")
+	c.Check(disks[2], DeepEquals, DiskStatus{Identity: "serial:GONE"})
+
+	c.Check(status["degraded"], DeepEquals, []string{
+		"disk wwn:0x5000000000000a is present but not mounted",
+		"disk serial:GONE is not present",
+		"volume has 3 disks but requires 4",
+	})
+}
+
+func (this *StatusSuite) TestVolumeStatusScanError(c *C) {
+	this.vol.Staged = nil
+	this.vol.Query.MinDisks = 1
+
+	status := volumeStatus(nil, this.vol, map[string]string{}, errors.New("no udev"))
+	c.Check(status["mounted"], Equals, false)
+
+	// Disks can't be reported missing if they couldn't be looked for.
+	disks := status["disks"].([]DiskStatus)
+	c.Assert(disks, HasLen, 3)
+	for _, disk := range disks {
+		c.Check(disk.Present, Equals, false)
+	}
+	c.Check(status["degraded"], DeepEquals, []string{"could not scan for disks: no udev"})
+}
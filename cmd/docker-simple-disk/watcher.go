@@ -0,0 +1,64 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"github.com/jochenvg/go-udev"
+	"github.com/wrouesnel/go.log"
+)
+
+const (
+	udevActionAdd    string = "add"
+	udevActionChange string = "change"
+	udevActionRemove string = "remove"
+)
+
+// WatchDevices starts a udev monitor which adds and removes disks from live
+// volumes with dynamic mounts as block devices come and go. The monitor runs
+// until done is closed.
+func (this *SimpleVolumeDriver) WatchDevices(done chan struct{}) error {
+	udevCtx := udev.Udev{}
+	monitor := udevCtx.NewMonitorFromNetlink("udev")
+	if err := monitor.FilterAddMatchSubsystem("block"); err != nil {
+		return err
+	}
+
+	deviceCh, err := monitor.DeviceChan(done)
+	if err != nil {
+		return err
+	}
+
+	// Device events arrive in bursts (a disk and then each of its partitions,
+	// or a disk we are initializing ourselves), so coalesce add events into
+	// a single pending rescan.
+	go func() {
+		for {
+			select {
+			case <-this.rescanCh:
+				this.rescanDynamicVolumes()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for device := range deviceCh {
+			log.Debugln("udev event:", device.Action(), device.Devnode())
+			switch device.Action() {
+			case udevActionAdd, udevActionChange:
+				select {
+				case this.rescanCh <- struct{}{}:
+				default:
+				}
+			case udevActionRemove:
+				this.removeDynamicDisk(device.Devnode())
+			}
+		}
+		log.Infoln("udev monitor stopped")
+	}()
+
+	log.Infoln("Watching udev for dynamic mount changes")
+	return nil
+}
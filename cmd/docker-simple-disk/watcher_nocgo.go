@@ -0,0 +1,68 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/wrouesnel/go.log"
+)
+
+const (
+	// How often the device tree is polled for dynamic mount changes when
+	// there's no udev monitor.
+	devicePollInterval = 10 * time.Second
+)
+
+// WatchDevices polls for block devices coming and going, and adds and removes
+// disks from live volumes with dynamic mounts. Without cgo there is no udev
+// monitor, so changes are picked up every devicePollInterval. The poller runs
+// until done is closed.
+func (this *SimpleVolumeDriver) WatchDevices(done chan struct{}) error {
+	go func() {
+		ticker := time.NewTicker(devicePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, diskPath := range this.missingDynamicDisks() {
+					this.removeDynamicDisk(diskPath)
+				}
+				this.rescanDynamicVolumes()
+			case <-this.rescanCh:
+				this.rescanDynamicVolumes()
+			case <-done:
+				log.Infoln("device poller stopped")
+				return
+			}
+		}
+	}()
+
+	log.Infoln("Polling devices for dynamic mount changes every", devicePollInterval)
+	return nil
+}
+
+// missingDynamicDisks returns the disks of mounted dynamic volumes whose device
+// nodes have disappeared.
+func (this *SimpleVolumeDriver) missingDynamicDisks() []string {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	missing := []string{}
+	for _, vol := range this.registry.List() {
+		if !vol.Query.DynamicMounts || vol.Staged == nil {
+			continue
+		}
+		for _, disk := range vol.Staged.Disks {
+			if disk.DiskPath == "" {
+				continue
+			}
+			if _, err := os.Stat(disk.DiskPath); os.IsNotExist(err) {
+				missing = append(missing, disk.DiskPath)
+			}
+		}
+	}
+	return missing
+}
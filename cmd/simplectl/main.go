@@ -42,6 +42,27 @@ type checkVolumeQueryCmd struct {
 	inputQueryString volumequery.VolumeQuery
 }
 
+type upgradeLabelsCmd struct {
+	targetDevices []string
+	dryRun bool
+}
+
+type signLabelCmd struct {
+	targetDevice string
+	force bool
+}
+
+type setMetadataCmd struct {
+	targetDevice string
+	metadata map[string]string
+}
+
+type repairPartitionNameCmd struct {
+	targetDevice string
+	source string
+	force bool
+}
+
 // Get the hostname
 func hostname() string {
 	h, err := os.Hostname()
@@ -63,12 +84,12 @@ func machineid() string {
 func main() {
 	app := kingpin.New("simplectl", "Test utility which runs simple volume queries against udev")
 
-	cmdlineSelectionRule := volumequery.NewDeviceSelectionRule()
-	config.DefaultAppFlags(app, &cmdlineSelectionRule)
+	selectionRules := []volumequery.DeviceSelectionRule{}
+	config.DefaultAppFlags(app, &selectionRules)
 
 	rawQueryFromStdin := app.Command("raw-udev-query", "Read a JSON selection rules from stdin and run a udev query")
 
-	dumpDeviceRules := app.Command("dump-device-rules", "JSON print the parameter of a device as selection rules")
+	dumpDeviceRules := app.Command("dump-device-rules", "JSON print the parameter of a device (or every device if none is given) as selection rules")
 	dumpDeviceRulesCmd := dumpDeviceRulesCmd{}
 	dumpDeviceRules.Arg("disk path", "disk or device to reverse engineer selection rules for").StringVar(&dumpDeviceRulesCmd.targetDevice)
 
@@ -77,9 +98,18 @@ func main() {
 	listDevicePartitions.Arg("disk path", "disk or device to reverse engineer selection rules for").StringVar(&listDevicePartitionsCmd.targetDevice)
 
 	listRawCandidates := app.Command("list-raw-candidates", "list devices which form the initial pool")
+	listCandidates := app.Command("list-candidates", "list every candidate device with how it was classified and why")
 	listInitializedCandidates := app.Command("list-initialized-candidates", "list initialized simple devices")
 	listUninitializedCandidates := app.Command("list-uninitialized-candidates", "list uninitialized devices simple would initialize on request")
 	listRejectedCandidates := app.Command("list-rejected-candidates", "list candidate devices which were rejected for one reason or another")
+	candidateReportCmdData := candidateReportCmd{}
+	listCandidates.Flag("format", "output format").Default(formatTable).EnumVar(&candidateReportCmdData.format, formatTable, formatJSON)
+	// The per-class lists print bare device paths by default so they can be
+	// used in scripts.
+	candidateClassCmdData := candidateReportCmd{}
+	for _, cmd := range []*kingpin.CmdClause{listInitializedCandidates, listUninitializedCandidates, listRejectedCandidates} {
+		cmd.Flag("format", "output format").Default(formatPaths).EnumVar(&candidateClassCmdData.format, formatPaths, formatTable, formatJSON)
+	}
 
 	forceInitDisk := app.Command("initialize-disk", "manually write an initialization value to a given block device")
 	forceInitCmdData := forceInitCmd{}
@@ -94,7 +124,35 @@ func main() {
 	checkVolumeQuery.Arg("block device","block device to partition and initialize").StringVar(&checkVolumeQueryCmdData.targetDevice)
 	volumequery.VolumeQueryVar(checkVolumeQuery.Arg("query string", "query string used to initialize the device"), &checkVolumeQueryCmdData.inputQueryString)
 
-	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	explainQueryCommand := app.Command("explain-query", "explain how a query string fares against every candidate device")
+	explainQueryCmdData := explainQueryCmd{}
+	explainQueryCommand.Flag("format", "output format").Default(formatTable).EnumVar(&explainQueryCmdData.format, formatTable, formatJSON)
+	volumequery.VolumeQueryVar(explainQueryCommand.Arg("query string", "query string to explain"), &explainQueryCmdData.inputQueryString)
+
+	repairPartitionName := app.Command("repair-partition-name", "make the data partition name and volume label of a device agree again")
+	repairPartitionNameCmdData := repairPartitionNameCmd{}
+	repairPartitionName.Flag("force", "don't prompt for confirmation").BoolVar(&repairPartitionNameCmdData.force)
+	repairPartitionName.Flag("from", "which name to keep: the volume label (renames the partition) or the partition name (rewrites the volume label)").
+		Required().EnumVar(&repairPartitionNameCmdData.source, string(volumesetup.RepairFromLabel), string(volumesetup.RepairFromPartition))
+	repairPartitionName.Arg("block device", "initialized block device to repair").Required().StringVar(&repairPartitionNameCmdData.targetDevice)
+
+	upgradeLabels := app.Command("upgrade-labels", "rewrite volume labels written by older versions of simple with the current label version")
+	upgradeLabelsCmdData := upgradeLabelsCmd{}
+	upgradeLabels.Flag("dry-run", "only report which labels would be upgraded").BoolVar(&upgradeLabelsCmdData.dryRun)
+	upgradeLabels.Arg("block devices", "initialized block devices to upgrade (default: every initialized candidate device)").StringsVar(&upgradeLabelsCmdData.targetDevices)
+
+	signLabel := app.Command("sign-label", "sign the volume label of an initialized device with the --label-signing-key-file key")
+	signLabelCmdData := signLabelCmd{}
+	signLabel.Flag("force", "don't prompt for confirmation").BoolVar(&signLabelCmdData.force)
+	signLabel.Arg("block device", "initialized block device to sign").Required().StringVar(&signLabelCmdData.targetDevice)
+
+	setMetadata := app.Command("set-metadata", "set (or with a blank value, remove) volume label metadata keys of an initialized device")
+	setMetadataCmdData := setMetadataCmd{}
+	setMetadata.Arg("block device", "initialized block device to update").Required().StringVar(&setMetadataCmdData.targetDevice)
+	setMetadata.Arg("metadata", "key=value pairs to set, or key= to remove a key").Required().StringMapVar(&setMetadataCmdData.metadata)
+
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+	switch command {
 	case rawQueryFromStdin.FullCommand():
 		// Run GetCandidateDisk but read from a JSON query.
 		jsonBytes, err := ioutil.ReadAll(os.Stdin)
@@ -105,6 +163,9 @@ func main() {
 		if err := json.Unmarshal(jsonBytes, &jsonRules); err != nil {
 			log.Fatalln("Error unmarshalling query from JSON:", err)
 		}
+		if err := volumequery.ValidateSelectionRules(jsonRules); err != nil {
+			log.Fatalln("Invalid selection rules:", err)
+		}
 		devices, err := volumequery.GetDevicePaths(jsonRules)
 		if err != nil {
 			log.Fatalln(err)
@@ -114,11 +175,22 @@ func main() {
 		}
 
 	case dumpDeviceRules.FullCommand():
-		rule, err := volumequery.GetFullSelectionRuleForDevice(dumpDeviceRulesCmd.targetDevice)
-		if err != nil {
-			log.Fatalln("Failed to query device:", err)
+		var rules []*volumequery.DeviceSelectionRule
+		if dumpDeviceRulesCmd.targetDevice == "" {
+			// Dump the whole database. This is the snapshot format read by
+			// --device-snapshot.
+			devices, err := volumequery.GetDeviceSource().Devices()
+			if err != nil {
+				log.Fatalln("Failed to query devices:", err)
+			}
+			rules = devices
+		} else {
+			rule, err := volumequery.GetFullSelectionRuleForDevice(dumpDeviceRulesCmd.targetDevice)
+			if err != nil {
+				log.Fatalln("Failed to query device:", err)
+			}
+			rules = []*volumequery.DeviceSelectionRule{rule}
 		}
-		rules := []*volumequery.DeviceSelectionRule{rule}
 		b, err := json.MarshalIndent(rules,""," ")
 		if err != nil {
 			log.Fatalln("JSON marshalling failed:", err)
@@ -127,7 +199,7 @@ func main() {
 		os.Stdout.Write([]byte{'\n'})
 
 	case listRawCandidates.FullCommand():
-		devices, err := volumequery.GetDevicePaths([]volumequery.DeviceSelectionRule{cmdlineSelectionRule})
+		devices, err := volumequery.GetDevicePaths(selectionRules)
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -151,34 +223,29 @@ func main() {
 			fmt.Println(d)
 		}
 
-	case listUninitializedCandidates.FullCommand():
-		_, uninitialized, _, err := volumequery.GetCandidateDisks([]volumequery.DeviceSelectionRule{cmdlineSelectionRule})
+	case listCandidates.FullCommand(), listInitializedCandidates.FullCommand(),
+		listUninitializedCandidates.FullCommand(), listRejectedCandidates.FullCommand():
+		report, err := volumequery.GetCandidateReport(selectionRules, nil, volumequery.Claimant{}, volumequery.DeserializeVolumeLabel)
 		if err != nil {
 			log.Fatalln("Failed while querying candidates:", err)
 		}
-		fmt.Fprintln(os.Stderr, "Listing uninitialized candidate devices for simple")
-		for _, d := range uninitialized {
-			fmt.Println(d)
-		}
-
-	case listInitializedCandidates.FullCommand():
-		initialized, _, _, err := volumequery.GetCandidateDisks([]volumequery.DeviceSelectionRule{cmdlineSelectionRule})
-		if err != nil {
-			log.Fatalln("Failed while querying candidates:", err)
-		}
-		fmt.Fprintln(os.Stderr, "Listing initialized candidate devices for simple")
-		for _, d := range initialized {
-			fmt.Println(d)
-		}
-
-	case listRejectedCandidates.FullCommand():
-		_, _, rejected, err := volumequery.GetCandidateDisks([]volumequery.DeviceSelectionRule{cmdlineSelectionRule})
-		if err != nil {
-			log.Fatalln("Failed while querying candidates:", err)
+		format := candidateClassCmdData.format
+		switch command {
+		case listInitializedCandidates.FullCommand():
+			fmt.Fprintln(os.Stderr, "Listing initialized candidate devices for simple")
+			report = filterCandidates(report, volumequery.DiskInitialized)
+		case listUninitializedCandidates.FullCommand():
+			fmt.Fprintln(os.Stderr, "Listing uninitialized candidate devices for simple")
+			report = filterCandidates(report, volumequery.DiskUninitialized)
+		case listRejectedCandidates.FullCommand():
+			fmt.Fprintln(os.Stderr, "Listing rejected candidate devices for simple")
+			report = filterCandidates(report, volumequery.DiskRejected)
+		default:
+			fmt.Fprintln(os.Stderr, "Listing candidate devices for simple")
+			format = candidateReportCmdData.format
 		}
-		fmt.Fprintln(os.Stderr, "Listing rejected candidate devices for simple")
-		for _, d := range rejected {
-			fmt.Println(d)
+		if err := writeCandidateReport(os.Stdout, report, format); err != nil {
+			log.Fatalln("Failed writing candidate report:", err)
 		}
 
 	case forceInitDisk.FullCommand():
@@ -204,12 +271,96 @@ func main() {
 		if err != nil {
 			log.Fatalln("Not an initialized or locateable device:", err)
 		}
-		if matches, err := volumequery.VolumeQueryMatch(&checkVolumeQueryCmdData.inputQueryString, labelPath, dataPath); err != nil {
+		if report, err := volumequery.ExplainVolumeQueryMatch(&checkVolumeQueryCmdData.inputQueryString, labelPath, dataPath); err != nil {
 			log.Fatalln("Error while trying to run matcher:", err)
-		} else if matches {
+		} else if report.Matched() {
 			fmt.Fprintln(os.Stdout, "Match")
 		} else {
 			fmt.Fprintln(os.Stdout, "No Match")
+			for _, result := range report.Failed() {
+				fmt.Fprintf(os.Stdout, "  %s: expected %s, got %s\n", result.Constraint, result.Expected, result.Actual)
+			}
+		}
+
+	case repairPartitionName.FullCommand():
+		if !repairPartitionNameCmdData.force {
+			if proceed := prompter.YesNo(fmt.Sprintf("Repair the partition name of the given device from its %s. Are you sure?", repairPartitionNameCmdData.source), false); !proceed {
+				log.Fatalln("Cancelled by user.")
+			}
+		}
+		err := volumesetup.RepairPartitionName(repairPartitionNameCmdData.targetDevice,
+			volumesetup.PartitionNameSource(repairPartitionNameCmdData.source))
+		if err != nil {
+			log.Fatalln("Failed while repairing device:", err)
+		}
+
+	case upgradeLabels.FullCommand():
+		diskPaths := upgradeLabelsCmdData.targetDevices
+		if len(diskPaths) == 0 {
+			report, err := volumequery.GetCandidateReport(selectionRules, nil, volumequery.Claimant{}, nil)
+			if err != nil {
+				log.Fatalln("Failed while querying candidates:", err)
+			}
+			for _, candidate := range filterCandidates(report, volumequery.DiskInitialized) {
+				diskPaths = append(diskPaths, candidate.DiskPath)
+			}
+		}
+		failed := false
+		for _, diskPath := range diskPaths {
+			labelPath, _, err := volumequery.GetDiskLabelAndVolumePath(diskPath)
+			if err != nil {
+				log.Errorln("Not an initialized or locateable device:", diskPath, err)
+				failed = true
+				continue
+			}
+			fromVersion, err := volumesetup.UpgradeVolumeLabel(labelPath, upgradeLabelsCmdData.dryRun)
+			switch {
+			case err != nil:
+				log.Errorln("Failed upgrading volume label:", diskPath, err)
+				failed = true
+			case fromVersion == volumequery.VolumeLabelVersion:
+				fmt.Printf("%s: version %d is current\n", diskPath, fromVersion)
+			case upgradeLabelsCmdData.dryRun:
+				fmt.Printf("%s: would upgrade version %d to %d\n", diskPath, fromVersion, volumequery.VolumeLabelVersion)
+			default:
+				fmt.Printf("%s: upgraded version %d to %d\n", diskPath, fromVersion, volumequery.VolumeLabelVersion)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+
+	case signLabel.FullCommand():
+		if !signLabelCmdData.force {
+			if proceed := prompter.YesNo("Signing vouches for the label as it is now. Are you sure?", false); !proceed {
+				log.Fatalln("Cancelled by user.")
+			}
+		}
+		labelPath, _, err := volumequery.GetDiskLabelAndVolumePath(signLabelCmdData.targetDevice)
+		if err != nil {
+			log.Fatalln("Not an initialized or locateable device:", err)
+		}
+		if err := volumesetup.SignExistingVolumeLabel(labelPath); err != nil {
+			log.Fatalln("Failed while signing label:", err)
+		}
+
+	case setMetadata.FullCommand():
+		labelPath, _, err := volumequery.GetDiskLabelAndVolumePath(setMetadataCmdData.targetDevice)
+		if err != nil {
+			log.Fatalln("Not an initialized or locateable device:", err)
+		}
+		if err := volumesetup.SetVolumeLabelMetadata(labelPath, setMetadataCmdData.metadata); err != nil {
+			log.Fatalln("Failed while setting metadata:", err)
+		}
+
+	case explainQueryCommand.FullCommand():
+		report, err := volumequery.GetCandidateReport(selectionRules, nil, volumequery.Claimant{}, nil)
+		if err != nil {
+			log.Fatalln("Failed while querying candidates:", err)
+		}
+		explanations := explainQuery(&explainQueryCmdData.inputQueryString, report)
+		if err := writeQueryExplanations(os.Stdout, explanations, explainQueryCmdData.format); err != nil {
+			log.Fatalln("Failed writing query explanation:", err)
 		}
 	}
 
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+const (
+	formatTable string = "table"
+	formatJSON  string = "json"
+	formatPaths string = "paths"
+)
+
+type candidateReportCmd struct {
+	format string
+}
+
+// filterCandidates returns the candidates with the given classes. Returns all
+// candidates if no classes are given.
+func filterCandidates(report []volumequery.CandidateDisk, classes ...volumequery.DiskClass) []volumequery.CandidateDisk {
+	if len(classes) == 0 {
+		return report
+	}
+	filtered := []volumequery.CandidateDisk{}
+	for _, candidate := range report {
+		for _, class := range classes {
+			if candidate.Class == class {
+				filtered = append(filtered, candidate)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// candidateLabel summarizes the volume label of a candidate for the table.
+func candidateLabel(candidate volumequery.CandidateDisk) string {
+	if candidate.Label != nil && candidate.PartitionNameMismatch != nil {
+		return fmt.Sprintf("%s (v%d, %s, partition name mismatch: %q)", candidate.Label.Label,
+			candidate.Label.Version, candidate.Label.Hostname, candidate.PartitionNameMismatch.PartitionName)
+	}
+	if candidate.Label != nil {
+		return fmt.Sprintf("%s (v%d, %s)", candidate.Label.Label, candidate.Label.Version, candidate.Label.Hostname)
+	}
+	if candidate.LabelError != "" {
+		return fmt.Sprintf("unreadable: %s", candidate.LabelError)
+	}
+	return "-"
+}
+
+// writeCandidateReport writes a candidate report as a table, JSON, or bare
+// device paths one per line.
+func writeCandidateReport(w io.Writer, report []volumequery.CandidateDisk, format string) error {
+	if format == formatPaths {
+		for _, candidate := range report {
+			if _, err := fmt.Fprintln(w, candidate.DiskPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if format == formatJSON {
+		b, err := json.MarshalIndent(report, "", " ")
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVNODE\tIDENTITY\tSIZE\tCLASS\tREASON\tLABEL")
+	for _, candidate := range report {
+		identity := candidate.Identity
+		if identity == "" {
+			identity = "-"
+		}
+		reason := candidate.Reason
+		if reason == "" {
+			reason = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			candidate.DiskPath, identity, candidate.SizeBytes, candidate.Class,
+			reason, candidateLabel(candidate))
+	}
+	return tw.Flush()
+}
+
+type explainQueryCmd struct {
+	inputQueryString volumequery.VolumeQuery
+	format           string
+}
+
+// QueryExplanation is how a volume query fared against one candidate disk.
+type QueryExplanation struct {
+	DiskPath string                `json:"devnode"`
+	Class    volumequery.DiskClass `json:"class"`
+	Matched  bool                  `json:"matched"`
+	// Why the disk couldn't be evaluated
+	Error string `json:"error,omitempty"`
+	// Only initialized disks are matched against the query
+	Report *volumequery.MatchReport `json:"report,omitempty"`
+}
+
+// explainQuery evaluates a query against every initialized candidate disk.
+func explainQuery(query *volumequery.VolumeQuery, report []volumequery.CandidateDisk) []QueryExplanation {
+	explanations := make([]QueryExplanation, 0, len(report))
+	for _, candidate := range report {
+		explanation := QueryExplanation{
+			DiskPath: candidate.DiskPath,
+			Class:    candidate.Class,
+		}
+		if candidate.Class == volumequery.DiskInitialized {
+			matchReport, err := volumequery.ExplainVolumeQueryMatch(query, candidate.LabelPath, candidate.DataPath)
+			if err != nil {
+				explanation.Error = err.Error()
+			} else {
+				explanation.Report = matchReport
+				explanation.Matched = matchReport.Matched()
+			}
+		} else {
+			explanation.Error = candidate.Reason
+		}
+		explanations = append(explanations, explanation)
+	}
+	return explanations
+}
+
+// writeQueryExplanations writes query explanations as a table of constraints
+// or JSON.
+func writeQueryExplanations(w io.Writer, explanations []QueryExplanation, format string) error {
+	if format == formatJSON {
+		b, err := json.MarshalIndent(explanations, "", " ")
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVNODE\tCONSTRAINT\tEXPECTED\tACTUAL\tRESULT")
+	for _, explanation := range explanations {
+		if explanation.Report == nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t%s: %s\n", explanation.DiskPath, explanation.Class, explanation.Error)
+			continue
+		}
+		if len(explanation.Report.Constraints) == 0 {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\tmatch (no constraints)\n", explanation.DiskPath)
+			continue
+		}
+		for _, result := range explanation.Report.Constraints {
+			outcome := "fail"
+			if result.Passed {
+				outcome = "pass"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", explanation.DiskPath,
+				result.Constraint, result.Expected, result.Actual, outcome)
+		}
+	}
+	return tw.Flush()
+}
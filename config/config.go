@@ -10,16 +10,34 @@ import (
 )
 
 // DefaultAppFlags sets up the mapping of default app configuration which the
-// underlying subsystems always need.
-func DefaultAppFlags(app *kingpin.Application, cmdlineSelectionRule *volumequery.DeviceSelectionRule) {
+// underlying subsystems always need. selectionRules is set to the rules from
+// --device-rules-file if given, otherwise to the rule built from the
+// --device-match-* flags.
+func DefaultAppFlags(app *kingpin.Application, selectionRules *[]volumequery.DeviceSelectionRule) {
+	cmdlineSelectionRule := volumequery.NewDeviceSelectionRule()
+
 	// Default device match subsystem
 	app.Flag("device-match-subsystem", "udev subsystem match for finding elegible devices").Default("block").StringsVar(&cmdlineSelectionRule.Subsystems)
-	app.Flag("device-match-name", "udev name to match for finding elegible devices").Default("sd*").StringsVar(&cmdlineSelectionRule.Name)
+	app.Flag("device-match-name", "udev name to match for finding elegible devices (all must match, use expr:a|b for alternatives)").Default("expr:sd*|nvme*|vd*|dm-*").StringsVar(&cmdlineSelectionRule.Name)
 	app.Flag("device-match-tag", "udev tag to match for finding elegible devices").StringsVar(&cmdlineSelectionRule.Tag)
 
 	app.Flag("device-match-attr", "udev sys attribute to match for finding elegible devices").StringMapVar(&cmdlineSelectionRule.Attrs)
 	app.Flag("device-match-properties", "udev property to match for finding elegible devices (i.e. environment variables)").Default("DEVTYPE=disk").StringMapVar(&cmdlineSelectionRule.Properties)
 
+	// Allow a list of selection rules instead of the single rule above
+	deviceRulesFile := app.Flag("device-rules-file", "read a JSON list of device selection rules (as accepted by simplectl raw-udev-query) instead of using the --device-match-* flags").String()
+
+	// Select how the live device database is read
+	deviceBackend := app.Flag("device-backend", "how to read the device database: udev (libudev, requires cgo) or sysfs (reads /sys and /run/udev/data directly)").
+		Default(volumequery.DefaultDeviceBackend).Enum(volumequery.DeviceBackends()...)
+
+	// Allow running against a device database snapshot instead of udev
+	deviceSnapshot := app.Flag("device-snapshot", "read devices from a JSON snapshot (as output by simplectl dump-device-rules) instead of udev").String()
+
+	// Label signing
+	labelSigningKeyFile := app.Flag("label-signing-key-file", "sign volume labels with the key in this file (HMAC-SHA256), and verify them for queries with require-signature").String()
+	requireLabelSignature := app.Flag("require-label-signature", "require a valid label signature for every query, as though each specified require-signature").Bool()
+
 	// Handle logging globally
 	loglevel := app.Flag("log-level", "Logging Level").Default("info").String()
 	logformat := app.Flag("log-format", "If set use a syslog logger or JSON logging. Example: logger:syslog?appname=bob&local=7 or logger:stdout?json=true. Defaults to stderr.").Default("stderr").String()
@@ -27,6 +45,42 @@ func DefaultAppFlags(app *kingpin.Application, cmdlineSelectionRule *volumequery
 	app.Action(func(*kingpin.ParseContext) error {
 		flag.Set("log.level", *loglevel)
 		flag.Set("log.format", *logformat)
+		if *deviceRulesFile != "" {
+			rules, err := volumequery.LoadSelectionRules(*deviceRulesFile)
+			if err != nil {
+				return err
+			}
+			*selectionRules = rules
+		} else {
+			*selectionRules = []volumequery.DeviceSelectionRule{cmdlineSelectionRule}
+			if err := volumequery.ValidateSelectionRules(*selectionRules); err != nil {
+				return err
+			}
+		}
+		if *labelSigningKeyFile != "" {
+			key, err := volumequery.LoadLabelSigningKey(*labelSigningKeyFile)
+			if err != nil {
+				return err
+			}
+			if err := volumequery.SetLabelSigningKey(key); err != nil {
+				return err
+			}
+		}
+		volumequery.SetLabelSignatureRequired(*requireLabelSignature)
+		source, err := volumequery.NewDeviceSourceForBackend(*deviceBackend)
+		if err != nil {
+			return err
+		}
+		volumequery.SetDeviceSource(source)
+		if *deviceSnapshot != "" {
+			source, err := volumequery.LoadSnapshotDeviceSource(*deviceSnapshot)
+			if err != nil {
+				return err
+			}
+			volumequery.SetDeviceSource(source)
+			// The snapshot's disks aren't ours, so nothing here uses them.
+			volumequery.SetDiskUsageSource(volumequery.NewStaticDiskUsageSource(nil))
+		}
 		return nil
 	})
 }
\ No newline at end of file
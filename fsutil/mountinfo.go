@@ -0,0 +1,132 @@
+package fsutil
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Where to read our mount namespace's mount table from.
+	ProcSelfMountInfo string = "/proc/self/mountinfo"
+)
+
+var (
+	errMalformedMountInfo = errors.New("malformed mountinfo line")
+)
+
+// MountInfo is a single entry from a mountinfo file. See proc(5).
+type MountInfo struct {
+	MountID      int
+	ParentID     int
+	Major        int
+	Minor        int
+	Root         string
+	Mountpoint   string
+	Options      string
+	FSType       string
+	Source       string
+	SuperOptions string
+}
+
+// unescapeMountInfo decodes the octal escapes the kernel uses for whitespace
+// and backslashes in mountinfo paths.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(v))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// parseMountInfoLine parses a single line of a mountinfo file.
+func parseMountInfoLine(line string) (MountInfo, error) {
+	fields := strings.Fields(line)
+	// Find the separator between the optional fields and the filesystem
+	// fields.
+	sep := -1
+	for i, field := range fields {
+		if field == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 6 || len(fields) < sep+4 {
+		return MountInfo{}, errMalformedMountInfo
+	}
+
+	mountID, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return MountInfo{}, errMalformedMountInfo
+	}
+	parentID, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return MountInfo{}, errMalformedMountInfo
+	}
+	devTuple := strings.Split(fields[2], ":")
+	if len(devTuple) != 2 {
+		return MountInfo{}, errMalformedMountInfo
+	}
+	major, err := strconv.Atoi(devTuple[0])
+	if err != nil {
+		return MountInfo{}, errMalformedMountInfo
+	}
+	minor, err := strconv.Atoi(devTuple[1])
+	if err != nil {
+		return MountInfo{}, errMalformedMountInfo
+	}
+
+	return MountInfo{
+		MountID:      mountID,
+		ParentID:     parentID,
+		Major:        major,
+		Minor:        minor,
+		Root:         unescapeMountInfo(fields[3]),
+		Mountpoint:   unescapeMountInfo(fields[4]),
+		Options:      fields[5],
+		FSType:       fields[sep+1],
+		Source:       unescapeMountInfo(fields[sep+2]),
+		SuperOptions: fields[sep+3],
+	}, nil
+}
+
+// ReadMountInfo reads and parses a mountinfo file (normally
+// ProcSelfMountInfo).
+func ReadMountInfo(path string) ([]MountInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := []MountInfo{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		mount, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return mounts, nil
+}
@@ -0,0 +1,55 @@
+package fsutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type MountInfoSuite struct{}
+
+var _ = Suite(&MountInfoSuite{})
+
+const testMountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+36 22 0:45 / /tmp/docker-simple/label.data rw,relatime shared:20 - tmpfs tmpfs ro,size=4k,mode=755
+37 36 253:0 / /tmp/docker-simple/label.data/simple-0 rw,relatime shared:21 - ext4 /dev/mapper/0b5e3c2f-1d9e-4a4e-9c67-2b3e1cf3f0a1 rw
+38 22 8:18 / /mnt/with\040space rw,relatime - xfs /dev/sdb2 rw,attr2
+`
+
+func (this *MountInfoSuite) TestReadMountInfo(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "mountinfo")
+	c.Assert(ioutil.WriteFile(path, []byte(testMountInfo), os.FileMode(0644)), IsNil)
+
+	mounts, err := ReadMountInfo(path)
+	c.Assert(err, IsNil)
+	c.Assert(len(mounts), Equals, 4)
+
+	c.Check(mounts[1].Mountpoint, Equals, "/tmp/docker-simple/label.data")
+	c.Check(mounts[1].FSType, Equals, "tmpfs")
+	c.Check(mounts[1].ParentID, Equals, 22)
+
+	c.Check(mounts[2].Major, Equals, 253)
+	c.Check(mounts[2].Minor, Equals, 0)
+	c.Check(mounts[2].Source, Equals, "/dev/mapper/0b5e3c2f-1d9e-4a4e-9c67-2b3e1cf3f0a1")
+
+	c.Check(mounts[3].Mountpoint, Equals, "/mnt/with space")
+	c.Check(mounts[3].SuperOptions, Equals, "rw,attr2")
+}
+
+func (this *MountInfoSuite) TestParseMountInfoLineRejectsMalformedLines(c *C) {
+	_, err := parseMountInfoLine("22 1 8:1 / / rw,relatime shared:1")
+	c.Check(err, NotNil)
+
+	_, err = parseMountInfoLine("x 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw")
+	c.Check(err, NotNil)
+
+	_, err = parseMountInfoLine("22 1 8 / / rw,relatime - ext4 /dev/sda1 rw")
+	c.Check(err, NotNil)
+}
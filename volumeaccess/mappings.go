@@ -0,0 +1,105 @@
+package volumeaccess
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Where the kernel exposes block devices
+	SysBlockPath string = "/sys/block"
+	// device-mapper UUID prefix cryptsetup uses for dm-crypt devices
+	CryptUUIDPrefix string = "CRYPT-"
+)
+
+// Mapping describes a live device-mapper device.
+type Mapping struct {
+	// device-mapper name (i.e. /dev/mapper/<name>)
+	Name string
+	// device-mapper UUID
+	UUID string
+	// Kernel device node of the mapping (i.e. /dev/dm-0)
+	DevicePath string
+	// Device number of the mapping as major:minor
+	Devnum string
+	// Device nodes the mapping is stacked on
+	Slaves []string
+}
+
+// IsCrypt returns true if the mapping is a dm-crypt device.
+func (this *Mapping) IsCrypt() bool {
+	return strings.HasPrefix(this.UUID, CryptUUIDPrefix)
+}
+
+// readSysfsValue reads a single-line sysfs attribute.
+func readSysfsValue(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// ListMappings lists the live device-mapper devices from sysfs.
+func ListMappings() ([]Mapping, error) {
+	dmDevices, err := filepath.Glob(filepath.Join(SysBlockPath, "dm-*"))
+	if err != nil {
+		return nil, err
+	}
+
+	mappings := []Mapping{}
+	for _, dmDevice := range dmDevices {
+		name, err := readSysfsValue(filepath.Join(dmDevice, "dm", "name"))
+		if err != nil {
+			// Device went away while we were looking.
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		uuid, err := readSysfsValue(filepath.Join(dmDevice, "dm", "uuid"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		devnum, err := readSysfsValue(filepath.Join(dmDevice, "dev"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		slaves := []string{}
+		slaveEntries, err := ioutil.ReadDir(filepath.Join(dmDevice, "slaves"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, slave := range slaveEntries {
+			slaves = append(slaves, filepath.Join("/dev", slave.Name()))
+		}
+
+		mappings = append(mappings, Mapping{
+			Name:       name,
+			UUID:       uuid,
+			DevicePath: filepath.Join("/dev", filepath.Base(dmDevice)),
+			Devnum:     devnum,
+			Slaves:     slaves,
+		})
+	}
+
+	return mappings, nil
+}
+
+// MappingExists checks if a device-mapper device with the given name exists.
+func MappingExists(name string) bool {
+	_, err := os.Stat(filepath.Join(DevMapperPath, name))
+	return err == nil
+}
+
+// CloseMapping closes an encrypted device by its device-mapper name.
+func CloseMapping(name string) error {
+	ctx := &encryptedDeviceContext{
+		mountId: name,
+	}
+	return ctx.Close()
+}
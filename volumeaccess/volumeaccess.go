@@ -2,6 +2,7 @@ package volumeaccess
 
 import (
 	"errors"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -14,15 +15,41 @@ import (
 var (
 	errCryptSetupOpenFailed  = errors.New("error invoking cryptsetup to open device")
 	errCryptSetupCloseFailed = errors.New("error invoking cryptsetup to close device")
+	errMappingNotFound       = errors.New("device mapping does not exist")
+)
+
+const (
+	// Where device-mapper devices appear
+	DevMapperPath string = "/dev/mapper"
 )
 
 type VolumeContext interface {
 	// Return the device path of the context where it can be accessed
 	GetDevicePath() string
+	// Return the device-mapper name the context was opened as. Blank for
+	// devices which are accessed directly.
+	GetMappingName() string
 	// Tear down the volume setup
 	Close() error
 }
 
+// AttachDevice recreates the context of a device which was opened previously
+// (i.e. by another process), from its device-mapper name if it has one.
+func AttachDevice(devicePath string, mappingName string) (VolumeContext, error) {
+	if mappingName == "" {
+		return OpenDevice(devicePath)
+	}
+
+	if _, err := os.Stat(filepath.Join(DevMapperPath, mappingName)); err != nil {
+		return nil, errwrap.Wrap(errMappingNotFound, err)
+	}
+
+	return VolumeContext(&encryptedDeviceContext{
+		sourceDevicePath: devicePath,
+		mountId:          mappingName,
+	}), nil
+}
+
 // deviceContext represents the context of an unencrypted device.
 type deviceContext struct {
 	sourceDevicePath string
@@ -39,6 +66,11 @@ func (this *deviceContext) GetDevicePath() string {
 	return this.sourceDevicePath
 }
 
+// GetMappingName returns nothing since the device is accessed directly.
+func (this *deviceContext) GetMappingName() string {
+	return ""
+}
+
 func (this *deviceContext) Close() error {
 	// Nothing to actually.
 	return nil
@@ -76,7 +108,7 @@ func OpenEncryptedDevice(key string, devicePath string) (VolumeContext, error) {
 
 // GetDevicePath returns the unencrypted device path
 func (this *encryptedDeviceContext) GetDevicePath() string {
-	realPath, err := filepath.EvalSymlinks("/dev/mapper/" + this.mountId)
+	realPath, err := filepath.EvalSymlinks(filepath.Join(DevMapperPath, this.mountId))
 	if err != nil {
 		return ""
 	}
@@ -84,9 +116,13 @@ func (this *encryptedDeviceContext) GetDevicePath() string {
 	return realPath
 }
 
+// GetMappingName returns the device-mapper name of the opened LUKS volume
+func (this *encryptedDeviceContext) GetMappingName() string {
+	return this.mountId
+}
+
 func (this *encryptedDeviceContext) Close() error {
 	if err := executil.CheckExec("cryptsetup", "close", this.mountId); err != nil {
-		log.Errorln("Error unmounting luksDevice:", err)
 		return errwrap.Wrap(errCryptSetupCloseFailed, err)
 	}
 	return nil
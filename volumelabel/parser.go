@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -25,6 +26,11 @@ const (
 
 const StructTag = "volumelabel"
 
+// TagOptionPrefix marks a map[string]string field which collects every key
+// starting with the tag name, keyed by the rest of the key. i.e. a field
+// tagged `volumelabel:"meta-,prefix"` maps meta-tier.hot to {"tier": "hot"}.
+const TagOptionPrefix = "prefix"
+
 // TODO: allow human-readable specifiers i.e. "bytes" as extra tag info
 
 // Structs which want to marshal/unmarshal volumelabels should implement
@@ -61,6 +67,28 @@ func VolumeFieldValueValid(v string) bool {
 	return volumeFieldRegex.MatchString(v)
 }
 
+// parseTag splits a struct tag into the key name and whether the field is a
+// prefix map.
+func parseTag(tag string) (string, bool) {
+	parts := strings.Split(tag, ",")
+	isPrefix := false
+	for _, option := range parts[1:] {
+		if option == TagOptionPrefix {
+			isPrefix = true
+		}
+	}
+	return parts[0], isPrefix
+}
+
+// prefixMap returns the map of a prefix map field.
+func prefixMap(field reflect.Value, keyName string) (map[string]string, error) {
+	m, ok := field.Interface().(map[string]string)
+	if !ok {
+		return nil, fmt.Errorf("prefix field must be a map[string]string: %v", keyName)
+	}
+	return m, nil
+}
+
 // Marshals a value to a volume-field compatible string
 func marshalType(v interface{}) (string, error) {
 
@@ -209,7 +237,7 @@ func MarshalVolumeLabel(v interface{}) (string, error) {
 	keyValues := []string{}
 
 	for i := 0; i < vtype.NumField(); i++ {
-		keyName := vtype.Field(i).Tag.Get(StructTag)
+		keyName, isPrefix := parseTag(vtype.Field(i).Tag.Get(StructTag))
 		if keyName == "" {
 			// Not a key member
 			continue
@@ -219,6 +247,31 @@ func MarshalVolumeLabel(v interface{}) (string, error) {
 			return "", fmt.Errorf("key name does not parse field regex: %v", keyName)
 		}
 
+		// Prefix maps marshal a key-value per entry, in key order so the
+		// output is stable.
+		if isPrefix {
+			m, err := prefixMap(vvalue.Field(i), keyName)
+			if err != nil {
+				return "", err
+			}
+			subKeys := make([]string, 0, len(m))
+			for subKey, _ := range m {
+				subKeys = append(subKeys, subKey)
+			}
+			sort.Strings(subKeys)
+			for _, subKey := range subKeys {
+				if !VolumeFieldKeyValid(subKey) {
+					return "", fmt.Errorf("key name does not parse field regex: %v%v", keyName, subKey)
+				}
+				value, err := marshalType(m[subKey])
+				if err != nil {
+					return "", err
+				}
+				keyValues = append(keyValues, fmt.Sprintf("%s%s%s%s", keyName, subKey, ParserKVSep, value))
+			}
+			continue
+		}
+
 		// Key name is valid. Is it a pointer?
 		var v interface{}
 		v = vvalue.Field(i).Interface()
@@ -242,50 +295,90 @@ func MarshalVolumeLabel(v interface{}) (string, error) {
 	return strings.Join(keyValues, ParserFieldSep), nil
 }
 
+// ParseVolumeLabelFields splits a volume label string into its raw key-value
+// fields. Keys given without a value map to a blank string.
+func ParseVolumeLabelFields(l string) map[string]string {
+	keyValues := strings.Split(l, ParserFieldSep)
+	rawValues := make(map[string]string, len(keyValues))
+
+	for _, kv := range keyValues {
+		kvTuple := strings.Split(kv, ParserKVSep)
+		if len(kvTuple) == 2 {
+			rawValues[kvTuple[0]] = kvTuple[1]
+		} else {
+			rawValues[kvTuple[0]] = ""
+		}
+	}
+	return rawValues
+}
+
 func UnmarshalVolumeLabel(l string, v interface{}) error {
+	_, err := unmarshalFields(ParseVolumeLabelFields(l), v, true)
+	return err
+}
+
+// UnmarshalVolumeLabelOptions unmarshals a map of key-values (i.e. docker
+// volume driver options) into a struct using the same StructTag keys as
+// UnmarshalVolumeLabel. Since options are not constrained to be part of a
+// docker volume name, string values are not checked against the field regex.
+// Unlike UnmarshalVolumeLabel, keys which do not match a field are an error.
+func UnmarshalVolumeLabelOptions(options map[string]string, v interface{}) error {
+	used, err := unmarshalFields(options, v, false)
+	if err != nil {
+		return err
+	}
+
+	for keyName, _ := range options {
+		if _, found := used[keyName]; !found {
+			return fmt.Errorf("unknown option: %v", keyName)
+		}
+	}
+	return nil
+}
+
+// unmarshalFields unmarshals raw key-values into the struct pointed to by v,
+// and returns the set of keys which matched a field. If checkValues is false
+// string values are not checked against the field regex.
+func unmarshalFields(rawValues map[string]string, v interface{}, checkValues bool) (map[string]struct{}, error) {
 	if v == nil {
-		return fmt.Errorf("unmarshal target must be a non-nil struct pointer")
+		return nil, fmt.Errorf("unmarshal target must be a non-nil struct pointer")
 	}
 
 	value := reflect.ValueOf(v)
 	if value.Type().Kind() != reflect.Ptr {
-		return fmt.Errorf("unmarshal target must be a non-nil struct pointer")
+		return nil, fmt.Errorf("unmarshal target must be a non-nil struct pointer")
 	}
 
 	if value.Elem().Kind() != reflect.Struct {
-		return fmt.Errorf("unmarshal target must be a non-nil struct pointer")
+		return nil, fmt.Errorf("unmarshal target must be a non-nil struct pointer")
 	}
 
-	// Prechecks passed. Start expanding values into the raw map
-	keyValues := strings.Split(l, ParserFieldSep)
-	rawValues := make(map[string]string, len(keyValues))
+	used := make(map[string]struct{}, len(rawValues))
 
-	for _, kv := range keyValues {
-		kvTuple := strings.Split(kv, ParserKVSep)
-		if len(kvTuple) == 2 {
-			rawValues[kvTuple[0]] = kvTuple[1]
-		} else {
-			rawValues[kvTuple[0]] = ""
-		}
-	}
+	// Prefix map fields, which get whatever keys no other field matched
+	prefixFields := []int{}
 
 	// Scan the struct and try and unmarshal matching keys
 	for i := 0; i < value.Elem().NumField(); i++ {
-		keyName := value.Type().Elem().Field(i).Tag.Get(StructTag)
+		keyName, isPrefix := parseTag(value.Type().Elem().Field(i).Tag.Get(StructTag))
 		// TODO: should we recognize "-" and just ignore it?
 		if keyName == "" {
 			continue
 		}
 		// Print something helpful if the struct could never unmarshal
 		if !VolumeFieldKeyValid(keyName) {
-			return fmt.Errorf("key name does not parse field regex: %v %v", keyName, value.Type().Elem().Field(i).PkgPath)
+			return nil, fmt.Errorf("key name does not parse field regex: %v %v", keyName, value.Type().Elem().Field(i).PkgPath)
+		}
+		if isPrefix {
+			prefixFields = append(prefixFields, i)
+			continue
 		}
 
 		// Okay, do we have this keyname?
 		if rawstr, found := rawValues[keyName]; found {
 			// Yes. Let's try and unmarshal it as the type
 			if !value.Elem().Field(i).CanAddr() {
-				return fmt.Errorf("key cannot be addressed and will never be unmarshalled: %v %v", keyName, value.Type().Elem().Field(i).PkgPath)
+				return nil, fmt.Errorf("key cannot be addressed and will never be unmarshalled: %v %v", keyName, value.Type().Elem().Field(i).PkgPath)
 			}
 
 			var target interface{}
@@ -304,15 +397,50 @@ func UnmarshalVolumeLabel(l string, v interface{}) error {
 				target = value.Elem().Field(i).Addr().Interface()
 			}
 
-			// Unmarshal straight into it
-			err := unmarshalType(rawstr, target)
-			if err != nil {
-				return fmt.Errorf("Error while unmarshalling %v : %v : %v", keyName, rawstr, err)
+			// Unchecked strings are assigned directly, anything else is
+			// unmarshalled straight into the target.
+			if str, ok := target.(*string); ok && !checkValues {
+				*str = rawstr
+			} else if err := unmarshalType(rawstr, target); err != nil {
+				return nil, fmt.Errorf("Error while unmarshalling %v : %v : %v", keyName, rawstr, err)
 			}
+			used[keyName] = struct{}{}
 		}
-		// TODO: how to handle unspecified fields (i.e. meta- vals)?
 	}
-	return nil
+
+	// Collect the keys with the prefix of a prefix map field (i.e. meta-
+	// values) into the map.
+	for _, i := range prefixFields {
+		keyName, _ := parseTag(value.Type().Elem().Field(i).Tag.Get(StructTag))
+		m, err := prefixMap(value.Elem().Field(i), keyName)
+		if err != nil {
+			return nil, err
+		}
+		for rawKey, rawstr := range rawValues {
+			if _, found := used[rawKey]; found || !strings.HasPrefix(rawKey, keyName) {
+				continue
+			}
+			subKey := strings.TrimPrefix(rawKey, keyName)
+			if !VolumeFieldKeyValid(subKey) {
+				// Volume names may carry keys which aren't ours, so these
+				// are ignored like any other unknown key.
+				if checkValues {
+					continue
+				}
+				return nil, fmt.Errorf("key name does not parse field regex: %v", rawKey)
+			}
+			if checkValues && !VolumeFieldValueValid(rawstr) {
+				return nil, fmt.Errorf("Error while unmarshalling %v : %v : value does not parse field regex", rawKey, rawstr)
+			}
+			if m == nil {
+				m = make(map[string]string)
+				value.Elem().Field(i).Set(reflect.ValueOf(m))
+			}
+			m[subKey] = rawstr
+			used[rawKey] = struct{}{}
+		}
+	}
+	return used, nil
 }
 
 // Types which want to do custom marshalling should implement this interface
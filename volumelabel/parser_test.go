@@ -408,3 +408,86 @@ func (this *ParserSuite) TestUnMarshalVolumeFailsOnBadValueWhileUnmarshalling(c
 	err := UnmarshalVolumeLabel(SUnparseable, &testcase)
 	c.Check(err, NotNil)
 }
+
+func (this *ParserSuite) TestUnmarshalVolumeLabelOptions(c *C) {
+	unmarshalled := S{}
+
+	err := UnmarshalVolumeLabelOptions(map[string]string{
+		"test-int":  "-5",
+		"test-str":  "Not$Parseable_in.a-name",
+		"test-bool": "true",
+	}, &unmarshalled)
+	c.Assert(err, IsNil)
+	c.Check(unmarshalled.Test1, Equals, -5)
+	c.Check(unmarshalled.Test11, Equals, "Not$Parseable_in.a-name")
+	c.Check(unmarshalled.Test12, Equals, true)
+}
+
+func (this *ParserSuite) TestUnmarshalVolumeLabelOptionsFailsOnUnknownKey(c *C) {
+	unmarshalled := S{}
+
+	err := UnmarshalVolumeLabelOptions(map[string]string{"not-a-field": "value"}, &unmarshalled)
+	c.Check(err, NotNil)
+}
+
+func (this *ParserSuite) TestUnmarshalVolumeLabelOptionsFailsOnBadValue(c *C) {
+	unmarshalled := S{}
+
+	err := UnmarshalVolumeLabelOptions(map[string]string{"test-int": "notInt"}, &unmarshalled)
+	c.Check(err, NotNil)
+}
+
+// Test struct with a prefix map
+type PrefixS struct {
+	Tagged string            `volumelabel:"meta-tagged"`
+	Meta   map[string]string `volumelabel:"meta-,prefix"`
+}
+
+func (this *ParserSuite) TestRoundTripWithPrefixMap(c *C) {
+	testcase := PrefixS{"value", map[string]string{"tier": "hot", "owner": "ops"}}
+
+	out, err := MarshalVolumeLabel(testcase)
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, "meta-tagged.value_meta-owner.ops_meta-tier.hot")
+
+	unmarshalled := PrefixS{}
+	err = UnmarshalVolumeLabel(out, &unmarshalled)
+	c.Assert(err, IsNil)
+	c.Check(unmarshalled, DeepEquals, testcase, Commentf("Named fields take precedence over the prefix"))
+}
+
+func (this *ParserSuite) TestUnmarshalPrefixMap(c *C) {
+	unmarshalled := PrefixS{}
+	err := UnmarshalVolumeLabel("other.value", &unmarshalled)
+	c.Assert(err, IsNil)
+	c.Check(unmarshalled.Meta, IsNil)
+
+	err = UnmarshalVolumeLabel("meta-.value_meta--tier.hot", &unmarshalled)
+	c.Assert(err, IsNil, Commentf("Keys which aren't valid map keys are ignored in volume names"))
+	c.Check(unmarshalled.Meta, IsNil)
+
+	err = UnmarshalVolumeLabel("meta-.value_meta-tier.hot", &unmarshalled)
+	c.Assert(err, IsNil)
+	c.Check(unmarshalled.Meta, DeepEquals, map[string]string{"tier": "hot"})
+
+	err = UnmarshalVolumeLabelOptions(map[string]string{"meta-tier": "Not$Parseable_in.a-name"}, &unmarshalled)
+	c.Assert(err, IsNil)
+	c.Check(unmarshalled.Meta, DeepEquals, map[string]string{"tier": "Not$Parseable_in.a-name"})
+
+	err = UnmarshalVolumeLabelOptions(map[string]string{"meta-": "value"}, &unmarshalled)
+	c.Check(err, NotNil, Commentf("Keys which are only the prefix aren't map keys"))
+	err = UnmarshalVolumeLabelOptions(map[string]string{"meta--tier": "hot"}, &unmarshalled)
+	c.Check(err, NotNil)
+}
+
+func (this *ParserSuite) TestPrefixMustBeStringMap(c *C) {
+	type s struct {
+		Meta map[string]int `volumelabel:"meta-,prefix"`
+	}
+
+	_, err := MarshalVolumeLabel(s{})
+	c.Check(err, NotNil)
+
+	err = UnmarshalVolumeLabel("meta-tier.hot", &s{})
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,57 @@
+package volumemount
+
+// NoSlot marks a disk with no slot preference, or which could not be given a
+// slot.
+const NoSlot int = -1
+
+// AllocateSlots assigns numeric mountpoint slots to disks. preferred holds the
+// slot each disk would like (i.e. from its label) or NoSlot. taken holds slots
+// which are already in use. maxSlots limits slots to 0..maxSlots-1, with 0
+// meaning unlimited.
+//
+// Disks keep their preferred slot if it is free and in range, with conflicts
+// resolved in favour of the earlier disk. Remaining disks take the lowest free
+// slots in order. Disks which can't be given a slot are assigned NoSlot.
+func AllocateSlots(preferred []int, taken map[int]struct{}, maxSlots int) []int {
+	used := make(map[int]struct{}, len(taken)+len(preferred))
+	for slot, _ := range taken {
+		used[slot] = struct{}{}
+	}
+
+	inRange := func(slot int) bool {
+		return slot >= 0 && (maxSlots == 0 || slot < maxSlots)
+	}
+
+	assigned := make([]int, len(preferred))
+	for idx, slot := range preferred {
+		assigned[idx] = NoSlot
+		if !inRange(slot) {
+			continue
+		}
+		if _, found := used[slot]; found {
+			continue
+		}
+		assigned[idx] = slot
+		used[slot] = struct{}{}
+	}
+
+	nextSlot := 0
+	for idx, slot := range assigned {
+		if slot != NoSlot {
+			continue
+		}
+		for {
+			if _, found := used[nextSlot]; !found {
+				break
+			}
+			nextSlot++
+		}
+		if !inRange(nextSlot) {
+			break
+		}
+		assigned[idx] = nextSlot
+		used[nextSlot] = struct{}{}
+	}
+
+	return assigned
+}
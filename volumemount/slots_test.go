@@ -0,0 +1,35 @@
+package volumemount
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type SlotsSuite struct{}
+
+var _ = Suite(&SlotsSuite{})
+
+func (this *SlotsSuite) TestPreferredSlotsAreKept(c *C) {
+	slots := AllocateSlots([]int{3, NoSlot, 1}, nil, 4)
+	c.Check(slots, DeepEquals, []int{3, 0, 1})
+}
+
+func (this *SlotsSuite) TestConflictingPreferencesFavourEarlierDisks(c *C) {
+	slots := AllocateSlots([]int{2, 2, 2}, nil, 0)
+	c.Check(slots, DeepEquals, []int{2, 0, 1})
+}
+
+func (this *SlotsSuite) TestTakenAndOutOfRangeSlotsAreReassigned(c *C) {
+	taken := map[int]struct{}{0: struct{}{}, 1: struct{}{}}
+	slots := AllocateSlots([]int{1, 7, NoSlot}, taken, 4)
+	c.Check(slots, DeepEquals, []int{2, 3, NoSlot})
+}
+
+func (this *SlotsSuite) TestUnlimitedSlots(c *C) {
+	slots := AllocateSlots([]int{NoSlot, NoSlot, 10}, nil, 0)
+	c.Check(slots, DeepEquals, []int{0, 1, 10})
+}
@@ -0,0 +1,408 @@
+/*
+	Assembles the staging directory which is handed to docker as a volume
+	mountpoint. A small tmpfs is mounted to hold a directory per disk, each
+	disk is mounted into its directory, and then the tmpfs is remounted
+	read-only so containers can't create anything outside of a disk.
+*/
+
+package volumemount
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/wrouesnel/go.log"
+	"github.com/wrouesnel/go.sysutil/executil"
+
+	"github.com/wrouesnel/docker-simple-disk/volumeaccess"
+)
+
+var (
+	errCreateStagingDirFailed = errors.New("could not create staging directory")
+	errTmpfsMountFailed       = errors.New("could not mount staging tmpfs")
+	errRemountFailed          = errors.New("could not remount staging tmpfs")
+	errCreateMountpointFailed = errors.New("could not create disk mountpoint")
+	errOpenDeviceFailed       = errors.New("could not open disk data device")
+	errDiskMountFailed        = errors.New("could not mount disk")
+	errUnmountFailed          = errors.New("could not unmount")
+	errTeardownFailed         = errors.New("errors occurred during volume teardown")
+	errDiskNotInVolume        = errors.New("disk is not mounted in volume")
+	errDiskAlreadyInVolume    = errors.New("a disk is already mounted with that name")
+)
+
+const (
+	// Size of the staging tmpfs. It only ever holds directories.
+	StagingTmpfsSize string = "4k"
+)
+
+// DiskSource describes a disk to be mounted into a staged volume.
+type DiskSource struct {
+	// Directory name of the disk under the staging root
+	Name string `json:"name"`
+	// Disk device path
+	DiskPath string `json:"disk_path"`
+	// Data partition device path
+	DataPath string `json:"data_path"`
+	// Passphrase to open the data partition with. Blank if not encrypted.
+	EncryptionKey string `json:"-"`
+	// Filesystem type to mount with. Blank to let mount detect it.
+	Filesystem string `json:"filesystem"`
+}
+
+// DiskMount is a disk which has been mounted into a staged volume.
+type DiskMount struct {
+	DiskSource
+	// Path the disk is mounted at
+	Mountpoint string `json:"mountpoint"`
+	// Device-mapper name the data partition was opened as, if any
+	MappingName string `json:"mapping_name"`
+	// Opened data partition
+	ctx volumeaccess.VolumeContext
+	// Whether the disk has been unmounted but its data partition not closed
+	unmounted bool
+}
+
+// StagedVolume is an assembled volume. It can be serialized and reattached
+// so assembled volumes can outlive the process which assembled them.
+type StagedVolume struct {
+	// Root of the staging tmpfs
+	Root string `json:"root"`
+	// Disk mounts in the order they were made
+	Disks []*DiskMount `json:"disks"`
+	// Mountpoint directories which are kept even when no disk is mounted
+	Placeholders []string `json:"placeholders"`
+	// Mappings of removed disks which were still busy when they were removed
+	DeferredMappings []string `json:"deferred_mappings,omitempty"`
+	// Whether teardown has unmounted the staging tmpfs
+	rootUnmounted bool
+}
+
+// MountTmpfs mounts a staging tmpfs at the given path.
+func MountTmpfs(path string) error {
+	if err := executil.CheckExec("mount", "-t", "tmpfs", "-o", "size="+StagingTmpfsSize+",mode=0755", "tmpfs", path); err != nil {
+		return errwrap.Wrap(errTmpfsMountFailed, err)
+	}
+	return nil
+}
+
+// RemountReadOnly remounts the given mountpoint read-only.
+func RemountReadOnly(path string) error {
+	if err := executil.CheckExec("mount", "-o", "remount,ro", path); err != nil {
+		return errwrap.Wrap(errRemountFailed, err)
+	}
+	return nil
+}
+
+// RemountReadWrite remounts the given mountpoint read-write.
+func RemountReadWrite(path string) error {
+	if err := executil.CheckExec("mount", "-o", "remount,rw", path); err != nil {
+		return errwrap.Wrap(errRemountFailed, err)
+	}
+	return nil
+}
+
+// Unmount unmounts the given mountpoint.
+func Unmount(path string) error {
+	if err := executil.CheckExec("umount", path); err != nil {
+		return errwrap.Wrap(errUnmountFailed, err)
+	}
+	return nil
+}
+
+// Replaced by tests
+var (
+	unmount       = Unmount
+	unmountLazy   = UnmountLazy
+	closeMapping  = volumeaccess.CloseMapping
+	mappingExists = volumeaccess.MappingExists
+)
+
+// UnmountLazy detaches the given mountpoint immediately and cleans it up once
+// it is no longer busy. Used for disks which have disappeared.
+func UnmountLazy(path string) error {
+	if err := executil.CheckExec("umount", "-l", path); err != nil {
+		return errwrap.Wrap(errUnmountFailed, err)
+	}
+	return nil
+}
+
+// mountDisk opens the data partition of a disk source and mounts it under
+// the staging root.
+func mountDisk(root string, source DiskSource) (*DiskMount, error) {
+	mountpoint := filepath.Join(root, source.Name)
+	if err := os.Mkdir(mountpoint, os.FileMode(0755)); err != nil && !os.IsExist(err) {
+		return nil, errwrap.Wrap(errCreateMountpointFailed, err)
+	}
+
+	var ctx volumeaccess.VolumeContext
+	var err error
+	if source.EncryptionKey != "" {
+		ctx, err = volumeaccess.OpenEncryptedDevice(source.EncryptionKey, source.DataPath)
+	} else {
+		ctx, err = volumeaccess.OpenDevice(source.DataPath)
+	}
+	if err != nil {
+		return nil, errwrap.Wrap(errOpenDeviceFailed, err)
+	}
+
+	mountOpts := []string{}
+	if source.Filesystem != "" {
+		mountOpts = append(mountOpts, "-t", source.Filesystem)
+	}
+	mountOpts = append(mountOpts, ctx.GetDevicePath(), mountpoint)
+
+	log.Infoln("Mounting", source.DataPath, "at", mountpoint)
+	if err := executil.CheckExec("mount", mountOpts...); err != nil {
+		if cerr := ctx.Close(); cerr != nil {
+			log.Errorln("Error closing data device after failed mount:", cerr)
+		}
+		return nil, errwrap.Wrap(errDiskMountFailed, err)
+	}
+
+	return &DiskMount{
+		DiskSource:  source,
+		Mountpoint:  mountpoint,
+		MappingName: ctx.GetMappingName(),
+		ctx:         ctx,
+	}, nil
+}
+
+// unmountDisk unmounts a disk and closes its data partition. A disk which was
+// unmounted by an earlier call whose close failed is only closed.
+func unmountDisk(disk *DiskMount) error {
+	if !disk.unmounted {
+		log.Infoln("Unmounting", disk.DataPath, "from", disk.Mountpoint)
+		if err := unmount(disk.Mountpoint); err != nil {
+			return err
+		}
+		disk.unmounted = true
+	}
+	return disk.ctx.Close()
+}
+
+// isPlaceholder checks if the named mountpoint is kept without a disk.
+func (this *StagedVolume) isPlaceholder(name string) bool {
+	for _, placeholder := range this.Placeholders {
+		if placeholder == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Assemble creates a staged volume at root from the given disks. Placeholder
+// mountpoint directories are created for any names in placeholders which are
+// not used by a disk, so they appear as empty read-only directories. On
+// failure anything which was set up is torn down again.
+func Assemble(root string, sources []DiskSource, placeholders []string) (*StagedVolume, error) {
+	if err := os.MkdirAll(root, os.FileMode(0755)); err != nil {
+		return nil, errwrap.Wrap(errCreateStagingDirFailed, err)
+	}
+
+	log.Infoln("Mounting staging tmpfs at", root)
+	if err := MountTmpfs(root); err != nil {
+		return nil, err
+	}
+
+	staged := &StagedVolume{
+		Root:         root,
+		Disks:        make([]*DiskMount, 0, len(sources)),
+		Placeholders: placeholders,
+	}
+
+	for _, placeholder := range placeholders {
+		if err := os.Mkdir(filepath.Join(root, placeholder), os.FileMode(0755)); err != nil && !os.IsExist(err) {
+			if terr := staged.Teardown(); terr != nil {
+				log.Errorln("Error tearing down partially assembled volume:", terr)
+			}
+			return nil, errwrap.Wrap(errCreateMountpointFailed, err)
+		}
+	}
+
+	for _, source := range sources {
+		disk, err := mountDisk(root, source)
+		if err != nil {
+			if terr := staged.Teardown(); terr != nil {
+				log.Errorln("Error tearing down partially assembled volume:", terr)
+			}
+			return nil, err
+		}
+		staged.Disks = append(staged.Disks, disk)
+	}
+
+	if err := RemountReadOnly(root); err != nil {
+		if terr := staged.Teardown(); terr != nil {
+			log.Errorln("Error tearing down partially assembled volume:", terr)
+		}
+		return nil, err
+	}
+
+	return staged, nil
+}
+
+// Attach recreates the data partition contexts of a deserialized staged volume
+// so it can be torn down.
+func (this *StagedVolume) Attach() error {
+	for _, disk := range this.Disks {
+		ctx, err := volumeaccess.AttachDevice(disk.DataPath, disk.MappingName)
+		if err != nil {
+			return err
+		}
+		disk.ctx = ctx
+	}
+	return nil
+}
+
+// withReadWriteRoot briefly remounts the staging tmpfs read-write to run fn.
+func (this *StagedVolume) withReadWriteRoot(fn func() error) error {
+	if err := RemountReadWrite(this.Root); err != nil {
+		return err
+	}
+	fnErr := fn()
+	if err := RemountReadOnly(this.Root); err != nil {
+		log.Errorln("Could not return staging tmpfs to read-only:", this.Root, err)
+		if fnErr == nil {
+			fnErr = err
+		}
+	}
+	return fnErr
+}
+
+// AddDisk mounts an additional disk into a live staged volume.
+func (this *StagedVolume) AddDisk(source DiskSource) error {
+	for _, disk := range this.Disks {
+		if disk.Name == source.Name {
+			return errDiskAlreadyInVolume
+		}
+	}
+
+	mountpoint := filepath.Join(this.Root, source.Name)
+	err := this.withReadWriteRoot(func() error {
+		if err := os.Mkdir(mountpoint, os.FileMode(0755)); err != nil && !os.IsExist(err) {
+			return errwrap.Wrap(errCreateMountpointFailed, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	disk, err := mountDisk(this.Root, source)
+	if err != nil {
+		if this.isPlaceholder(source.Name) {
+			return err
+		}
+		if rerr := this.withReadWriteRoot(func() error { return os.Remove(mountpoint) }); rerr != nil {
+			log.Errorln("Could not remove mountpoint of disk which failed to mount:", mountpoint, rerr)
+		}
+		return err
+	}
+	this.Disks = append(this.Disks, disk)
+	return nil
+}
+
+// RemoveDisk lazily unmounts a disk which has disappeared from a live staged
+// volume and removes its mountpoint.
+func (this *StagedVolume) RemoveDisk(name string) error {
+	idx := -1
+	for i, disk := range this.Disks {
+		if disk.Name == name {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return errDiskNotInVolume
+	}
+	disk := this.Disks[idx]
+
+	log.Infoln("Lazily unmounting", disk.DataPath, "from", disk.Mountpoint)
+	if err := unmountLazy(disk.Mountpoint); err != nil {
+		return err
+	}
+	this.Disks = append(this.Disks[:idx], this.Disks[idx+1:]...)
+
+	// The lazily unmounted filesystem holds an encrypted mapping open until
+	// its last user lets go, so a failed close is retried later rather than
+	// failing the remove.
+	if err := disk.ctx.Close(); err != nil {
+		if disk.MappingName != "" {
+			log.Warnln("Data device of removed disk is busy. Deferring close of mapping", disk.MappingName, ":", err)
+			this.DeferredMappings = append(this.DeferredMappings, disk.MappingName)
+		} else {
+			log.Errorln("Error closing data device of removed disk:", disk.DataPath, err)
+		}
+	}
+
+	// Placeholders stay behind as empty read-only directories.
+	if this.isPlaceholder(name) {
+		return nil
+	}
+
+	return this.withReadWriteRoot(func() error {
+		return os.Remove(disk.Mountpoint)
+	})
+}
+
+// CloseDeferredMappings retries closing the mappings of removed disks which
+// were busy when they were removed. Mappings which are gone are forgotten.
+func (this *StagedVolume) CloseDeferredMappings() {
+	remaining := []string{}
+	for _, name := range this.DeferredMappings {
+		if !mappingExists(name) {
+			log.Debugln("Deferred mapping has already been closed:", name)
+			continue
+		}
+		if err := closeMapping(name); err != nil {
+			log.Debugln("Deferred mapping is still busy:", name, err)
+			remaining = append(remaining, name)
+			continue
+		}
+		log.Infoln("Closed deferred mapping", name)
+	}
+	this.DeferredMappings = remaining
+}
+
+// Teardown unmounts the disks of a staged volume in reverse order, closes their
+// data partitions, and then removes the staging tmpfs. Teardown continues past
+// disks which fail so as much as possible is cleaned up. Disks are dropped from
+// the volume once they are closed, and the staging tmpfs is left mounted until
+// every disk is, so a failed teardown can be retried. Mappings of removed disks
+// which are still busy are left for reconcile to close.
+func (this *StagedVolume) Teardown() error {
+	this.CloseDeferredMappings()
+	if len(this.DeferredMappings) > 0 {
+		log.Warnln("Leaving busy mappings of removed disks to be closed on reconcile:", this.DeferredMappings)
+	}
+
+	remaining := []*DiskMount{}
+	for i := len(this.Disks) - 1; i >= 0; i-- {
+		if err := unmountDisk(this.Disks[i]); err != nil {
+			log.Errorln("Error unmounting disk:", this.Disks[i].DataPath, err)
+			remaining = append([]*DiskMount{this.Disks[i]}, remaining...)
+		}
+	}
+	this.Disks = remaining
+
+	if len(this.Disks) > 0 {
+		log.Errorln("Leaving staging tmpfs mounted with", len(this.Disks), "disks still mounted:", this.Root)
+		return errTeardownFailed
+	}
+
+	if !this.rootUnmounted {
+		log.Infoln("Unmounting staging tmpfs at", this.Root)
+		if err := unmount(this.Root); err != nil {
+			log.Errorln("Error unmounting staging tmpfs:", this.Root, err)
+			return errTeardownFailed
+		}
+		this.rootUnmounted = true
+	}
+
+	if err := os.Remove(this.Root); err != nil && !os.IsNotExist(err) {
+		log.Errorln("Error removing staging directory:", this.Root, err)
+		return errTeardownFailed
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package volumemount
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/wrouesnel/docker-simple-disk/fsutil"
+	"github.com/wrouesnel/docker-simple-disk/volumeaccess"
+)
+
+type TeardownSuite struct {
+	// Paths which are currently mounted
+	mounted map[string]bool
+	// Paths which fail to unmount
+	busy map[string]bool
+	// Every path unmount was called with
+	unmounts []string
+	// Open device-mapper mappings, and whether they are busy
+	mappings map[string]bool
+}
+
+var _ = Suite(&TeardownSuite{})
+
+var errBusy = errors.New("target is busy")
+
+func (this *TeardownSuite) SetUpTest(c *C) {
+	this.mounted = make(map[string]bool)
+	this.busy = make(map[string]bool)
+	this.unmounts = nil
+	this.mappings = make(map[string]bool)
+	unmountLazy = func(path string) error {
+		if !this.mounted[path] {
+			return errUnmountFailed
+		}
+		delete(this.mounted, path)
+		return nil
+	}
+	mappingExists = func(name string) bool {
+		_, found := this.mappings[name]
+		return found
+	}
+	closeMapping = func(name string) error {
+		if this.mappings[name] {
+			return errBusy
+		}
+		delete(this.mappings, name)
+		return nil
+	}
+	unmount = func(path string) error {
+		this.unmounts = append(this.unmounts, path)
+		if !this.mounted[path] {
+			return errUnmountFailed
+		}
+		if this.busy[path] {
+			return errBusy
+		}
+		delete(this.mounted, path)
+		return nil
+	}
+}
+
+func (this *TeardownSuite) TearDownTest(c *C) {
+	unmount = Unmount
+	unmountLazy = UnmountLazy
+	closeMapping = volumeaccess.CloseMapping
+	mappingExists = volumeaccess.MappingExists
+}
+
+// fakeContext is an opened data partition which can only be closed once. If it
+// has a mapping name it is closed with closeMapping.
+type fakeContext struct {
+	mapping string
+	closed  bool
+}
+
+func (this *fakeContext) GetDevicePath() string  { return "/dev/fake" }
+func (this *fakeContext) GetMappingName() string { return this.mapping }
+func (this *fakeContext) Close() error {
+	if this.closed {
+		return errors.New("already closed")
+	}
+	if this.mapping != "" {
+		if err := closeMapping(this.mapping); err != nil {
+			return err
+		}
+	}
+	this.closed = true
+	return nil
+}
+
+// stagedVolume makes a staged volume of mounted fake disks.
+func (this *TeardownSuite) stagedVolume(c *C, names ...string) *StagedVolume {
+	root := filepath.Join(c.MkDir(), "volume")
+	c.Assert(os.Mkdir(root, os.FileMode(0755)), IsNil)
+	this.mounted[root] = true
+	staged := &StagedVolume{Root: root}
+	for _, name := range names {
+		disk := &DiskMount{
+			DiskSource: DiskSource{Name: name, DataPath: "/dev/" + name},
+			Mountpoint: filepath.Join(root, name),
+			ctx:        &fakeContext{},
+		}
+		this.mounted[disk.Mountpoint] = true
+		staged.Disks = append(staged.Disks, disk)
+	}
+	return staged
+}
+
+func (this *TeardownSuite) TestTeardown(c *C) {
+	staged := this.stagedVolume(c, "0", "1")
+	c.Assert(staged.Teardown(), IsNil)
+	c.Check(staged.Disks, HasLen, 0)
+	c.Check(this.mounted, HasLen, 0)
+	c.Check(fsutil.PathExists(staged.Root), Equals, false)
+	c.Check(this.unmounts, DeepEquals, []string{
+		filepath.Join(staged.Root, "1"), filepath.Join(staged.Root, "0"), staged.Root,
+	})
+}
+
+func (this *TeardownSuite) TestTeardownRetriesBusyDisk(c *C) {
+	staged := this.stagedVolume(c, "0", "1", "2")
+	busy := filepath.Join(staged.Root, "1")
+	this.busy[busy] = true
+
+	c.Check(staged.Teardown(), Equals, errTeardownFailed)
+	c.Assert(staged.Disks, HasLen, 1)
+	c.Check(staged.Disks[0].Name, Equals, "1")
+	c.Check(this.mounted[staged.Root], Equals, true, Commentf("staging tmpfs unmounted under a busy disk"))
+
+	// Only the busy disk is tried again, and the volume comes down once it
+	// is free.
+	delete(this.busy, busy)
+	this.unmounts = nil
+	c.Assert(staged.Teardown(), IsNil)
+	c.Check(this.unmounts, DeepEquals, []string{busy, staged.Root})
+	c.Check(staged.Disks, HasLen, 0)
+	c.Check(this.mounted, HasLen, 0)
+}
+
+func (this *TeardownSuite) TestTeardownRetriesFailedClose(c *C) {
+	staged := this.stagedVolume(c, "0")
+	ctx := staged.Disks[0].ctx.(*fakeContext)
+	ctx.closed = true
+
+	c.Check(staged.Teardown(), Equals, errTeardownFailed)
+	c.Check(this.mounted[staged.Root], Equals, true)
+
+	// The disk is already unmounted, so the retry only closes it.
+	ctx.closed = false
+	this.unmounts = nil
+	c.Assert(staged.Teardown(), IsNil)
+	c.Check(this.unmounts, DeepEquals, []string{staged.Root})
+}
+
+// encrypt gives a disk of a staged volume an open mapping.
+func (this *TeardownSuite) encrypt(disk *DiskMount) {
+	disk.MappingName = "mapping-" + disk.Name
+	disk.ctx = &fakeContext{mapping: disk.MappingName}
+	this.mappings[disk.MappingName] = false
+}
+
+func (this *TeardownSuite) TestRemoveDiskDefersBusyClose(c *C) {
+	staged := this.stagedVolume(c, "0", "1")
+	staged.Placeholders = []string{"0", "1"}
+	this.encrypt(staged.Disks[0])
+	this.mappings["mapping-0"] = true
+
+	// The disk is gone even though its mapping couldn't be closed yet.
+	c.Assert(staged.RemoveDisk("0"), IsNil)
+	c.Assert(staged.Disks, HasLen, 1)
+	c.Check(staged.Disks[0].Name, Equals, "1")
+	c.Check(staged.DeferredMappings, DeepEquals, []string{"mapping-0"})
+
+	staged.CloseDeferredMappings()
+	c.Check(staged.DeferredMappings, DeepEquals, []string{"mapping-0"})
+
+	this.mappings["mapping-0"] = false
+	staged.CloseDeferredMappings()
+	c.Check(staged.DeferredMappings, HasLen, 0)
+	c.Check(this.mappings, HasLen, 0)
+}
+
+func (this *TeardownSuite) TestTeardownClosesDeferredMappings(c *C) {
+	staged := this.stagedVolume(c, "0")
+	staged.DeferredMappings = []string{"busy", "free", "gone"}
+	this.mappings["busy"] = true
+	this.mappings["free"] = false
+
+	// Busy mappings don't hold up the teardown.
+	c.Assert(staged.Teardown(), IsNil)
+	c.Check(staged.DeferredMappings, DeepEquals, []string{"busy"})
+	c.Check(this.mappings, DeepEquals, map[string]bool{"busy": true})
+}
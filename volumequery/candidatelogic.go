@@ -16,25 +16,37 @@ var (
 // A safe disk is either one which is already labelled as a simple disk, or
 // one which is unpartitioned and does not appear to contain a filesystem or
 // appear in the mount table.
-func GetCandidateDisks(selectionRules []DeviceSelectionRule) (initialized []string, uninitialized []string, rejected []string, rerr error) {
-	diskPaths, err := GetDevicePaths(selectionRules)
+//
+// Disks which the system is using (mounted, active swap, held by device-mapper
+// or md, or a volume manager member) are rejected with errDiskInUse, including
+// simple disks (i.e. those already mounted by another volume).
+//
+// If a claim ledger is supplied, disks which the claimant could not claim
+// (including disks with no stable identity to claim them by) are rejected.
+func GetCandidateDisks(selectionRules []DeviceSelectionRule, ledger *ClaimLedger, claimant Claimant) (initialized []string, uninitialized []string, rejected []string, rerr error) {
+	db, err := SnapshotDeviceDatabase()
 	if err != nil {
 		rerr = err
 		return
 	}
-	for _, diskPath := range diskPaths {
-		isInitialized, failReason, err := CheckIfDiskIsInitialized(diskPath)
-		if err != nil {
-			rerr = err
-			return
-		}
-		// Sort the disk based on what it is...
-		if isInitialized {
-			initialized = append(initialized, diskPath)
-		} else if IsBlankDisk(isInitialized, failReason) {
-			uninitialized = append(uninitialized, diskPath)
-		} else {
-			rejected = append(rejected, diskPath)
+	return db.CandidateDisks(selectionRules, ledger, claimant)
+}
+
+// CandidateDisks implements GetCandidateDisks against the snapshot.
+func (this *DeviceDatabase) CandidateDisks(selectionRules []DeviceSelectionRule, ledger *ClaimLedger, claimant Claimant) (initialized []string, uninitialized []string, rejected []string, rerr error) {
+	report, err := this.CandidateReport(selectionRules, ledger, claimant)
+	if err != nil {
+		rerr = err
+		return
+	}
+	for _, candidate := range report {
+		switch candidate.Class {
+		case DiskInitialized:
+			initialized = append(initialized, candidate.DiskPath)
+		case DiskUninitialized:
+			uninitialized = append(uninitialized, candidate.DiskPath)
+		default:
+			rejected = append(rejected, candidate.DiskPath)
 		}
 	}
 	// All good! We have our candidates!
@@ -47,14 +59,38 @@ func GetCandidateDisks(selectionRules []DeviceSelectionRule) (initialized []stri
 // Returns the initialization state, failure reason if not initialized, label
 // volume path, device volume path, and lookup error state.
 func checkAndGetInitializedDisk(diskPath string) (bool, DiskFailReason, string, string, error) {
-	partDevices, err := GetPartitionDevicesFromDiskPath(diskPath)
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return false, errUnknown, "", "", err
+	}
+	return db.checkAndGetInitializedDisk(diskPath)
+}
+
+// checkAndGetInitializedDisk implements checkAndGetInitializedDisk against the
+// snapshot. Disks which aren't simple disks and are in use by the system fail
+// with errDiskInUse. Simple disks are in use by us while their volumes are
+// mounted, so are only checked when they are picked as candidates (see
+// CandidateReport).
+func (this *DeviceDatabase) checkAndGetInitializedDisk(diskPath string) (bool, DiskFailReason, string, string, error) {
+	isInitialized, failReason, labelDevice, dataDevice, err := this.classifyDisk(diskPath)
+	if err != nil || isInitialized {
+		return isInitialized, failReason, labelDevice, dataDevice, err
+	}
+	failReason, err = this.checkDiskAvailable(diskPath, failReason)
+	return isInitialized, failReason, labelDevice, dataDevice, err
+}
+
+// classifyDisk determines if a disk is a simple disk from its partitions and
+// their udev properties.
+func (this *DeviceDatabase) classifyDisk(diskPath string) (bool, DiskFailReason, string, string, error) {
+	partDevices, err := this.Partitions(diskPath)
 	if err != nil {
 		return false, errUnknown, "", "", err
 	}
 
 	if len(partDevices) == 0 {
 		// Okay, no partitions. Does it have a filesystem?
-		device, err := GetFullSelectionRuleForDevice(diskPath)
+		device, err := this.Device(diskPath)
 		if err != nil {
 			return false, errUnknown, "", "", err
 		}
@@ -115,7 +151,17 @@ func CheckIfDiskIsInitialized(diskPath string) (bool, DiskFailReason, error) {
 
 // GetDiskLabelAndVolumePath get's the disk label and volume path.
 func GetDiskLabelAndVolumePath(diskPath string) (string, string, error) {
-	isInitialized, failReason, labelPath, volumePath, err := checkAndGetInitializedDisk(diskPath)
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return "", "", err
+	}
+	return db.DiskLabelAndVolumePath(diskPath)
+}
+
+// DiskLabelAndVolumePath implements GetDiskLabelAndVolumePath against the
+// snapshot.
+func (this *DeviceDatabase) DiskLabelAndVolumePath(diskPath string) (string, string, error) {
+	isInitialized, failReason, labelPath, volumePath, err := this.checkAndGetInitializedDisk(diskPath)
 	if err != nil {
 		return "", "", err
 	}
@@ -150,7 +196,16 @@ func IsBlankDisk(isInitialized bool, failReason DiskFailReason) bool {
 // CheckIfDiskIsInitialized - if you need to do both checks, then it's better to
 // use IsBlankDisk which just does the response code parsing.
 func CheckIfDiskIsBlankCandidate(diskPath string) (bool, error) {
-	isInitialized, failReason, err := CheckIfDiskIsInitialized(diskPath)
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return false, err
+	}
+	return db.IsBlankCandidate(diskPath)
+}
+
+// IsBlankCandidate implements CheckIfDiskIsBlankCandidate against the snapshot.
+func (this *DeviceDatabase) IsBlankCandidate(diskPath string) (bool, error) {
+	isInitialized, failReason, _, _, err := this.checkAndGetInitializedDisk(diskPath)
 	if err != nil {
 		return false, err
 	}
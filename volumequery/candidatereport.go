@@ -0,0 +1,175 @@
+// Implements the candidate disk report, which records how each candidate disk
+// was classified and why disks were rejected.
+
+package volumequery
+
+import (
+	"github.com/wrouesnel/go.log"
+)
+
+// DiskClass is how a candidate disk was classified.
+type DiskClass string
+
+const (
+	// Disk is an initialized simple disk
+	DiskInitialized DiskClass = "initialized"
+	// Disk is blank and could be initialized
+	DiskUninitialized DiskClass = "uninitialized"
+	// Disk can't be used by simple
+	DiskRejected DiskClass = "rejected"
+)
+
+// LabelReader reads the volume label of an initialized disk from its label
+// partition (i.e. DeserializeVolumeLabel).
+type LabelReader func(labelPath string) (VolumeLabel, error)
+
+// CandidateDisk is the assessment of a single candidate disk.
+type CandidateDisk struct {
+	// Disk device path
+	DiskPath string `json:"devnode"`
+	// Stable identity of the disk (see DiskIdentity), if it has one
+	Identity string `json:"identity,omitempty"`
+	// Disk size, if known
+	SizeBytes uint64 `json:"size_bytes"`
+	// How the disk was classified
+	Class DiskClass `json:"class"`
+	// Why the disk was rejected, or why it isn't initialized
+	FailReason DiskFailReason `json:"-"`
+	// FailReason as a string
+	Reason string `json:"reason,omitempty"`
+	// Label and data partitions of initialized disks
+	LabelPath string `json:"label_path,omitempty"`
+	DataPath  string `json:"data_path,omitempty"`
+	// Volume label of initialized disks, if it was read
+	Label *VolumeLabel `json:"label,omitempty"`
+	// Why the volume label couldn't be read
+	LabelError string `json:"label_error,omitempty"`
+	// Set if the data partition GPT name disagrees with the volume label
+	PartitionNameMismatch *PartitionNameMismatch `json:"partition_name_mismatch,omitempty"`
+}
+
+// setFailReason records why the disk isn't an initialized disk.
+func (this *CandidateDisk) setFailReason(failReason DiskFailReason) {
+	this.FailReason = failReason
+	if failReason != nil {
+		this.Reason = failReason.Error()
+	}
+}
+
+// GetCandidateReport assesses every disk matched by the selection rules as
+// GetCandidateDisks does, and reports how each disk was classified and why.
+// If readLabel is not nil it is used to read the volume label of initialized
+// disks, which is also cross-checked against the data partition GPT name.
+func GetCandidateReport(selectionRules []DeviceSelectionRule, ledger *ClaimLedger, claimant Claimant, readLabel LabelReader) ([]CandidateDisk, error) {
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return nil, err
+	}
+	report, err := db.CandidateReport(selectionRules, ledger, claimant)
+	if err != nil {
+		return nil, err
+	}
+	if readLabel != nil {
+		for idx, _ := range report {
+			candidate := &report[idx]
+			if candidate.Class != DiskInitialized {
+				continue
+			}
+			label, err := readLabel(candidate.LabelPath)
+			if err != nil {
+				candidate.LabelError = err.Error()
+				continue
+			}
+			candidate.Label = &label
+			if dataPartition, err := db.Device(candidate.DataPath); err == nil {
+				candidate.PartitionNameMismatch = checkPartitionName(&label, dataPartition)
+			}
+		}
+	}
+	return report, nil
+}
+
+// ledgerClaimable returns true if a disk known by the given identities can be
+// claimed. A disk may have been claimed by an identity it no longer prefers,
+// so every identity is checked.
+func ledgerClaimable(ledger *ClaimLedger, identities []string, claimant Claimant) bool {
+	for _, identity := range identities {
+		if !ledger.Claimable(identity, claimant) {
+			return false
+		}
+	}
+	return true
+}
+
+// CandidateReport implements GetCandidateReport against the snapshot, without
+// reading volume labels. Candidates are sorted by device path.
+func (this *DeviceDatabase) CandidateReport(selectionRules []DeviceSelectionRule, ledger *ClaimLedger, claimant Claimant) ([]CandidateDisk, error) {
+	diskPaths, err := this.CandidatePaths(selectionRules)
+	if err != nil {
+		return nil, err
+	}
+
+	report := make([]CandidateDisk, 0, len(diskPaths))
+	for _, diskPath := range diskPaths {
+		candidate := CandidateDisk{
+			DiskPath: diskPath,
+		}
+		if device, err := this.Device(diskPath); err == nil {
+			candidate.SizeBytes, _ = DeviceSizeBytes(device)
+		}
+		identities, err := this.DiskIdentities(diskPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(identities) > 0 {
+			candidate.Identity = identities[0]
+		}
+
+		if ledger != nil {
+			// Disks are claimed by identity, so one with none (i.e. a blank
+			// virtio disk udev gave no ID_PATH) can't be handed out safely.
+			if candidate.Identity == "" {
+				log.Debugln("Rejecting disk:", diskPath, errNoStableIdentity)
+				candidate.Class = DiskRejected
+				candidate.setFailReason(errNoStableIdentity)
+				report = append(report, candidate)
+				continue
+			}
+			if !ledgerClaimable(ledger, identities, claimant) {
+				log.Debugln("Rejecting disk:", diskPath, errDiskClaimed)
+				candidate.Class = DiskRejected
+				candidate.setFailReason(errDiskClaimed)
+				report = append(report, candidate)
+				continue
+			}
+		}
+
+		isInitialized, failReason, labelPath, dataPath, err := this.checkAndGetInitializedDisk(diskPath)
+		if err != nil {
+			return nil, err
+		}
+		if isInitialized {
+			// Simple disks the system is using (i.e. mounted by another
+			// volume, or by hand) can't be handed out either.
+			failReason, err = this.checkDiskAvailable(diskPath, failReason)
+			if err != nil {
+				return nil, err
+			}
+			isInitialized = failReason == nil
+		}
+		candidate.setFailReason(failReason)
+		// Sort the disk based on what it is...
+		if isInitialized {
+			candidate.Class = DiskInitialized
+			candidate.LabelPath = labelPath
+			candidate.DataPath = dataPath
+		} else if IsBlankDisk(isInitialized, failReason) {
+			candidate.Class = DiskUninitialized
+		} else {
+			log.Debugln("Rejecting disk:", diskPath, failReason)
+			candidate.Class = DiskRejected
+		}
+		report = append(report, candidate)
+	}
+	return report, nil
+}
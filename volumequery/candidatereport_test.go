@@ -0,0 +1,91 @@
+package volumequery
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+type CandidateReportTestSuite struct {
+	restore func()
+}
+
+var _ = Suite(&CandidateReportTestSuite{})
+
+func (this *CandidateReportTestSuite) SetUpTest(c *C) {
+	this.restore = useTestSnapshot(c)
+}
+
+func (this *CandidateReportTestSuite) TearDownTest(c *C) {
+	this.restore()
+}
+
+func (this *CandidateReportTestSuite) TestGetCandidateReport(c *C) {
+	readLabel := func(labelPath string) (VolumeLabel, error) {
+		c.Check(labelPath, Equals, "/dev/sdb1")
+		return VolumeLabel{Version: 1, Label: "test"}, nil
+	}
+
+	report, err := GetCandidateReport(diskRules(), nil, Claimant{}, readLabel)
+	c.Assert(err, IsNil)
+
+	classes := make(map[string]DiskClass)
+	reasons := make(map[string]DiskFailReason)
+	for _, candidate := range report {
+		classes[candidate.DiskPath] = candidate.Class
+		reasons[candidate.DiskPath] = candidate.FailReason
+	}
+	c.Check(classes, DeepEquals, map[string]DiskClass{
+		"/dev/sda": DiskUninitialized,
+		"/dev/sdb": DiskInitialized,
+		"/dev/sdc": DiskRejected,
+		"/dev/sdd": DiskRejected,
+		"/dev/sde": DiskRejected,
+		"/dev/sdf": DiskUninitialized,
+	})
+	c.Check(reasons["/dev/sda"], Equals, errBlankDisk)
+	c.Check(reasons["/dev/sdb"], IsNil)
+	c.Check(reasons["/dev/sdc"], Equals, errHasAFilesystem)
+	c.Check(reasons["/dev/sdd"], Equals, errCouldNotFindLabelPartition)
+	c.Check(reasons["/dev/sde"], Equals, errHasPartitionTable)
+
+	sdb := report[1]
+	c.Assert(sdb.DiskPath, Equals, "/dev/sdb")
+	c.Check(sdb.Identity, Equals, IdentityPrefixSerial+"SIMPLE_DISK_B")
+	c.Check(sdb.SizeBytes, Equals, uint64(4194304)*SysfsSectorSize)
+	c.Check(sdb.LabelPath, Equals, "/dev/sdb1")
+	c.Check(sdb.DataPath, Equals, "/dev/sdb2")
+	c.Assert(sdb.Label, NotNil)
+	c.Check(sdb.Label.Label, Equals, "test")
+	c.Check(report[2].Reason, Equals, errHasAFilesystem.Error())
+}
+
+func (this *CandidateReportTestSuite) TestGetCandidateReport_LabelErrors(c *C) {
+	readLabel := func(labelPath string) (VolumeLabel, error) {
+		return VolumeLabel{}, errors.New("unreadable")
+	}
+
+	report, err := GetCandidateReport(diskRules(), nil, Claimant{}, readLabel)
+	c.Assert(err, IsNil)
+	c.Assert(report[1].DiskPath, Equals, "/dev/sdb")
+	c.Check(report[1].Label, IsNil)
+	c.Check(report[1].LabelError, Equals, "unreadable")
+}
+
+func (this *CandidateReportTestSuite) TestGetCandidateReport_LedgerReasons(c *C) {
+	ledger := NewClaimLedger()
+	identity, err := GetDiskIdentity("/dev/sda")
+	c.Assert(err, IsNil)
+	c.Assert(ledger.Claim([]string{identity}, Claimant{Volume: "other", Exclusive: true}), IsNil)
+
+	report, err := GetCandidateReport(diskRules(), ledger, Claimant{Volume: "mine", Exclusive: true}, nil)
+	c.Assert(err, IsNil)
+	for _, candidate := range report {
+		switch candidate.DiskPath {
+		case "/dev/sda":
+			c.Check(candidate.FailReason, Equals, errDiskClaimed)
+		case "/dev/sdf":
+			c.Check(candidate.FailReason, Equals, errNoStableIdentity)
+		}
+	}
+}
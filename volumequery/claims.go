@@ -0,0 +1,268 @@
+// Implements the claim ledger which tracks which volumes are using which disks,
+// so exclusive disks are never handed to more than one volume.
+
+package volumequery
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	errDiskClaimed       = DiskFailReason(errors.New("disk is claimed by another volume"))
+	errNoStableIdentity  = DiskFailReason(errors.New("disk has no stable identity (no WWN, serial, partition GUID or udev ID_PATH)"))
+	errClaimConflict     = errors.New("disk is already claimed by another volume")
+	errClaimNoIdentities = errors.New("no disk identities given to claim")
+)
+
+const (
+	IdentityPrefixWWN       string = "wwn:"
+	IdentityPrefixSerial    string = "serial:"
+	IdentityPrefixPartUUID  string = "partuuid:"
+	IdentityPrefixMultipath string = "mpath:"
+	IdentityPrefixPath      string = "path:"
+)
+
+// DiskIdentity returns a stable identity for a disk from its udev properties.
+// The WWN is preferred, then the serial number, then the WWID of a multipath
+// map. If the disk has none of them, the GPT partition GUID of its data
+// partition is used if one is given, and failing that the udev ID_PATH of the
+// disk. Returns a blank string if the disk has no stable identity.
+func DiskIdentity(disk *DeviceSelectionRule, dataPartition *DeviceSelectionRule) string {
+	identities := DiskIdentities(disk, dataPartition)
+	if len(identities) == 0 {
+		return ""
+	}
+	return identities[0]
+}
+
+// DiskIdentities returns every stable identity of a disk in the order
+// DiskIdentity prefers them. A disk is known by all of them, so a disk claimed
+// by one identity is still found once it has a preferred one.
+//
+// This is what lets blank disks with no hardware identity (i.e. virtio disks
+// without a serial) be claimed: they are claimed by ID_PATH, and found by it
+// after initialization gives them a partition GUID. ID_PATH names the slot a
+// disk is attached to rather than the disk, so such a disk is lost to its
+// volume if it is moved to another slot. Disks with a hardware identity are
+// never known by ID_PATH.
+func DiskIdentities(disk *DeviceSelectionRule, dataPartition *DeviceSelectionRule) []string {
+	identities := []string{}
+	if wwn := disk.Properties["ID_WWN_WITH_EXTENSION"]; wwn != "" {
+		identities = append(identities, IdentityPrefixWWN+wwn)
+	} else if wwn := disk.Properties["ID_WWN"]; wwn != "" {
+		identities = append(identities, IdentityPrefixWWN+wwn)
+	}
+	if serial := disk.Properties["ID_SERIAL"]; serial != "" {
+		identities = append(identities, IdentityPrefixSerial+serial)
+	}
+	if wwid, isMap := deviceMultipathMap(disk); isMap && wwid != "" {
+		identities = append(identities, IdentityPrefixMultipath+wwid)
+	}
+	if len(identities) > 0 {
+		return identities
+	}
+
+	// Without a hardware identity, fall back to identities which belong to
+	// the partitions or slot rather than the disk.
+	if dataPartition != nil {
+		if partUUID := dataPartition.Properties["ID_PART_ENTRY_UUID"]; partUUID != "" {
+			identities = append(identities, IdentityPrefixPartUUID+partUUID)
+		}
+	}
+	if path := disk.Properties["ID_PATH"]; path != "" {
+		identities = append(identities, IdentityPrefixPath+path)
+	}
+	return identities
+}
+
+// GetDiskIdentity queries the stable identity of the disk at the given path.
+// Returns a blank string if the disk has no stable identity.
+func GetDiskIdentity(diskPath string) (string, error) {
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return "", err
+	}
+	return db.DiskIdentity(diskPath)
+}
+
+// DiskIdentity implements GetDiskIdentity against the snapshot.
+func (this *DeviceDatabase) DiskIdentity(diskPath string) (string, error) {
+	identities, err := this.DiskIdentities(diskPath)
+	if err != nil || len(identities) == 0 {
+		return "", err
+	}
+	return identities[0], nil
+}
+
+// DiskIdentities returns every stable identity of the disk at the given path
+// (see DiskIdentities).
+func (this *DeviceDatabase) DiskIdentities(diskPath string) ([]string, error) {
+	disk, err := this.Device(diskPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataPartition *DeviceSelectionRule
+	isInitialized, _, _, dataPath, err := this.checkAndGetInitializedDisk(diskPath)
+	if err != nil {
+		return nil, err
+	}
+	if isInitialized {
+		dataPartition, err = this.Device(dataPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return DiskIdentities(disk, dataPartition), nil
+}
+
+// FindDisksByIdentity scans the disks matched by the selection rules and
+// returns the device paths of those with the given identities, keyed by
+// identity. A disk is found by any of its identities (see DiskIdentities).
+// Identities which could not be found are omitted.
+func FindDisksByIdentity(selectionRules []DeviceSelectionRule, identities []string) (map[string]string, error) {
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return db.FindDisksByIdentity(selectionRules, identities)
+}
+
+// FindDisksByIdentity implements FindDisksByIdentity against the snapshot.
+func (this *DeviceDatabase) FindDisksByIdentity(selectionRules []DeviceSelectionRule, identities []string) (map[string]string, error) {
+	wanted := make(map[string]struct{}, len(identities))
+	for _, identity := range identities {
+		wanted[identity] = struct{}{}
+	}
+
+	diskPaths, err := this.CandidatePaths(selectionRules)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]string, len(identities))
+	for _, diskPath := range diskPaths {
+		identities, err := this.DiskIdentities(diskPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, identity := range identities {
+			if _, ok := wanted[identity]; ok {
+				found[identity] = diskPath
+			}
+		}
+	}
+	return found, nil
+}
+
+// Claimant identifies a volume claiming disks.
+type Claimant struct {
+	// Name of the volume
+	Volume string
+	// Whether the volume requires exclusive use of its disks
+	Exclusive bool
+}
+
+// ClaimLedger records which volumes have claimed which disks, keyed by disk
+// identity. It is safe for concurrent use.
+type ClaimLedger struct {
+	mtx    sync.Mutex
+	claims map[string][]Claimant
+}
+
+// NewClaimLedger returns an empty claim ledger.
+func NewClaimLedger() *ClaimLedger {
+	return &ClaimLedger{
+		claims: make(map[string][]Claimant),
+	}
+}
+
+// claimable implements Claimable. Caller must hold the ledger mutex.
+func (this *ClaimLedger) claimable(identity string, claimant Claimant) bool {
+	for _, existing := range this.claims[identity] {
+		if existing.Volume == claimant.Volume {
+			continue
+		}
+		// An exclusive claim on either side prevents sharing.
+		if existing.Exclusive || claimant.Exclusive {
+			return false
+		}
+	}
+	return true
+}
+
+// Claimable checks if the claimant could claim the disk with the given
+// identity. A disk can be shared between any number of non-exclusive volumes,
+// but an exclusive volume can only claim a disk no other volume has claimed.
+func (this *ClaimLedger) Claimable(identity string, claimant Claimant) bool {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	return this.claimable(identity, claimant)
+}
+
+// Claim records the claimant as using all the given disk identities. Either
+// every identity is claimed, or none are and an error is returned.
+func (this *ClaimLedger) Claim(identities []string, claimant Claimant) error {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	for _, identity := range identities {
+		if identity == "" {
+			return errClaimNoIdentities
+		}
+		if !this.claimable(identity, claimant) {
+			return errClaimConflict
+		}
+	}
+
+	for _, identity := range identities {
+		alreadyClaimed := false
+		for _, existing := range this.claims[identity] {
+			if existing.Volume == claimant.Volume {
+				alreadyClaimed = true
+				break
+			}
+		}
+		if !alreadyClaimed {
+			this.claims[identity] = append(this.claims[identity], claimant)
+		}
+	}
+	return nil
+}
+
+// Release removes every claim held by the named volume and returns the
+// identities which were released.
+func (this *ClaimLedger) Release(volume string) []string {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	released := []string{}
+	for identity, claimants := range this.claims {
+		remaining := claimants[:0]
+		for _, claimant := range claimants {
+			if claimant.Volume == volume {
+				released = append(released, identity)
+			} else {
+				remaining = append(remaining, claimant)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(this.claims, identity)
+		} else {
+			this.claims[identity] = remaining
+		}
+	}
+	sort.Strings(released)
+	return released
+}
+
+// Claimants returns the volumes which have claimed the given disk identity.
+func (this *ClaimLedger) Claimants(identity string) []Claimant {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	return append([]Claimant{}, this.claims[identity]...)
+}
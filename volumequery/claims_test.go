@@ -0,0 +1,160 @@
+package volumequery
+
+import (
+	"fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+type ClaimsTestSuite struct{}
+
+var _ = Suite(&ClaimsTestSuite{})
+
+func (this *ClaimsTestSuite) TestDiskIdentityPrecedence(c *C) {
+	disk := &DeviceSelectionRule{
+		Properties: map[string]string{
+			"ID_WWN":    "0x5000c500a1b2c3d4",
+			"ID_SERIAL": "ST4000DM000_Z300ABCD",
+		},
+	}
+	part := &DeviceSelectionRule{
+		Properties: map[string]string{
+			"ID_PART_ENTRY_UUID": "4f68bce3-e8cd-4db1-96e7-fbcaf984b709",
+		},
+	}
+
+	c.Check(DiskIdentity(disk, part), Equals, "wwn:0x5000c500a1b2c3d4")
+
+	delete(disk.Properties, "ID_WWN")
+	c.Check(DiskIdentity(disk, part), Equals, "serial:ST4000DM000_Z300ABCD")
+
+	delete(disk.Properties, "ID_SERIAL")
+	c.Check(DiskIdentity(disk, part), Equals, "partuuid:4f68bce3-e8cd-4db1-96e7-fbcaf984b709")
+	c.Check(DiskIdentity(disk, nil), Equals, "")
+}
+
+func (this *ClaimsTestSuite) TestExclusiveClaimsAreNotShared(c *C) {
+	ledger := NewClaimLedger()
+
+	c.Assert(ledger.Claim([]string{"wwn:a", "wwn:b"}, Claimant{"vol1", true}), IsNil)
+
+	c.Check(ledger.Claimable("wwn:a", Claimant{"vol1", true}), Equals, true)
+	c.Check(ledger.Claimable("wwn:a", Claimant{"vol2", true}), Equals, false)
+	c.Check(ledger.Claimable("wwn:a", Claimant{"vol2", false}), Equals, false)
+	c.Check(ledger.Claimable("wwn:c", Claimant{"vol2", true}), Equals, true)
+
+	// Claims are all or nothing.
+	c.Check(ledger.Claim([]string{"wwn:c", "wwn:b"}, Claimant{"vol2", false}), NotNil)
+	c.Check(len(ledger.Claimants("wwn:c")), Equals, 0)
+
+	c.Check(ledger.Release("vol1"), DeepEquals, []string{"wwn:a", "wwn:b"})
+	c.Check(ledger.Claimable("wwn:a", Claimant{"vol2", true}), Equals, true)
+}
+
+func (this *ClaimsTestSuite) TestSharedClaims(c *C) {
+	ledger := NewClaimLedger()
+
+	c.Assert(ledger.Claim([]string{"serial:a"}, Claimant{"vol1", false}), IsNil)
+	c.Assert(ledger.Claim([]string{"serial:a"}, Claimant{"vol2", false}), IsNil)
+	c.Check(len(ledger.Claimants("serial:a")), Equals, 2)
+
+	// An exclusive volume can't take a shared disk.
+	c.Check(ledger.Claim([]string{"serial:a"}, Claimant{"vol3", true}), NotNil)
+
+	ledger.Release("vol1")
+	c.Check(ledger.Claimants("serial:a"), DeepEquals, []Claimant{{"vol2", false}})
+}
+
+func (this *ClaimsTestSuite) TestDiskIdentityFallsBackToPath(c *C) {
+	disk := &DeviceSelectionRule{
+		Properties: map[string]string{
+			"ID_SERIAL": "ST4000DM000_Z300ABCD",
+			"ID_PATH":   "pci-0000:00:05.0",
+		},
+	}
+	part := &DeviceSelectionRule{
+		Properties: map[string]string{
+			"ID_PART_ENTRY_UUID": "4f68bce3-e8cd-4db1-96e7-fbcaf984b709",
+		},
+	}
+
+	// Disks with a hardware identity aren't known by their slot.
+	c.Check(DiskIdentities(disk, part), DeepEquals, []string{"serial:ST4000DM000_Z300ABCD"})
+
+	delete(disk.Properties, "ID_SERIAL")
+	c.Check(DiskIdentities(disk, nil), DeepEquals, []string{"path:pci-0000:00:05.0"})
+	c.Check(DiskIdentities(disk, part), DeepEquals,
+		[]string{"partuuid:4f68bce3-e8cd-4db1-96e7-fbcaf984b709", "path:pci-0000:00:05.0"})
+	c.Check(DiskIdentity(disk, part), Equals, "partuuid:4f68bce3-e8cd-4db1-96e7-fbcaf984b709")
+}
+
+// virtioDevices fabricates a virtio disk with no serial, initialized or not.
+func virtioDevices(initialized bool) []*DeviceSelectionRule {
+	devices := []*DeviceSelectionRule{
+		&DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{"vda"},
+			Properties: map[string]string{
+				"DEVNAME": "/dev/vda",
+				"DEVTYPE": "disk",
+				"MAJOR":   "253",
+				"MINOR":   "0",
+				"ID_PATH": "pci-0000:00:05.0",
+			},
+			Attrs: map[string]string{"size": "2097152"},
+		},
+	}
+	if !initialized {
+		return devices
+	}
+	devices[0].Properties["ID_PART_TABLE_TYPE"] = "gpt"
+	for idx, name := range []string{SimpleMetadataLabel, "data"} {
+		devices = append(devices, &DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{fmt.Sprintf("vda%d", idx+1)},
+			Properties: map[string]string{
+				"DEVNAME":            fmt.Sprintf("/dev/vda%d", idx+1),
+				"DEVTYPE":            "partition",
+				"MAJOR":              "253",
+				"MINOR":              fmt.Sprintf("%d", idx+1),
+				"ID_PART_ENTRY_DISK": "253:0",
+				"ID_PART_ENTRY_NAME": name,
+				"ID_PART_ENTRY_UUID": fmt.Sprintf("4f68bce3-e8cd-4db1-96e7-fbcaf984b70%d", idx),
+			},
+		})
+	}
+	devices[1].Properties["ID_PART_ENTRY_TYPE"] = SimpleMetadataUUID
+	return devices
+}
+
+func (this *ClaimsTestSuite) TestBlankVirtioDiskIsClaimable(c *C) {
+	rules := []DeviceSelectionRule{
+		DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{"vd*"},
+			Properties: map[string]string{"DEVTYPE": "disk"},
+		},
+	}
+	ledger := NewClaimLedger()
+
+	blank := NewDeviceDatabase(virtioDevices(false))
+	report, err := blank.CandidateReport(rules, ledger, Claimant{Volume: "vol1", Exclusive: true})
+	c.Assert(err, IsNil)
+	c.Assert(report, HasLen, 1)
+	c.Check(report[0].Class, Equals, DiskUninitialized)
+	c.Assert(report[0].Identity, Equals, "path:pci-0000:00:05.0")
+	c.Assert(ledger.Claim([]string{report[0].Identity}, Claimant{Volume: "vol1", Exclusive: true}), IsNil)
+
+	// Once initialized the disk prefers its partition GUID, but is still
+	// found and claimed by the identity it was claimed with.
+	initialized := NewDeviceDatabase(virtioDevices(true))
+	found, err := initialized.FindDisksByIdentity(rules, []string{"path:pci-0000:00:05.0"})
+	c.Assert(err, IsNil)
+	c.Check(found, DeepEquals, map[string]string{"path:pci-0000:00:05.0": "/dev/vda"})
+
+	report, err = initialized.CandidateReport(rules, ledger, Claimant{Volume: "vol2", Exclusive: true})
+	c.Assert(err, IsNil)
+	c.Assert(report, HasLen, 1)
+	c.Check(report[0].Identity, Equals, "partuuid:4f68bce3-e8cd-4db1-96e7-fbcaf984b701")
+	c.Check(report[0].FailReason, Equals, errDiskClaimed)
+}
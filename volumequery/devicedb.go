@@ -0,0 +1,287 @@
+// Implements an indexed snapshot of the device database. Scans which look up
+// many devices take a single snapshot and answer every lookup from its indexes
+// rather than enumerating the whole device database for each lookup.
+
+package volumequery
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// DeviceDatabase is an indexed snapshot of the device database.
+type DeviceDatabase struct {
+	// Every device in the snapshot
+	devices []*DeviceSelectionRule
+	// Devices keyed by device node path
+	byDevnode map[string]*DeviceSelectionRule
+	// Devices keyed by MAJOR:MINOR
+	byDevnum map[string]*DeviceSelectionRule
+	// Partitions keyed by the MAJOR:MINOR of their parent disk
+	partitionsByParent map[string][]*DeviceSelectionRule
+	// MAJOR:MINOR of the disk each partition is on, keyed by the partition's
+	// MAJOR:MINOR
+	parentByPartition map[string]string
+	// Reports how devices are in use by the system. Nil if none are.
+	usage DiskUsageSource
+	// How devices are in use by the system, keyed by MAJOR:MINOR. Read from
+	// usage the first time it is needed, since scans which don't check
+	// availability shouldn't pay for it.
+	inUseOnce sync.Once
+	inUse     map[string]string
+	inUseErr  error
+}
+
+// deviceDevnum returns the MAJOR:MINOR device number of a device.
+func deviceDevnum(device *DeviceSelectionRule) string {
+	major, hasMajor := device.Properties["MAJOR"]
+	minor, hasMinor := device.Properties["MINOR"]
+	if !hasMajor || !hasMinor {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s", major, minor)
+}
+
+// NewDeviceDatabase indexes a list of devices (as full selection rules).
+func NewDeviceDatabase(devices []*DeviceSelectionRule) *DeviceDatabase {
+	db := &DeviceDatabase{
+		devices:            devices,
+		byDevnode:          make(map[string]*DeviceSelectionRule, len(devices)),
+		byDevnum:           make(map[string]*DeviceSelectionRule, len(devices)),
+		partitionsByParent: make(map[string][]*DeviceSelectionRule),
+		parentByPartition:  make(map[string]string),
+	}
+
+	byName := make(map[string]*DeviceSelectionRule, len(devices))
+	byDevpath := make(map[string]*DeviceSelectionRule, len(devices))
+	byDMUUID := make(map[string]*DeviceSelectionRule)
+	for _, device := range devices {
+		if devnode := deviceDevnode(device); devnode != "" {
+			db.byDevnode[devnode] = device
+		}
+		if devnum := deviceDevnum(device); devnum != "" {
+			db.byDevnum[devnum] = device
+		}
+		if name := deviceName(device); name != "" {
+			byName[name] = device
+		}
+		if devpath := device.Properties["DEVPATH"]; devpath != "" {
+			byDevpath[devpath] = device
+		}
+		if uuid := device.Properties["DM_UUID"]; uuid != "" {
+			byDMUUID[uuid] = device
+		}
+	}
+
+	for _, device := range devices {
+		if !devicePartition(device) {
+			continue
+		}
+		if parent := partitionParent(device, byName, byDevpath, byDMUUID); parent != "" {
+			db.partitionsByParent[parent] = append(db.partitionsByParent[parent], device)
+			db.parentByPartition[deviceDevnum(device)] = parent
+		}
+	}
+
+	return db
+}
+
+// devicePartition checks if a device is a partition. Partitions of
+// device-mapper devices (i.e. kpartx partitions of multipath maps) are disks
+// to udev, so are recognized by their DM_UUID.
+func devicePartition(device *DeviceSelectionRule) bool {
+	if device.Properties["DEVTYPE"] == "partition" {
+		return true
+	}
+	return strings.HasPrefix(device.Properties["DM_UUID"], "part")
+}
+
+// partitionParent returns the MAJOR:MINOR of the disk a partition is on. The
+// udev ID_PART_ENTRY_DISK property is used if present. Otherwise the disk is
+// found from the sysfs DEVPATH (partitions are below their disk), the
+// device-mapper UUID (kpartx partitions are named part<n>-<map UUID>), or the
+// kernel name (a partition is named for its disk plus the partition number,
+// with a "p" between if the disk name ends in a digit, i.e. nvme0n1p1).
+func partitionParent(device *DeviceSelectionRule, byName map[string]*DeviceSelectionRule,
+	byDevpath map[string]*DeviceSelectionRule, byDMUUID map[string]*DeviceSelectionRule) string {
+	if parent := device.Properties["ID_PART_ENTRY_DISK"]; parent != "" {
+		return parent
+	}
+
+	if devpath := device.Properties["DEVPATH"]; devpath != "" {
+		if disk, found := byDevpath[path.Dir(devpath)]; found {
+			return deviceDevnum(disk)
+		}
+	}
+
+	if uuid := device.Properties["DM_UUID"]; strings.HasPrefix(uuid, "part") {
+		if idx := strings.Index(uuid, "-"); idx != -1 {
+			if disk, found := byDMUUID[uuid[idx+1:]]; found {
+				return deviceDevnum(disk)
+			}
+		}
+	}
+
+	name := deviceName(device)
+	partn := device.Properties["PARTN"]
+	if name == "" || partn == "" || !strings.HasSuffix(name, partn) {
+		return ""
+	}
+	diskName := strings.TrimSuffix(name, partn)
+	if disk, found := byName[diskName]; found {
+		return deviceDevnum(disk)
+	}
+	// nvme0n1p1, mmcblk0p1
+	if strings.HasSuffix(diskName, "p") {
+		trimmed := strings.TrimSuffix(diskName, "p")
+		if len(trimmed) > 0 && unicode.IsDigit(rune(trimmed[len(trimmed)-1])) {
+			if disk, found := byName[trimmed]; found {
+				return deviceDevnum(disk)
+			}
+		}
+	}
+	return ""
+}
+
+// SnapshotDeviceDatabase takes a snapshot of the current DeviceSource. Which
+// devices the current DiskUsageSource reports are in use is read once, the
+// first time the snapshot needs it.
+//
+// A snapshot is meant to be taken once per scan and passed to everything the
+// scan does, rather than each lookup taking its own.
+func SnapshotDeviceDatabase() (*DeviceDatabase, error) {
+	devices, err := GetDeviceSource().Devices()
+	if err != nil {
+		return nil, err
+	}
+	db := NewDeviceDatabase(devices)
+	db.usage = GetDiskUsageSource()
+	return db, nil
+}
+
+// devicesInUse returns how devices are in use by the system, keyed by
+// MAJOR:MINOR. The usage source is only asked once per snapshot.
+func (this *DeviceDatabase) devicesInUse() (map[string]string, error) {
+	this.inUseOnce.Do(func() {
+		if this.usage == nil {
+			this.inUse = make(map[string]string)
+			return
+		}
+		this.inUse, this.inUseErr = this.usage.InUse()
+	})
+	return this.inUse, this.inUseErr
+}
+
+// Match applies a list of selection rules individually and returns every
+// device matched by any of them, keyed by device node path. Devices without a
+// device node are never matched.
+func (this *DeviceDatabase) Match(selectionRules []DeviceSelectionRule) (map[string]*DeviceSelectionRule, error) {
+	// Deduplicates the device paths we've already seen.
+	devPaths := make(map[string]*DeviceSelectionRule)
+
+	for idx, _ := range selectionRules {
+		for _, device := range this.devices {
+			devnode := deviceDevnode(device)
+			// Devices without a device node can't be used.
+			if devnode == "" {
+				continue
+			}
+			if _, found := devPaths[devnode]; found {
+				continue
+			}
+			matched, err := ruleMatchesDevice(&selectionRules[idx], device)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				devPaths[devnode] = device
+			}
+		}
+	}
+	return devPaths, nil
+}
+
+// DevicePaths returns a sorted list of the device node paths matched by the
+// selection rules.
+func (this *DeviceDatabase) DevicePaths(selectionRules []DeviceSelectionRule) ([]string, error) {
+	devices, err := this.Match(selectionRules)
+	if err != nil {
+		return []string{}, err
+	}
+
+	devNodes := make([]string, 0, len(devices))
+	for devNode, _ := range devices {
+		devNodes = append(devNodes, devNode)
+	}
+	sort.Strings(devNodes)
+	return devNodes, nil
+}
+
+// Device returns the device at the given path. Paths which are symlinks to
+// device nodes (i.e. /dev/disk/by-id or /dev/mapper paths) are resolved.
+func (this *DeviceDatabase) Device(devicePath string) (*DeviceSelectionRule, error) {
+	if device, found := this.byDevnode[devicePath]; found {
+		return device, nil
+	}
+	if resolved, err := filepath.EvalSymlinks(devicePath); err == nil {
+		if device, found := this.byDevnode[resolved]; found {
+			return device, nil
+		}
+	}
+	return nil, errDiskNotFound
+}
+
+// DeviceByDevnum returns the device with the given MAJOR:MINOR number.
+func (this *DeviceDatabase) DeviceByDevnum(devnum string) (*DeviceSelectionRule, error) {
+	device, found := this.byDevnum[devnum]
+	if !found {
+		return nil, errDiskNotFound
+	}
+	return device, nil
+}
+
+// Partitions returns the partitions of the disk at the given path, keyed by
+// device node path.
+func (this *DeviceDatabase) Partitions(diskPath string) (map[string]*DeviceSelectionRule, error) {
+	disk, err := this.Device(diskPath)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make(map[string]*DeviceSelectionRule)
+	for _, partition := range this.partitionsByParent[deviceDevnum(disk)] {
+		if devnode := deviceDevnode(partition); devnode != "" {
+			partitions[devnode] = partition
+		}
+	}
+	return partitions, nil
+}
+
+// ParentDisk returns the disk the partition at the given path is on, keyed by
+// device node path.
+func (this *DeviceDatabase) ParentDisk(partitionPath string) (map[string]*DeviceSelectionRule, error) {
+	partition, err := this.Device(partitionPath)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, found := this.parentByPartition[deviceDevnum(partition)]
+	if !found {
+		return nil, errDiskNotFound
+	}
+	disk, err := this.DeviceByDevnum(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	devnode := deviceDevnode(disk)
+	if devnode == "" {
+		return nil, errDiskNotFound
+	}
+	return map[string]*DeviceSelectionRule{devnode: disk}, nil
+}
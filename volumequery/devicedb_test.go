@@ -0,0 +1,238 @@
+package volumequery
+
+import (
+	"fmt"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type DeviceDatabaseTestSuite struct {
+	db *DeviceDatabase
+}
+
+var _ = Suite(&DeviceDatabaseTestSuite{})
+
+func (this *DeviceDatabaseTestSuite) SetUpTest(c *C) {
+	snapshot, err := LoadSnapshotDeviceSource(testSnapshotPath)
+	c.Assert(err, IsNil)
+	devices, err := snapshot.Devices()
+	c.Assert(err, IsNil)
+	this.db = NewDeviceDatabase(devices)
+}
+
+func (this *DeviceDatabaseTestSuite) TestDevice(c *C) {
+	device, err := this.db.Device("/dev/sdb2")
+	c.Assert(err, IsNil)
+	c.Check(device.Name, DeepEquals, []string{"sdb2"})
+
+	_, err = this.db.Device("/dev/sdz")
+	c.Check(err, Equals, errDiskNotFound)
+}
+
+func (this *DeviceDatabaseTestSuite) TestDeviceByDevnum(c *C) {
+	device, err := this.db.DeviceByDevnum("8:16")
+	c.Assert(err, IsNil)
+	c.Check(deviceDevnode(device), Equals, "/dev/sdb")
+
+	_, err = this.db.DeviceByDevnum("8:255")
+	c.Check(err, Equals, errDiskNotFound)
+}
+
+func (this *DeviceDatabaseTestSuite) TestPartitions(c *C) {
+	partitions, err := this.db.Partitions("/dev/sdd")
+	c.Assert(err, IsNil)
+	c.Check(sortedKeys(partitions), DeepEquals, []string{"/dev/sdd1"})
+}
+
+func (this *DeviceDatabaseTestSuite) TestParentDisk(c *C) {
+	disks, err := this.db.ParentDisk("/dev/sdb1")
+	c.Assert(err, IsNil)
+	c.Check(sortedKeys(disks), DeepEquals, []string{"/dev/sdb"})
+
+	// A disk has no parent disk.
+	_, err = this.db.ParentDisk("/dev/sda")
+	c.Check(err, NotNil)
+}
+
+// jbodDevices fabricates a host with the given number of initialized disks,
+// each with a label and data partition, plus some unrelated devices.
+func jbodDevices(disks int) []*DeviceSelectionRule {
+	devices := []*DeviceSelectionRule{}
+	for idx := 0; idx < disks; idx++ {
+		name := fmt.Sprintf("sd%c%c", 'a'+idx/26, 'a'+idx%26)
+		major := 8 + idx/16
+		minor := (idx % 16) * 16
+		diskDevnum := fmt.Sprintf("%d:%d", major, minor)
+
+		devices = append(devices, &DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{name},
+			Properties: map[string]string{
+				"DEVNAME":            "/dev/" + name,
+				"DEVTYPE":            "disk",
+				"MAJOR":              fmt.Sprintf("%d", major),
+				"MINOR":              fmt.Sprintf("%d", minor),
+				"ID_SERIAL":          fmt.Sprintf("JBOD_DISK_%04d", idx),
+				"ID_PART_TABLE_TYPE": "gpt",
+			},
+			Attrs: map[string]string{"size": "7814037168"},
+		})
+		devices = append(devices, &DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{name + "1"},
+			Properties: map[string]string{
+				"DEVNAME":            "/dev/" + name + "1",
+				"DEVTYPE":            "partition",
+				"MAJOR":              fmt.Sprintf("%d", major),
+				"MINOR":              fmt.Sprintf("%d", minor+1),
+				"ID_PART_ENTRY_DISK": diskDevnum,
+				"ID_PART_ENTRY_NAME": SimpleMetadataLabel,
+				"ID_PART_ENTRY_TYPE": SimpleMetadataUUID,
+			},
+			Attrs: map[string]string{"size": "2048"},
+		})
+		devices = append(devices, &DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{name + "2"},
+			Properties: map[string]string{
+				"DEVNAME":            "/dev/" + name + "2",
+				"DEVTYPE":            "partition",
+				"MAJOR":              fmt.Sprintf("%d", major),
+				"MINOR":              fmt.Sprintf("%d", minor+2),
+				"ID_PART_ENTRY_DISK": diskDevnum,
+				"ID_PART_ENTRY_NAME": "data",
+				"ID_PART_ENTRY_UUID": fmt.Sprintf("6b1e0f3a-4c2d-4e5f-8a9b-%012d", idx),
+			},
+			Attrs: map[string]string{"size": "7814035120"},
+		})
+	}
+	// Non-disk devices a real udev database is mostly made of.
+	for idx := 0; idx < 4*disks; idx++ {
+		devices = append(devices, &DeviceSelectionRule{
+			Subsystems: []string{"pci"},
+			Name:       []string{fmt.Sprintf("0000:00:%02x.%d", idx/8, idx%8)},
+			Properties: map[string]string{"SUBSYSTEM": "pci"},
+		})
+	}
+	return devices
+}
+
+func benchmarkCandidateDisks(b *testing.B, disks int) {
+	defer useTestDevices(NewSnapshotDeviceSource(jbodDevices(disks)))()
+
+	rules := []DeviceSelectionRule{
+		DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{"sd*"},
+			Properties: map[string]string{"DEVTYPE": "disk"},
+		},
+	}
+	ledger := NewClaimLedger()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		initialized, _, _, err := GetCandidateDisks(rules, ledger, Claimant{Volume: "bench"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(initialized) != disks {
+			b.Fatalf("expected %d initialized disks, got %d", disks, len(initialized))
+		}
+	}
+}
+
+func BenchmarkCandidateDisks_10(b *testing.B)  { benchmarkCandidateDisks(b, 10) }
+func BenchmarkCandidateDisks_60(b *testing.B)  { benchmarkCandidateDisks(b, 60) }
+func BenchmarkCandidateDisks_240(b *testing.B) { benchmarkCandidateDisks(b, 240) }
+
+func benchmarkDeviceLookup(b *testing.B, disks int) {
+	db := NewDeviceDatabase(jbodDevices(disks))
+	target := fmt.Sprintf("/dev/sd%c%c2", 'a'+(disks-1)/26, 'a'+(disks-1)%26)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.ParentDisk(target); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDeviceLookup_10(b *testing.B)  { benchmarkDeviceLookup(b, 10) }
+func BenchmarkDeviceLookup_60(b *testing.B)  { benchmarkDeviceLookup(b, 60) }
+func BenchmarkDeviceLookup_240(b *testing.B) { benchmarkDeviceLookup(b, 240) }
+
+// benchmarkCreateGetPath runs the device lookups the docker plugin makes to
+// create a volume and then report its status, each against one snapshot.
+// Reading labels needs real disks, so the matcher only does the lookups
+// MatchInitializedDisk makes before it reads the label.
+func benchmarkCreateGetPath(b *testing.B, disks int) {
+	defer useTestDevices(NewSnapshotDeviceSource(jbodDevices(disks)))()
+
+	rules := []DeviceSelectionRule{
+		DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{"sd*"},
+			Properties: map[string]string{"DEVTYPE": "disk"},
+		},
+	}
+	query := &VolumeQuery{MinDisks: 1, MaxDisks: int32(disks)}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Create
+		db, err := SnapshotDeviceDatabase()
+		if err != nil {
+			b.Fatal(err)
+		}
+		initialized, uninitialized, _, err := db.CandidateDisks(rules, NewClaimLedger(), Claimant{Volume: "bench"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		matcher := func(query *VolumeQuery, diskPath string) (bool, error) {
+			_, dataPath, err := db.DiskLabelAndVolumePath(diskPath)
+			if err != nil {
+				return false, err
+			}
+			_, err = db.Device(dataPath)
+			return err == nil, err
+		}
+		selected, err := db.SelectDisks(query, initialized, uninitialized, matcher)
+		if err != nil {
+			b.Fatal(err)
+		}
+		identities := make([]string, 0, len(selected))
+		for _, diskPath := range selected {
+			identity, err := db.DiskIdentity(diskPath)
+			if err != nil {
+				b.Fatal(err)
+			}
+			identities = append(identities, identity)
+		}
+
+		// Get
+		db, err = SnapshotDeviceDatabase()
+		if err != nil {
+			b.Fatal(err)
+		}
+		found, err := db.FindDisksByIdentity(rules, identities)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(found) != disks {
+			b.Fatalf("expected %d disks, found %d", disks, len(found))
+		}
+		for _, diskPath := range found {
+			if _, err := db.Device(diskPath); err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := db.DiskLabelAndVolumePath(diskPath); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkCreateGetPath_10(b *testing.B)  { benchmarkCreateGetPath(b, 10) }
+func BenchmarkCreateGetPath_60(b *testing.B)  { benchmarkCreateGetPath(b, 60) }
+func BenchmarkCreateGetPath_240(b *testing.B) { benchmarkCreateGetPath(b, 240) }
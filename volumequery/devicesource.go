@@ -0,0 +1,146 @@
+// Implements the pluggable device database which the volume query functions
+// run against. By default this is the live udev database, but it can be
+// replaced with a snapshot so queries can be run (and tested) against
+// fabricated disk layouts.
+
+package volumequery
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// Reads the device database with libudev. Requires cgo.
+	DeviceBackendUdev string = "udev"
+	// Reads the device database directly from sysfs and /run/udev/data.
+	DeviceBackendSysfs string = "sysfs"
+)
+
+var (
+	errUnknownDeviceBackend     = errors.New("unknown device backend")
+	errDeviceBackendUnavailable = errors.New("device backend is not available in this build")
+)
+
+// DeviceSource supplies a snapshot of the device database as selection rules
+// which fully describe each device (as GetFullSelectionRuleForDevice returns).
+type DeviceSource interface {
+	// Devices returns every initialized device. Callers may modify the
+	// returned rules.
+	Devices() ([]*DeviceSelectionRule, error)
+}
+
+var (
+	deviceSourceMtx sync.RWMutex
+	deviceSource    DeviceSource = mustDeviceSourceForBackend(DefaultDeviceBackend)
+)
+
+// DeviceBackends returns the names of the device backends available in this
+// build.
+func DeviceBackends() []string {
+	if _, err := newUdevBackend(); err != nil {
+		return []string{DeviceBackendSysfs}
+	}
+	return []string{DeviceBackendUdev, DeviceBackendSysfs}
+}
+
+// NewDeviceSourceForBackend returns a device source reading the live device
+// database with the named backend.
+func NewDeviceSourceForBackend(backend string) (DeviceSource, error) {
+	switch backend {
+	case DeviceBackendUdev:
+		return newUdevBackend()
+	case DeviceBackendSysfs:
+		return NewSysfsDeviceSource(), nil
+	}
+	return nil, errUnknownDeviceBackend
+}
+
+func mustDeviceSourceForBackend(backend string) DeviceSource {
+	source, err := NewDeviceSourceForBackend(backend)
+	if err != nil {
+		panic(err)
+	}
+	return source
+}
+
+// SetDeviceSource replaces the device source used by all queries.
+func SetDeviceSource(source DeviceSource) {
+	deviceSourceMtx.Lock()
+	defer deviceSourceMtx.Unlock()
+	deviceSource = source
+}
+
+// GetDeviceSource returns the device source used by all queries.
+func GetDeviceSource() DeviceSource {
+	deviceSourceMtx.RLock()
+	defer deviceSourceMtx.RUnlock()
+	return deviceSource
+}
+
+// copySelectionRule returns a deep copy of a selection rule.
+func copySelectionRule(rule *DeviceSelectionRule) *DeviceSelectionRule {
+	newRule := &DeviceSelectionRule{
+		Subsystems: append([]string{}, rule.Subsystems...),
+		Name:       append([]string{}, rule.Name...),
+		Tag:        append([]string{}, rule.Tag...),
+		Properties: make(map[string]string, len(rule.Properties)),
+		Attrs:      make(map[string]string, len(rule.Attrs)),
+	}
+	for k, v := range rule.Properties {
+		newRule.Properties[k] = v
+	}
+	for k, v := range rule.Attrs {
+		newRule.Attrs[k] = v
+	}
+	return newRule
+}
+
+// SnapshotDeviceSource is an in-memory device database.
+type SnapshotDeviceSource struct {
+	devices []*DeviceSelectionRule
+}
+
+// NewSnapshotDeviceSource returns a device source which serves copies of the
+// given devices.
+func NewSnapshotDeviceSource(devices []*DeviceSelectionRule) *SnapshotDeviceSource {
+	snapshot := &SnapshotDeviceSource{
+		devices: make([]*DeviceSelectionRule, 0, len(devices)),
+	}
+	for _, device := range devices {
+		snapshot.devices = append(snapshot.devices, copySelectionRule(device))
+	}
+	return snapshot
+}
+
+// ReadSnapshotDeviceSource reads a JSON list of selection rules, as output by
+// simplectl dump-device-rules, into a device source.
+func ReadSnapshotDeviceSource(rdr io.Reader) (*SnapshotDeviceSource, error) {
+	devices := []*DeviceSelectionRule{}
+	if err := json.NewDecoder(rdr).Decode(&devices); err != nil {
+		return nil, err
+	}
+	return NewSnapshotDeviceSource(devices), nil
+}
+
+// LoadSnapshotDeviceSource reads a JSON snapshot file into a device source.
+func LoadSnapshotDeviceSource(path string) (*SnapshotDeviceSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSnapshotDeviceSource(f)
+}
+
+// Devices implements DeviceSource
+func (this *SnapshotDeviceSource) Devices() ([]*DeviceSelectionRule, error) {
+	devices := make([]*DeviceSelectionRule, 0, len(this.devices))
+	for _, device := range this.devices {
+		devices = append(devices, copySelectionRule(device))
+	}
+	return devices, nil
+}
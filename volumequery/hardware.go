@@ -0,0 +1,213 @@
+// Implements matching volume queries against the hardware attributes of disks:
+// whether they are rotational, how they are attached, and their vendor, model,
+// serial number and WWN.
+
+package volumequery
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Transport is how a disk is attached to the host.
+type Transport string
+
+const (
+	TransportSATA   Transport = "sata"
+	TransportSAS    Transport = "sas"
+	TransportNVMe   Transport = "nvme"
+	TransportUSB    Transport = "usb"
+	TransportVirtio Transport = "virtio"
+	TransportSCSI   Transport = "scsi"
+)
+
+// Valid checks if the transport is one we know how to detect.
+func (this Transport) Valid() bool {
+	switch this {
+	case TransportSATA, TransportSAS, TransportNVMe, TransportUSB, TransportVirtio, TransportSCSI:
+		return true
+	}
+	return false
+}
+
+// VolumelabelMarshal implements volumelabel.Marshaller
+func (this Transport) VolumelabelMarshal() (string, error) {
+	return string(this), nil
+}
+
+// VolumelabelUnmarshal implements volumelabel.Unmarshaller
+func (this *Transport) VolumelabelUnmarshal(value string) error {
+	*this = Transport(value)
+	return nil
+}
+
+const (
+	// Sysattr holding 1 for rotational media and 0 for solid state.
+	SysattrRotational string = "queue/rotational"
+)
+
+// HardwareSysattrs are the sysattrs below the top level of a block device's
+// sysfs directory which device sources collect in addition to the top-level
+// ones.
+var HardwareSysattrs = []string{SysattrRotational}
+
+// DeviceRotational returns whether a disk is rotational media. Returns false
+// if it is not known.
+func DeviceRotational(rule *DeviceSelectionRule) (bool, bool) {
+	switch rule.Attrs[SysattrRotational] {
+	case "1":
+		return true, true
+	case "0":
+		return false, true
+	}
+	return false, false
+}
+
+// DeviceTransport works out how a disk is attached from its udev properties.
+// Returns a blank transport if it is not known.
+func DeviceTransport(rule *DeviceSelectionRule) Transport {
+	name := deviceName(rule)
+	idPath := rule.Properties["ID_PATH"]
+
+	switch {
+	case strings.HasPrefix(name, "nvme") || strings.Contains(idPath, "-nvme-"):
+		return TransportNVMe
+	case strings.HasPrefix(name, "vd") || strings.Contains(idPath, "virtio"):
+		return TransportVirtio
+	case rule.Properties["ID_BUS"] == "usb" || strings.Contains(idPath, "-usb-"):
+		return TransportUSB
+	case strings.Contains(idPath, "-sas-"):
+		return TransportSAS
+	case rule.Properties["ID_BUS"] == "ata" || strings.Contains(idPath, "-ata-"):
+		return TransportSATA
+	case rule.Properties["ID_BUS"] == "scsi":
+		return TransportSCSI
+	}
+	return ""
+}
+
+// DeviceSerial returns the serial number of a disk as reported by the disk
+// itself (not the udev ID_SERIAL, which is prefixed with the model).
+func DeviceSerial(rule *DeviceSelectionRule) string {
+	if serial := rule.Properties["ID_SERIAL_SHORT"]; serial != "" {
+		return serial
+	}
+	return rule.Properties["ID_SERIAL"]
+}
+
+// hardwareGlobs returns the glob patterns of a query keyed by query field.
+func (this *VolumeQuery) hardwareGlobs() map[string]string {
+	return map[string]string{
+		"vendor": this.Vendor,
+		"model":  this.Model,
+	}
+}
+
+// explainHardware evaluates the hardware constraints of a query against a
+// disk.
+func (this *MatchReport) explainHardware(query *VolumeQuery, rule *DeviceSelectionRule) {
+	if query.Rotational != nil {
+		expected := "solid state"
+		if *query.Rotational {
+			expected = "rotational"
+		}
+		rotational, found := DeviceRotational(rule)
+		actual := "unknown"
+		if found && rotational {
+			actual = "rotational"
+		} else if found {
+			actual = "solid state"
+		}
+		this.add("rotational", expected, actual, found && rotational == *query.Rotational)
+	}
+
+	if query.Transport != "" {
+		transport := DeviceTransport(rule)
+		actual := string(transport)
+		if transport == "" {
+			actual = "unknown"
+		}
+		this.add("transport", string(query.Transport), actual, transport == query.Transport)
+	}
+
+	if query.Vendor != "" {
+		vendor := rule.Properties["ID_VENDOR"]
+		// Bad patterns are rejected by Validate.
+		matched, _ := filepath.Match(query.Vendor, vendor)
+		this.add("vendor", query.Vendor, vendor, matched)
+	}
+
+	if query.Model != "" {
+		model := rule.Properties["ID_MODEL"]
+		matched, _ := filepath.Match(query.Model, model)
+		this.add("model", query.Model, model, matched)
+	}
+
+	if query.Serial != "" {
+		// Accept either form of the serial udev reports.
+		serial := DeviceSerial(rule)
+		matched := serial == query.Serial || rule.Properties["ID_SERIAL"] == query.Serial
+		this.add("serial", query.Serial, serial, matched)
+	}
+
+	if query.WWN != "" {
+		wwn := rule.Properties["ID_WWN_WITH_EXTENSION"]
+		if wwn == "" {
+			wwn = rule.Properties["ID_WWN"]
+		}
+		this.add("wwn", query.WWN, wwn, wwn != "" && strings.EqualFold(wwn, query.WWN))
+	}
+}
+
+// hasHardwareConstraints is true if the query constrains disk hardware.
+func (this *VolumeQuery) hasHardwareConstraints() bool {
+	return this.Rotational != nil || this.Transport != "" || this.Vendor != "" ||
+		this.Model != "" || this.Serial != "" || this.WWN != ""
+}
+
+// HardwareMatch checks if a disk satisfies the hardware constraints of a query.
+func HardwareMatch(query *VolumeQuery, rule *DeviceSelectionRule) bool {
+	report := &MatchReport{}
+	report.explainHardware(query, rule)
+	return report.Matched()
+}
+
+// validateHardware checks the hardware constraints of a query.
+func (this *VolumeQuery) validateHardware() error {
+	if this.Transport != "" && !this.Transport.Valid() {
+		return errQueryBadTransport
+	}
+	for key, pattern := range this.hardwareGlobs() {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errwrap.Wrap(errQueryBadHardwareGlob, fmt.Errorf("%s: %v", key, err))
+		}
+	}
+	return nil
+}
+
+// MatchBlankDisk checks if a blank disk satisfies the size and hardware
+// constraints of a query, which are all that can be checked before it is
+// initialized.
+func MatchBlankDisk(query *VolumeQuery, diskPath string) (bool, error) {
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return false, err
+	}
+	return db.MatchBlankDisk(query, diskPath)
+}
+
+// MatchBlankDisk implements MatchBlankDisk against the snapshot.
+func (this *DeviceDatabase) MatchBlankDisk(query *VolumeQuery, diskPath string) (bool, error) {
+	rule, err := this.Device(diskPath)
+	if err != nil {
+		return false, err
+	}
+	size, _ := DeviceSizeBytes(rule)
+	if !sizeFits(query, SelectionCandidate{SizeBytes: size}) {
+		return false, nil
+	}
+	return HardwareMatch(query, rule), nil
+}
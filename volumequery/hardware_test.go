@@ -0,0 +1,119 @@
+package volumequery
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type HardwareTestSuite struct{}
+
+var _ = Suite(&HardwareTestSuite{})
+
+func hardwareRule(name string, properties map[string]string, attrs map[string]string) *DeviceSelectionRule {
+	return &DeviceSelectionRule{
+		Subsystems: []string{"block"},
+		Name:       []string{name},
+		Properties: properties,
+		Attrs:      attrs,
+	}
+}
+
+func (this *HardwareTestSuite) TestDeviceTransport(c *C) {
+	c.Check(DeviceTransport(hardwareRule("nvme0n1", map[string]string{}, nil)), Equals, TransportNVMe)
+	c.Check(DeviceTransport(hardwareRule("vda", map[string]string{}, nil)), Equals, TransportVirtio)
+	c.Check(DeviceTransport(hardwareRule("sda", map[string]string{
+		"ID_BUS":  "usb",
+		"ID_PATH": "pci-0000:00:14.0-usb-0:1:1.0-scsi-0:0:0:0",
+	}, nil)), Equals, TransportUSB)
+	c.Check(DeviceTransport(hardwareRule("sdb", map[string]string{
+		"ID_BUS":  "scsi",
+		"ID_PATH": "pci-0000:03:00.0-sas-phy2-lun-0",
+	}, nil)), Equals, TransportSAS)
+	c.Check(DeviceTransport(hardwareRule("sdc", map[string]string{
+		"ID_BUS":  "ata",
+		"ID_PATH": "pci-0000:00:1f.2-ata-1",
+	}, nil)), Equals, TransportSATA)
+	c.Check(DeviceTransport(hardwareRule("sdd", map[string]string{"ID_BUS": "scsi"}, nil)), Equals, TransportSCSI)
+	c.Check(DeviceTransport(hardwareRule("sde", map[string]string{}, nil)), Equals, Transport(""))
+}
+
+func (this *HardwareTestSuite) TestHardwareMatch(c *C) {
+	ssd := hardwareRule("sda", map[string]string{
+		"ID_BUS":          "ata",
+		"ID_VENDOR":       "ATA",
+		"ID_MODEL":        "Samsung_SSD_860_EVO_1TB",
+		"ID_SERIAL":       "Samsung_SSD_860_EVO_1TB_S3Z9NB0K123456",
+		"ID_SERIAL_SHORT": "S3Z9NB0K123456",
+		"ID_WWN":          "0x5002538e40000001",
+	}, map[string]string{SysattrRotational: "0"})
+
+	rotational := true
+	solidState := false
+
+	c.Check(HardwareMatch(&VolumeQuery{}, ssd), Equals, true)
+	c.Check(HardwareMatch(&VolumeQuery{Rotational: &solidState}, ssd), Equals, true)
+	c.Check(HardwareMatch(&VolumeQuery{Rotational: &rotational}, ssd), Equals, false)
+	c.Check(HardwareMatch(&VolumeQuery{Transport: TransportSATA}, ssd), Equals, true)
+	c.Check(HardwareMatch(&VolumeQuery{Transport: TransportNVMe}, ssd), Equals, false)
+	c.Check(HardwareMatch(&VolumeQuery{Model: "Samsung_SSD_*"}, ssd), Equals, true)
+	c.Check(HardwareMatch(&VolumeQuery{Model: "WDC_*"}, ssd), Equals, false)
+	c.Check(HardwareMatch(&VolumeQuery{Vendor: "ATA"}, ssd), Equals, true)
+	c.Check(HardwareMatch(&VolumeQuery{Serial: "S3Z9NB0K123456"}, ssd), Equals, true)
+	c.Check(HardwareMatch(&VolumeQuery{Serial: "Samsung_SSD_860_EVO_1TB_S3Z9NB0K123456"}, ssd), Equals, true)
+	c.Check(HardwareMatch(&VolumeQuery{Serial: "S3Z9NB0K000000"}, ssd), Equals, false)
+	c.Check(HardwareMatch(&VolumeQuery{WWN: "0x5002538E40000001"}, ssd), Equals, true)
+
+	// Unknown attributes never satisfy a constraint.
+	unknown := hardwareRule("sdz", map[string]string{}, map[string]string{})
+	c.Check(HardwareMatch(&VolumeQuery{Rotational: &solidState}, unknown), Equals, false)
+	c.Check(HardwareMatch(&VolumeQuery{WWN: ""}, unknown), Equals, true)
+	c.Check(HardwareMatch(&VolumeQuery{Transport: TransportSATA}, unknown), Equals, false)
+}
+
+func (this *HardwareTestSuite) TestExplainHardware(c *C) {
+	rotational := true
+	hdd := hardwareRule("sda", map[string]string{"ID_MODEL": "WDC_WD40EFRX"}, map[string]string{SysattrRotational: "1"})
+
+	report := &MatchReport{}
+	report.explainHardware(&VolumeQuery{Rotational: &rotational, Model: "ST*"}, hdd)
+	c.Check(report.Constraints, DeepEquals, []ConstraintResult{
+		ConstraintResult{Constraint: "rotational", Expected: "rotational", Actual: "rotational", Passed: true},
+		ConstraintResult{Constraint: "model", Expected: "ST*", Actual: "WDC_WD40EFRX", Passed: false},
+	})
+}
+
+func (this *HardwareTestSuite) TestParseVolumeQuery_HardwareFields(c *C) {
+	query, err := ParseVolumeQuery("label.fast_rotational.false_transport.nvme",
+		map[string]string{"model": "Samsung SSD 9*"})
+	c.Assert(err, IsNil)
+	c.Assert(query.Rotational, NotNil)
+	c.Check(*query.Rotational, Equals, false)
+	c.Check(query.Transport, Equals, TransportNVMe)
+	c.Check(query.Model, Equals, "Samsung SSD 9*")
+	c.Check(query.Validate(), IsNil)
+
+	query, err = ParseVolumeQuery("label.fast_transport.floppy", nil)
+	c.Assert(err, IsNil)
+	c.Check(query.Validate(), Equals, errQueryBadTransport)
+
+	query, err = ParseVolumeQuery("label.fast", map[string]string{"vendor": "[ATA"})
+	c.Assert(err, IsNil)
+	c.Check(query.Validate(), NotNil)
+}
+
+func (this *HardwareTestSuite) TestSelectDisks_FiltersBlankDisksByHardware(c *C) {
+	defer useTestSnapshot(c)()
+
+	query := NewVolumeQuery()
+	query.Label = "test"
+	query.MinDisks = 1
+	query.WWN = "0x5000000000000a"
+
+	noMatch := func(*VolumeQuery, string) (bool, error) { return false, nil }
+	selected, err := SelectDisks(&query, nil, []string{"/dev/sda", "/dev/sdf"}, noMatch)
+	c.Assert(err, IsNil)
+	c.Check(selected, DeepEquals, []string{"/dev/sda"})
+
+	isMatch, err := MatchBlankDisk(&query, "/dev/sdf")
+	c.Assert(err, IsNil)
+	c.Check(isMatch, Equals, false)
+}
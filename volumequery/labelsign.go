@@ -0,0 +1,240 @@
+// Implements signing volume labels with a per-host or per-cluster key. The
+// hostname and machine-id in a label are only plain JSON, so anyone can craft a
+// disk which claims to belong to a host. A signed label can only have been
+// written by a host holding the key, and queries with require-signature only
+// match disks with a valid signature. Signatures are bound to the partition
+// GUID of the data partition, so a label copied to another disk as it is
+// doesn't verify. The GUID can be rewritten (i.e. with sgdisk -u) though, so
+// this doesn't stop someone with write access to both disks.
+
+package volumequery
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+const (
+	// Prefix of HMAC-SHA256 label signatures
+	LabelSignaturePrefix string = "hmac-sha256:"
+	// Shortest signing key accepted
+	LabelSigningKeyMinLength int = 16
+)
+
+var (
+	errLabelSigningKeyTooShort = errors.New("label signing key is too short")
+	errNoLabelSigningKey       = errors.New("no label signing key is configured")
+	errLabelUnsigned           = errors.New("volume label is not signed")
+	errLabelSignatureInvalid   = errors.New("volume label signature is not valid")
+	errNoSignatureBinding      = errors.New("data partition has no partition GUID to bind the label signature to")
+)
+
+var (
+	labelSigningMtx sync.RWMutex
+	// Key labels are signed and verified with. Labels are not signed if nil.
+	labelSigningKey []byte
+	// Whether every query requires a valid label signature
+	labelSignatureRequired bool
+)
+
+// SetLabelSigningKey sets the key volume labels are signed and verified with.
+// A nil key disables signing.
+func SetLabelSigningKey(key []byte) error {
+	if key != nil && len(key) < LabelSigningKeyMinLength {
+		return errLabelSigningKeyTooShort
+	}
+	labelSigningMtx.Lock()
+	defer labelSigningMtx.Unlock()
+	labelSigningKey = key
+	return nil
+}
+
+// GetLabelSigningKey returns the key volume labels are signed and verified
+// with, or nil if signing is disabled.
+func GetLabelSigningKey() []byte {
+	labelSigningMtx.RLock()
+	defer labelSigningMtx.RUnlock()
+	return labelSigningKey
+}
+
+// LoadLabelSigningKey reads a signing key from a file. Surrounding whitespace
+// (i.e. a trailing newline) is not part of the key.
+func LoadLabelSigningKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < LabelSigningKeyMinLength {
+		return nil, errLabelSigningKeyTooShort
+	}
+	return key, nil
+}
+
+// SetLabelSignatureRequired sets whether every query requires a valid label
+// signature, as though it specified require-signature.
+func SetLabelSignatureRequired(required bool) {
+	labelSigningMtx.Lock()
+	defer labelSigningMtx.Unlock()
+	labelSignatureRequired = required
+}
+
+// GetLabelSignatureRequired returns whether every query requires a valid label
+// signature.
+func GetLabelSignatureRequired() bool {
+	labelSigningMtx.RLock()
+	defer labelSigningMtx.RUnlock()
+	return labelSignatureRequired
+}
+
+// DataPartitionBinding returns the value label signatures on a disk are bound
+// to: the GPT partition GUID of its data partition. A signed label copied
+// onto another disk doesn't verify unless the GUID is copied too.
+func DataPartitionBinding(dataPartition *DeviceSelectionRule) (string, error) {
+	partUUID := strings.ToLower(dataPartition.Properties["ID_PART_ENTRY_UUID"])
+	if partUUID == "" {
+		return "", errNoSignatureBinding
+	}
+	return partUUID, nil
+}
+
+// LabelSignatureBinding returns the value the signature of the label at the
+// given label partition is bound to.
+func LabelSignatureBinding(labelPath string) (string, error) {
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return "", err
+	}
+	return db.LabelSignatureBinding(labelPath)
+}
+
+// LabelSignatureBinding implements LabelSignatureBinding against the snapshot.
+func (this *DeviceDatabase) LabelSignatureBinding(labelPath string) (string, error) {
+	disks, err := this.ParentDisk(labelPath)
+	if err != nil {
+		return "", err
+	}
+	for diskPath, _ := range disks {
+		isInitialized, _, diskLabelPath, dataPath, err := this.classifyDisk(diskPath)
+		if err != nil {
+			return "", err
+		}
+		if !isInitialized || diskLabelPath != labelPath {
+			continue
+		}
+		dataPartition, err := this.Device(dataPath)
+		if err != nil {
+			return "", err
+		}
+		return DataPartitionBinding(dataPartition)
+	}
+	return "", errNoSignatureBinding
+}
+
+// labelSignature computes the signature of the canonical unsigned form of a
+// label (see canonicalLabelPayload), bound to the disk it is written on.
+func labelSignature(unsignedPayload []byte, key []byte, binding string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(binding))
+	mac.Write([]byte{0})
+	mac.Write(unsignedPayload)
+	return LabelSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// canonicalLabelPayload splits the JSON form of a label into the canonical
+// encoding of every field but the signature, and the signature. Fields are
+// decoded generically and encoded again with sorted keys, so what is signed
+// doesn't depend on the field order or formatting of the stored JSON, and
+// fields the current schema doesn't know about (or would migrate) are still
+// covered.
+func canonicalLabelPayload(payload []byte) ([]byte, string, error) {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, "", err
+	}
+	signature := ""
+	if value, ok := fields["signature"]; ok {
+		signature, ok = value.(string)
+		if !ok {
+			return nil, "", errLabelSignatureInvalid
+		}
+		delete(fields, "signature")
+	}
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return nil, "", err
+	}
+	return canonical, signature, nil
+}
+
+// SignVolumeLabel signs a label with the given key, bound to the given value
+// (see DataPartitionBinding). The signature covers the canonical form of every
+// other field.
+func SignVolumeLabel(label *VolumeLabel, key []byte, binding string) error {
+	label.Signature = ""
+	payload, err := json.Marshal(label)
+	if err != nil {
+		return err
+	}
+	unsignedPayload, _, err := canonicalLabelPayload(payload)
+	if err != nil {
+		return err
+	}
+	label.Signature = labelSignature(unsignedPayload, key, binding)
+	return nil
+}
+
+// VerifyLabelPayload checks the signature of a label in its stored JSON form
+// with the given key and binding. The stored form is verified, not a decoded
+// label, so signatures survive labels being migrated when they are read.
+func VerifyLabelPayload(payload []byte, key []byte, binding string) error {
+	unsignedPayload, signature, err := canonicalLabelPayload(payload)
+	if err != nil {
+		return err
+	}
+	if signature == "" {
+		return errLabelUnsigned
+	}
+	if !strings.HasPrefix(signature, LabelSignaturePrefix) {
+		return errLabelSignatureInvalid
+	}
+	expected := labelSignature(unsignedPayload, key, binding)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errLabelSignatureInvalid
+	}
+	return nil
+}
+
+// explainSignature evaluates whether the stored label of a disk has a valid
+// signature, if the query or the driver requires one. Returns false if the
+// signature is required and doesn't verify.
+func (this *MatchReport) explainSignature(query *VolumeQuery, payload []byte, dataPartition *DeviceSelectionRule) bool {
+	if !query.RequireSignature && !GetLabelSignatureRequired() {
+		return true
+	}
+	key := GetLabelSigningKey()
+	if key == nil {
+		this.add("require-signature", "valid", errNoLabelSigningKey.Error(), false)
+		return false
+	}
+	binding, err := DataPartitionBinding(dataPartition)
+	if err != nil {
+		this.add("require-signature", "valid", err.Error(), false)
+		return false
+	}
+	if err := VerifyLabelPayload(payload, key, binding); err != nil {
+		this.add("require-signature", "valid", err.Error(), false)
+		return false
+	}
+	this.add("require-signature", "valid", "valid", true)
+	return true
+}
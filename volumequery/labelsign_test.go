@@ -0,0 +1,203 @@
+package volumequery
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type LabelSignTestSuite struct{}
+
+var _ = Suite(&LabelSignTestSuite{})
+
+var testSigningKey = []byte("0123456789abcdef0123456789abcdef")
+
+func (this *LabelSignTestSuite) TearDownTest(c *C) {
+	SetLabelSigningKey(nil)
+	SetLabelSignatureRequired(false)
+}
+
+const testSigningBinding = "6b1e0f3a-4c2d-4e5f-8a9b-000000000000"
+
+// signedTestPayload returns the stored JSON form of a signed label.
+func signedTestPayload(c *C) []byte {
+	label := VolumeLabel{
+		Version:   VolumeLabelVersion,
+		Hostname:  "host",
+		MachineId: "abcd",
+		Label:     "data",
+		Metadata:  map[string]string{},
+	}
+	c.Assert(SignVolumeLabel(&label, testSigningKey, testSigningBinding), IsNil)
+	c.Check(strings.HasPrefix(label.Signature, LabelSignaturePrefix), Equals, true)
+	payload, err := SerializeVolumeLabel(&label)
+	c.Assert(err, IsNil)
+	return payload
+}
+
+func (this *LabelSignTestSuite) TestSignAndVerify(c *C) {
+	payload := signedTestPayload(c)
+	c.Check(VerifyLabelPayload(payload, testSigningKey, testSigningBinding), IsNil)
+
+	// Copied onto another disk
+	c.Check(VerifyLabelPayload(payload, testSigningKey, "0f1e2d3c-0000-4000-8000-000000000000"), Equals, errLabelSignatureInvalid)
+
+	c.Check(VerifyLabelPayload(payload, []byte("another key, not the signing one"), testSigningBinding), Equals, errLabelSignatureInvalid)
+
+	// A spoofed hostname breaks the signature
+	spoofed := bytes.Replace(payload, []byte(`"hostname":"host"`), []byte(`"hostname":"evil"`), 1)
+	c.Check(VerifyLabelPayload(spoofed, testSigningKey, testSigningBinding), Equals, errLabelSignatureInvalid)
+
+	// So does anything after the signature
+	trailing := append(bytes.TrimSuffix(payload, []byte("}")), []byte(`,"hostname":"evil"}`)...)
+	c.Check(VerifyLabelPayload(trailing, testSigningKey, testSigningBinding), Equals, errLabelSignatureInvalid)
+	added := append(bytes.TrimSuffix(payload, []byte("}")), []byte(`,"extra":"x"}`)...)
+	c.Check(VerifyLabelPayload(added, testSigningKey, testSigningBinding), Equals, errLabelSignatureInvalid)
+
+	label, _, err := DecodeVolumeLabel(payload)
+	c.Assert(err, IsNil)
+	label.Signature = ""
+	unsigned, err := SerializeVolumeLabel(&label)
+	c.Assert(err, IsNil)
+	c.Check(VerifyLabelPayload(unsigned, testSigningKey, testSigningBinding), Equals, errLabelUnsigned)
+}
+
+func (this *LabelSignTestSuite) TestVerifiesStoredPayload(c *C) {
+	// A label stored with fields the current schema would drop or rewrite
+	// (as a migration might) still verifies, since the stored form is what
+	// is checked.
+	unsigned, _, err := canonicalLabelPayload([]byte(`{"version":1,"label":"data","retired_field":"x"}`))
+	c.Assert(err, IsNil)
+	signature := labelSignature(unsigned, testSigningKey, testSigningBinding)
+	payload := []byte(`{"version":1,"label":"data","retired_field":"x","signature":"` + signature + `"}`)
+	c.Check(VerifyLabelPayload(payload, testSigningKey, testSigningBinding), IsNil)
+
+	label, _, err := DecodeVolumeLabel(payload)
+	c.Assert(err, IsNil)
+	c.Check(label.Signature, Equals, signature)
+
+	// The signature doesn't have to be last, and the order and formatting of
+	// the fields doesn't matter.
+	reordered := []byte(`{ "signature": "` + signature + `", "retired_field": "x", "label": "data", "version": 1 }`)
+	c.Check(VerifyLabelPayload(reordered, testSigningKey, testSigningBinding), IsNil)
+}
+
+func (this *LabelSignTestSuite) TestSignatureSurvivesRemarshal(c *C) {
+	payload := signedTestPayload(c)
+	var fields map[string]interface{}
+	c.Assert(json.Unmarshal(payload, &fields), IsNil)
+	remarshaled, err := json.MarshalIndent(fields, "", "  ")
+	c.Assert(err, IsNil)
+	c.Check(VerifyLabelPayload(remarshaled, testSigningKey, testSigningBinding), IsNil)
+
+	_, _, err = canonicalLabelPayload([]byte(`{"label":"data","signature":1}`))
+	c.Check(err, Equals, errLabelSignatureInvalid)
+}
+
+func (this *LabelSignTestSuite) TestSetLabelSigningKey(c *C) {
+	c.Check(SetLabelSigningKey([]byte("short")), Equals, errLabelSigningKeyTooShort)
+	c.Check(GetLabelSigningKey(), IsNil)
+
+	c.Assert(SetLabelSigningKey(testSigningKey), IsNil)
+	c.Check(GetLabelSigningKey(), DeepEquals, testSigningKey)
+
+	c.Assert(SetLabelSigningKey(nil), IsNil)
+	c.Check(GetLabelSigningKey(), IsNil)
+}
+
+func (this *LabelSignTestSuite) TestLabelSignatureBinding(c *C) {
+	db := NewDeviceDatabase(jbodDevices(2))
+	binding, err := db.LabelSignatureBinding("/dev/sdab1")
+	c.Assert(err, IsNil)
+	c.Check(binding, Equals, "6b1e0f3a-4c2d-4e5f-8a9b-000000000001")
+
+	// The data partition isn't a label partition
+	_, err = db.LabelSignatureBinding("/dev/sdab2")
+	c.Check(err, Equals, errNoSignatureBinding)
+
+	_, err = DataPartitionBinding(&DeviceSelectionRule{Properties: map[string]string{}})
+	c.Check(err, Equals, errNoSignatureBinding)
+}
+
+func (this *LabelSignTestSuite) TestLoadLabelSigningKey(c *C) {
+	path := filepath.Join(c.MkDir(), "key")
+	c.Assert(ioutil.WriteFile(path, append(testSigningKey, '\n'), os.FileMode(0600)), IsNil)
+	key, err := LoadLabelSigningKey(path)
+	c.Assert(err, IsNil)
+	c.Check(key, DeepEquals, testSigningKey)
+
+	c.Assert(ioutil.WriteFile(path, []byte("short\n"), os.FileMode(0600)), IsNil)
+	_, err = LoadLabelSigningKey(path)
+	c.Check(err, Equals, errLabelSigningKeyTooShort)
+}
+
+func (this *LabelSignTestSuite) TestExplainSignature(c *C) {
+	payload := signedTestPayload(c)
+	spoofed := bytes.Replace(payload, []byte(`"hostname":"host"`), []byte(`"hostname":"evil"`), 1)
+	dataPartition := &DeviceSelectionRule{Properties: map[string]string{
+		"ID_PART_ENTRY_UUID": strings.ToUpper(testSigningBinding),
+	}}
+
+	// Not required
+	report := &MatchReport{}
+	c.Check(report.explainSignature(&VolumeQuery{}, spoofed, dataPartition), Equals, true)
+	c.Check(report.Constraints, HasLen, 0)
+
+	// Required without a key never matches
+	report = &MatchReport{}
+	c.Check(report.explainSignature(&VolumeQuery{RequireSignature: true}, payload, dataPartition), Equals, false)
+	c.Check(report.Matched(), Equals, false)
+
+	c.Assert(SetLabelSigningKey(testSigningKey), IsNil)
+	report = &MatchReport{}
+	c.Check(report.explainSignature(&VolumeQuery{RequireSignature: true}, payload, dataPartition), Equals, true)
+	c.Check(report.Constraints, DeepEquals, []ConstraintResult{
+		ConstraintResult{Constraint: "require-signature", Expected: "valid", Actual: "valid", Passed: true},
+	})
+
+	report = &MatchReport{}
+	c.Check(report.explainSignature(&VolumeQuery{RequireSignature: true}, spoofed, dataPartition), Equals, false)
+	c.Check(report.Matched(), Equals, false)
+
+	// The label copied onto another disk
+	report = &MatchReport{}
+	otherPartition := &DeviceSelectionRule{Properties: map[string]string{
+		"ID_PART_ENTRY_UUID": "0f1e2d3c-0000-4000-8000-000000000000",
+	}}
+	c.Check(report.explainSignature(&VolumeQuery{RequireSignature: true}, payload, otherPartition), Equals, false)
+
+	// Required by the driver
+	SetLabelSignatureRequired(true)
+	report = &MatchReport{}
+	c.Check(report.explainSignature(&VolumeQuery{}, spoofed, dataPartition), Equals, false)
+}
+
+func (this *LabelSignTestSuite) TestParseVolumeQuery_RequireSignature(c *C) {
+	query, err := ParseVolumeQuery("label.data_require-signature.true", nil)
+	c.Assert(err, IsNil)
+	c.Check(query.RequireSignature, Equals, true)
+}
+
+func (this *LabelSignTestSuite) TestExplainVolumeQueryMatch_StopsAtSignature(c *C) {
+	defer useTestDevices(NewSnapshotDeviceSource(jbodDevices(1)))()
+
+	partition := newLabelPartition()
+	partition.write(c, "data")
+	labelPath := filepath.Join(c.MkDir(), "label")
+	c.Assert(ioutil.WriteFile(labelPath, partition, os.FileMode(0600)), IsNil)
+
+	// The passphrase is never tried against a disk whose label doesn't
+	// verify.
+	c.Assert(SetLabelSigningKey(testSigningKey), IsNil)
+	query := &VolumeQuery{Label: "data", RequireSignature: true, EncryptionKey: "passphrase"}
+	report, err := ExplainVolumeQueryMatch(query, labelPath, "/dev/sdaa2")
+	c.Assert(err, IsNil)
+	c.Check(report.Constraints, DeepEquals, []ConstraintResult{
+		ConstraintResult{Constraint: "require-signature", Expected: "valid", Actual: errLabelUnsigned.Error(), Passed: false},
+	})
+}
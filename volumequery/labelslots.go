@@ -0,0 +1,162 @@
+// Implements the on-disk layout of the label partition. The partition holds
+// LabelSlotCount fixed size slots, each holding a complete copy of the volume
+// label behind a header:
+//
+//	magic		8 bytes, LabelSlotMagic
+//	generation	8 bytes, little-endian, incremented on every write
+//	length		4 bytes, little-endian, length of the label JSON
+//	checksum	4 bytes, little-endian, CRC32C of the generation,
+//			length and label JSON
+//
+// Writes alternate between slots, so a torn write only ever damages the slot
+// being written and the previous label survives in the other. Reads use the
+// valid slot with the highest generation. Disks initialized before slots
+// existed hold a single null terminated JSON label at the start of the
+// partition, which is read if no slot is valid.
+
+package volumequery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"github.com/hashicorp/errwrap"
+)
+
+const (
+	// Identifies a label slot
+	LabelSlotMagic string = "SIMPLELB"
+	// Size of each label slot in bytes
+	LabelSlotSize int = 256 * 1024
+	// Number of label slots in the label partition
+	LabelSlotCount int = 2
+
+	labelSlotHeaderSize int = 24
+	// Largest label JSON which fits in a slot
+	LabelSlotMaxPayload int = LabelSlotSize - labelSlotHeaderSize
+)
+
+var (
+	errLabelTooLarge = errors.New("volume label is too large for a label slot")
+	errNoValidLabel  = errors.New("label partition holds no valid label slot or legacy label")
+)
+
+var labelSlotCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// LabelSlot is the state of one label slot.
+type LabelSlot struct {
+	// Index of the slot in the label partition
+	Index int
+	// Whether the slot holds a label which passed its checksum
+	Valid      bool
+	Generation uint64
+	// Label JSON
+	Payload []byte
+}
+
+// labelSlotChecksum computes the checksum of a slot.
+func labelSlotChecksum(generation uint64, payload []byte) uint32 {
+	fields := make([]byte, 12)
+	binary.LittleEndian.PutUint64(fields[0:8], generation)
+	binary.LittleEndian.PutUint32(fields[8:12], uint32(len(payload)))
+	checksum := crc32.Update(0, labelSlotCRCTable, fields)
+	return crc32.Update(checksum, labelSlotCRCTable, payload)
+}
+
+// EncodeLabelSlot encodes label JSON as a slot with the given generation. The
+// result is the header and payload, not padded to LabelSlotSize.
+func EncodeLabelSlot(generation uint64, payload []byte) ([]byte, error) {
+	if len(payload) > LabelSlotMaxPayload {
+		return nil, errLabelTooLarge
+	}
+	slot := make([]byte, labelSlotHeaderSize, labelSlotHeaderSize+len(payload))
+	copy(slot[0:8], LabelSlotMagic)
+	binary.LittleEndian.PutUint64(slot[8:16], generation)
+	binary.LittleEndian.PutUint32(slot[16:20], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(slot[20:24], labelSlotChecksum(generation, payload))
+	return append(slot, payload...), nil
+}
+
+// DecodeLabelSlot decodes a raw slot. Returns false if the slot is empty, torn
+// or corrupt.
+func DecodeLabelSlot(raw []byte) (uint64, []byte, bool) {
+	if len(raw) < labelSlotHeaderSize || !bytes.Equal(raw[0:8], []byte(LabelSlotMagic)) {
+		return 0, nil, false
+	}
+	generation := binary.LittleEndian.Uint64(raw[8:16])
+	length := int(binary.LittleEndian.Uint32(raw[16:20]))
+	if length > LabelSlotMaxPayload || labelSlotHeaderSize+length > len(raw) {
+		return 0, nil, false
+	}
+	payload := raw[labelSlotHeaderSize : labelSlotHeaderSize+length]
+	if binary.LittleEndian.Uint32(raw[20:24]) != labelSlotChecksum(generation, payload) {
+		return 0, nil, false
+	}
+	return generation, payload, true
+}
+
+// LabelSlotOffset returns the offset of a slot in the label partition.
+func LabelSlotOffset(index int) int64 {
+	return int64(index) * int64(LabelSlotSize)
+}
+
+// ReadLabelSlots reads every slot of a label partition. Slots which can't be
+// read (i.e. past the end of a short file) are invalid.
+func ReadLabelSlots(r io.ReaderAt) []LabelSlot {
+	slots := make([]LabelSlot, 0, LabelSlotCount)
+	for idx := 0; idx < LabelSlotCount; idx++ {
+		slot := LabelSlot{Index: idx}
+		raw := make([]byte, LabelSlotSize)
+		n, _ := r.ReadAt(raw, LabelSlotOffset(idx))
+		slot.Generation, slot.Payload, slot.Valid = DecodeLabelSlot(raw[:n])
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+// NewestLabelSlot returns the valid slot with the highest generation. Returns
+// false if no slot is valid.
+func NewestLabelSlot(slots []LabelSlot) (LabelSlot, bool) {
+	newest := LabelSlot{}
+	found := false
+	for _, slot := range slots {
+		if slot.Valid && (!found || slot.Generation > newest.Generation) {
+			newest = slot
+			found = true
+		}
+	}
+	return newest, found
+}
+
+// NextLabelSlot returns the index and generation the next label write should
+// use: the slot after the newest valid one, so the newest label is never
+// overwritten. Partitions without a valid slot are written to slot 1 first,
+// which leaves a legacy label at the start of the partition intact until the
+// first slotted label has been written.
+func NextLabelSlot(slots []LabelSlot) (int, uint64) {
+	newest, found := NewestLabelSlot(slots)
+	if !found {
+		return 1 % LabelSlotCount, 1
+	}
+	return (newest.Index + 1) % LabelSlotCount, newest.Generation + 1
+}
+
+// ReadLabelPayload reads the label JSON from a label partition: from the
+// newest valid slot, or the legacy null terminated label if no slot is valid.
+func ReadLabelPayload(r io.ReaderAt) ([]byte, error) {
+	if newest, found := NewestLabelSlot(ReadLabelSlots(r)); found {
+		return newest.Payload, nil
+	}
+
+	rawData, err := readRawVolumeLabel(io.NewSectionReader(r, 0, int64(LabelSlotSize)))
+	if err != nil {
+		return nil, errwrap.Wrap(errNoValidLabel, err)
+	}
+	if len(bytes.TrimSpace(rawData)) == 0 || bytes.TrimSpace(rawData)[0] != '{' {
+		return nil, errNoValidLabel
+	}
+	return rawData, nil
+}
@@ -0,0 +1,140 @@
+package volumequery
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type LabelSlotsTestSuite struct{}
+
+var _ = Suite(&LabelSlotsTestSuite{})
+
+// labelPartition is an in-memory label partition.
+type labelPartition []byte
+
+func newLabelPartition() labelPartition {
+	return make(labelPartition, LabelSlotSize*LabelSlotCount)
+}
+
+func (this labelPartition) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(this).ReadAt(p, off)
+}
+
+// write writes a label the way volumesetup.WriteVolumeLabel does.
+func (this labelPartition) write(c *C, label string) int {
+	idx, generation := NextLabelSlot(ReadLabelSlots(this))
+	payload, err := SerializeVolumeLabel(&VolumeLabel{Version: VolumeLabelVersion, Label: label})
+	c.Assert(err, IsNil)
+	slot, err := EncodeLabelSlot(generation, payload)
+	c.Assert(err, IsNil)
+	copy(this[LabelSlotOffset(idx):], slot)
+	return idx
+}
+
+func (this labelPartition) label(c *C) string {
+	payload, err := ReadLabelPayload(this)
+	c.Assert(err, IsNil)
+	label, _, err := DecodeVolumeLabel(payload)
+	c.Assert(err, IsNil)
+	return label.Label
+}
+
+func (this *LabelSlotsTestSuite) TestEncodeDecodeLabelSlot(c *C) {
+	slot, err := EncodeLabelSlot(7, []byte(`{"label":"data"}`))
+	c.Assert(err, IsNil)
+
+	generation, payload, ok := DecodeLabelSlot(slot)
+	c.Check(ok, Equals, true)
+	c.Check(generation, Equals, uint64(7))
+	c.Check(string(payload), Equals, `{"label":"data"}`)
+
+	// Torn
+	_, _, ok = DecodeLabelSlot(slot[:len(slot)-1])
+	c.Check(ok, Equals, false)
+
+	// Corrupt
+	corrupt := append([]byte{}, slot...)
+	corrupt[len(corrupt)-2] ^= 0xff
+	_, _, ok = DecodeLabelSlot(corrupt)
+	c.Check(ok, Equals, false)
+
+	// Generation doesn't match the checksum
+	corrupt = append([]byte{}, slot...)
+	corrupt[8]++
+	_, _, ok = DecodeLabelSlot(corrupt)
+	c.Check(ok, Equals, false)
+
+	_, _, ok = DecodeLabelSlot(make([]byte, LabelSlotSize))
+	c.Check(ok, Equals, false)
+
+	_, err = EncodeLabelSlot(1, make([]byte, LabelSlotMaxPayload+1))
+	c.Check(err, Equals, errLabelTooLarge)
+}
+
+func (this *LabelSlotsTestSuite) TestWritesAlternateSlots(c *C) {
+	partition := newLabelPartition()
+
+	_, err := ReadLabelPayload(partition)
+	c.Check(err, NotNil)
+
+	c.Check(partition.write(c, "first"), Equals, 1)
+	c.Check(partition.label(c), Equals, "first")
+	c.Check(partition.write(c, "second"), Equals, 0)
+	c.Check(partition.label(c), Equals, "second")
+	c.Check(partition.write(c, "third"), Equals, 1)
+	c.Check(partition.label(c), Equals, "third")
+
+	newest, found := NewestLabelSlot(ReadLabelSlots(partition))
+	c.Check(found, Equals, true)
+	c.Check(newest.Generation, Equals, uint64(3))
+}
+
+func (this *LabelSlotsTestSuite) TestTornWriteKeepsPreviousLabel(c *C) {
+	partition := newLabelPartition()
+	partition.write(c, "first")
+	idx := partition.write(c, "second")
+
+	// Damage the newest slot's label JSON, as a torn write would.
+	partition[LabelSlotOffset(idx)+int64(labelSlotHeaderSize)+2] ^= 0xff
+	c.Check(partition.label(c), Equals, "first")
+
+	// The next write replaces the damaged slot, not the good one.
+	c.Check(partition.write(c, "third"), Equals, idx)
+	c.Check(partition.label(c), Equals, "third")
+}
+
+func (this *LabelSlotsTestSuite) TestLegacyLabel(c *C) {
+	partition := newLabelPartition()
+	copy(partition, append([]byte(`{"version":1,"label":"legacy"}`), 0))
+	c.Check(partition.label(c), Equals, "legacy")
+
+	// The first slotted write leaves the legacy label alone.
+	c.Check(partition.write(c, "upgraded"), Equals, 1)
+	c.Check(partition.label(c), Equals, "upgraded")
+	c.Check(bytes.HasPrefix(partition, []byte(`{"version":1,"label":"legacy"}`)), Equals, true)
+
+	// Garbage isn't mistaken for a legacy label.
+	garbage := newLabelPartition()
+	copy(garbage, append([]byte("SIMPLELBgarbage"), 0))
+	_, err := ReadLabelPayload(garbage)
+	c.Check(err, Equals, errNoValidLabel)
+}
+
+func (this *LabelSlotsTestSuite) TestDeserializeVolumeLabel(c *C) {
+	partition := newLabelPartition()
+	partition.write(c, "data")
+
+	path := filepath.Join(c.MkDir(), "label")
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	_, err = f.Write(partition)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	label, err := DeserializeVolumeLabel(path)
+	c.Assert(err, IsNil)
+	c.Check(label.Label, Equals, "data")
+}
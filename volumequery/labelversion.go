@@ -0,0 +1,166 @@
+// Implements versioning of the volume label schema. Labels are migrated in
+// memory from the version they were written with to VolumeLabelVersion by a
+// chain of migrators, each of which upgrades the raw JSON fields of a label by
+// one version. Labels written by a newer version of simple are refused, since
+// they can't be interpreted (or safely rewritten) by this one.
+
+package volumequery
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/hashicorp/errwrap"
+)
+
+var (
+	errLabelVersionTooNew     = errors.New("volume label was written by a newer version of simple and can't be read")
+	errLabelVersionInvalid    = errors.New("volume label has an invalid version")
+	errLabelMigrationMissing  = errors.New("no migrator is registered for the volume label version")
+	errLabelMigrationFailed   = errors.New("volume label migration failed")
+	errLabelMigratorDuplicate = errors.New("a migrator is already registered for the volume label version")
+)
+
+// LabelMigrator upgrades the raw JSON fields of a volume label by one version.
+// It need not set the version field.
+type LabelMigrator func(fields map[string]interface{}) error
+
+var (
+	labelMigratorsMtx sync.RWMutex
+	// Migrators keyed by the version they upgrade from
+	labelMigrators = make(map[int]LabelMigrator)
+)
+
+func init() {
+	MustRegisterLabelMigrator(0, migrateLabelV0)
+}
+
+// RegisterLabelMigrator registers the migrator which upgrades labels from the
+// given version to the next one.
+func RegisterLabelMigrator(fromVersion int, migrator LabelMigrator) error {
+	labelMigratorsMtx.Lock()
+	defer labelMigratorsMtx.Unlock()
+	if _, found := labelMigrators[fromVersion]; found {
+		return errLabelMigratorDuplicate
+	}
+	labelMigrators[fromVersion] = migrator
+	return nil
+}
+
+// MustRegisterLabelMigrator is RegisterLabelMigrator, but panics on error.
+func MustRegisterLabelMigrator(fromVersion int, migrator LabelMigrator) {
+	if err := RegisterLabelMigrator(fromVersion, migrator); err != nil {
+		panic(err)
+	}
+}
+
+// getLabelMigrator returns the migrator from the given version.
+func getLabelMigrator(fromVersion int) (LabelMigrator, bool) {
+	labelMigratorsMtx.RLock()
+	defer labelMigratorsMtx.RUnlock()
+	migrator, found := labelMigrators[fromVersion]
+	return migrator, found
+}
+
+// migrateLabelV0 upgrades labels from before the version field was written.
+// They have the fields of version 1, but may lack metadata.
+func migrateLabelV0(fields map[string]interface{}) error {
+	if fields["metadata"] == nil {
+		fields["metadata"] = map[string]interface{}{}
+	}
+	return nil
+}
+
+// labelFieldsVersion returns the version of a label's raw JSON fields. Labels
+// without a version field are version 0.
+func labelFieldsVersion(fields map[string]interface{}) (int, error) {
+	raw, found := fields["version"]
+	if !found || raw == nil {
+		return 0, nil
+	}
+	number, ok := raw.(float64)
+	if !ok || number < 0 || number != float64(int(number)) {
+		return 0, errwrap.Wrap(errLabelVersionInvalid, fmt.Errorf("%v", raw))
+	}
+	return int(number), nil
+}
+
+// DecodeVolumeLabel decodes the JSON form of a volume label, migrating it to
+// VolumeLabelVersion. Returns the label and the version it was written with.
+func DecodeVolumeLabel(rawData []byte) (VolumeLabel, int, error) {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(rawData, &fields); err != nil {
+		return VolumeLabel{}, 0, err
+	}
+
+	fromVersion, err := labelFieldsVersion(fields)
+	if err != nil {
+		return VolumeLabel{}, 0, err
+	}
+	if fromVersion > VolumeLabelVersion {
+		return VolumeLabel{}, fromVersion, errwrap.Wrapf(
+			fmt.Sprintf("{{err}} (label version %d, newest supported version %d)", fromVersion, VolumeLabelVersion),
+			errLabelVersionTooNew)
+	}
+
+	if fromVersion < VolumeLabelVersion {
+		for version := fromVersion; version < VolumeLabelVersion; version++ {
+			migrator, found := getLabelMigrator(version)
+			if !found {
+				return VolumeLabel{}, fromVersion, errwrap.Wrap(errLabelMigrationMissing, fmt.Errorf("version %d", version))
+			}
+			if err := migrator(fields); err != nil {
+				return VolumeLabel{}, fromVersion, errwrap.Wrap(errLabelMigrationFailed, err)
+			}
+			fields["version"] = version + 1
+		}
+		// Round-trip the migrated fields to decode them as the current schema.
+		if rawData, err = json.Marshal(fields); err != nil {
+			return VolumeLabel{}, fromVersion, errwrap.Wrap(errLabelMigrationFailed, err)
+		}
+	}
+
+	volLabel := VolumeLabel{}
+	if err := json.Unmarshal(rawData, &volLabel); err != nil {
+		return VolumeLabel{}, fromVersion, err
+	}
+	return volLabel, fromVersion, nil
+}
+
+// readRawVolumeLabel reads the null terminated JSON form of a volume label,
+// without the null.
+func readRawVolumeLabel(r io.Reader) ([]byte, error) {
+	rdr := bufio.NewReader(r)
+	rawData, err := rdr.ReadBytes(byte(0))
+	if err != nil {
+		return nil, err
+	}
+	// rawData includes the trailing null, which will choke the parser.
+	return rawData[:len(rawData)-1], nil
+}
+
+// ReadVolumeLabelPayload reads the stored JSON form of the volume label at the
+// given path, before any migration.
+func ReadVolumeLabelPayload(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadLabelPayload(f)
+}
+
+// ReadVolumeLabel reads the volume label at the given path, migrating it to
+// VolumeLabelVersion. Returns the label and the version it was written with.
+func ReadVolumeLabel(path string) (VolumeLabel, int, error) {
+	rawData, err := ReadVolumeLabelPayload(path)
+	if err != nil {
+		return VolumeLabel{}, 0, err
+	}
+	return DecodeVolumeLabel(rawData)
+}
@@ -0,0 +1,80 @@
+package volumequery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/errwrap"
+	. "gopkg.in/check.v1"
+)
+
+type LabelVersionTestSuite struct{}
+
+var _ = Suite(&LabelVersionTestSuite{})
+
+func (this *LabelVersionTestSuite) TestDecodeCurrentVersion(c *C) {
+	label, fromVersion, err := DecodeVolumeLabel([]byte(`{"version":1,"hostname":"host","machine_id":"abcd",` +
+		`"label":"data","numbering":"2","encrypted":true,"metadata":{"owner":"ops"}}`))
+	c.Assert(err, IsNil)
+	c.Check(fromVersion, Equals, 1)
+	c.Check(label, DeepEquals, VolumeLabel{
+		Version:   1,
+		Hostname:  "host",
+		MachineId: "abcd",
+		Label:     "data",
+		Numbering: "2",
+		Encrypted: true,
+		Metadata:  map[string]string{"owner": "ops"},
+	})
+}
+
+func (this *LabelVersionTestSuite) TestDecodeMigratesVersion0(c *C) {
+	label, fromVersion, err := DecodeVolumeLabel([]byte(`{"hostname":"host","label":"data"}`))
+	c.Assert(err, IsNil)
+	c.Check(fromVersion, Equals, 0)
+	c.Check(label.Version, Equals, VolumeLabelVersion)
+	c.Check(label.Label, Equals, "data")
+	c.Check(label.Metadata, DeepEquals, map[string]string{})
+
+	_, fromVersion, err = DecodeVolumeLabel([]byte(`{"version":0,"label":"data","metadata":null}`))
+	c.Assert(err, IsNil)
+	c.Check(fromVersion, Equals, 0)
+}
+
+func (this *LabelVersionTestSuite) TestDecodeRefusesNewerVersion(c *C) {
+	_, fromVersion, err := DecodeVolumeLabel([]byte(`{"version":99,"label":"data"}`))
+	c.Assert(err, NotNil)
+	c.Check(fromVersion, Equals, 99)
+	c.Check(errwrap.Contains(err, errLabelVersionTooNew.Error()), Equals, true)
+	c.Check(err.Error(), Matches, ".*label version 99, newest supported version 1.*")
+}
+
+func (this *LabelVersionTestSuite) TestDecodeRefusesInvalidVersion(c *C) {
+	for _, raw := range []string{`{"version":-1}`, `{"version":1.5}`, `{"version":"1"}`} {
+		_, _, err := DecodeVolumeLabel([]byte(raw))
+		c.Check(err, NotNil, Commentf("%s", raw))
+	}
+}
+
+func (this *LabelVersionTestSuite) TestRegisterLabelMigrator(c *C) {
+	c.Check(RegisterLabelMigrator(0, migrateLabelV0), Equals, errLabelMigratorDuplicate)
+	c.Check(func() { MustRegisterLabelMigrator(0, migrateLabelV0) }, PanicMatches, ".*already registered.*")
+}
+
+func (this *LabelVersionTestSuite) TestReadVolumeLabel(c *C) {
+	path := filepath.Join(c.MkDir(), "label")
+	// Anything after the null is left over from previous labels.
+	raw := append([]byte(`{"label":"data"}`), 0)
+	raw = append(raw, []byte(`garbage`)...)
+	c.Assert(ioutil.WriteFile(path, raw, os.FileMode(0600)), IsNil)
+
+	label, fromVersion, err := ReadVolumeLabel(path)
+	c.Assert(err, IsNil)
+	c.Check(fromVersion, Equals, 0)
+	c.Check(label.Label, Equals, "data")
+
+	label, err = DeserializeVolumeLabel(path)
+	c.Assert(err, IsNil)
+	c.Check(label.Version, Equals, VolumeLabelVersion)
+}
@@ -1,33 +1,121 @@
 package volumequery
 
 import (
+	"fmt"
 	"os"
-	"strconv"
+	"sort"
 
 	"github.com/coreos/go-systemd/util"
 	"github.com/wrouesnel/docker-simple-disk/volumeaccess"
 )
 
-// FilterByVolumeQuery takes a list of initialized devices and filters the list
-// for devices who's labels or properties match the supplied volume query.
-//func FilterByVolumeQuery(query *VolumeQuery, diskPaths []string) (diskPath []string, error) {
-//	for _, diskPath := range diskPaths {
-//		labelPath, dataPath, err := GetDiskLabelAndVolumePath(diskPath)
-//		if err != nil {
-//			return
-//		}
-//	}
-//
-//}
+// ConstraintResult is the outcome of evaluating one query constraint against
+// a device.
+type ConstraintResult struct {
+	// Query field the constraint comes from
+	Constraint string `json:"constraint"`
+	// What the query requires
+	Expected string `json:"expected"`
+	// What the device has
+	Actual string `json:"actual"`
+	// Whether the device satisfies the constraint
+	Passed bool `json:"passed"`
+}
+
+// MatchReport lists every constraint of a query which was evaluated against a
+// device, in the order they were evaluated.
+type MatchReport struct {
+	LabelPath   string             `json:"label_path"`
+	DataPath    string             `json:"data_path"`
+	Constraints []ConstraintResult `json:"constraints"`
+	// Set if the data partition GPT name disagrees with the volume label
+	PartitionNameMismatch *PartitionNameMismatch `json:"partition_name_mismatch,omitempty"`
+}
+
+// Matched is true if every evaluated constraint passed.
+func (this *MatchReport) Matched() bool {
+	for _, result := range this.Constraints {
+		if !result.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed returns the constraints which did not pass.
+func (this *MatchReport) Failed() []ConstraintResult {
+	failed := []ConstraintResult{}
+	for _, result := range this.Constraints {
+		if !result.Passed {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+func (this *MatchReport) add(constraint string, expected string, actual string, passed bool) {
+	this.Constraints = append(this.Constraints, ConstraintResult{
+		Constraint: constraint,
+		Expected:   expected,
+		Actual:     actual,
+		Passed:     passed,
+	})
+}
 
 // VolumeQueryMatch checks if a given volume query would match the device at
 // the given path. Does not check for initialization or exclusive access
 // constraints.
 func VolumeQueryMatch(query *VolumeQuery, labelPath string, dataPath string) (bool, error) {
-	label, err := DeserializeVolumeLabel(labelPath)
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return false, err
+	}
+	return db.VolumeQueryMatch(query, labelPath, dataPath)
+}
+
+// VolumeQueryMatch implements VolumeQueryMatch against the snapshot.
+func (this *DeviceDatabase) VolumeQueryMatch(query *VolumeQuery, labelPath string, dataPath string) (bool, error) {
+	report, err := this.ExplainVolumeQueryMatch(query, labelPath, dataPath)
 	if err != nil {
 		return false, err
 	}
+	return report.Matched(), nil
+}
+
+// ExplainVolumeQueryMatch evaluates a volume query against the device at the
+// given path as VolumeQueryMatch does, and reports the outcome of each
+// constraint. Constraints on the data partition can't be evaluated if it
+// can't be opened, so are left out of the report in that case.
+func ExplainVolumeQueryMatch(query *VolumeQuery, labelPath string, dataPath string) (*MatchReport, error) {
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return db.ExplainVolumeQueryMatch(query, labelPath, dataPath)
+}
+
+// ExplainVolumeQueryMatch implements ExplainVolumeQueryMatch against the
+// snapshot.
+func (this *DeviceDatabase) ExplainVolumeQueryMatch(query *VolumeQuery, labelPath string, dataPath string) (*MatchReport, error) {
+	report := &MatchReport{
+		LabelPath:   labelPath,
+		DataPath:    dataPath,
+		Constraints: []ConstraintResult{},
+	}
+
+	payload, err := ReadVolumeLabelPayload(labelPath)
+	if err != nil {
+		return nil, err
+	}
+	label, _, err := DecodeVolumeLabel(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	dataPartition, err := this.Device(dataPath)
+	if err != nil {
+		return nil, err
+	}
 
 	// By definition, any query for a non-initialized device should fail if
 	// gets into this function. But - we probably initialized the volume before
@@ -35,40 +123,32 @@ func VolumeQueryMatch(query *VolumeQuery, labelPath string, dataPath string) (bo
 
 	// query.Initialized
 
+	// Nothing in the label can be trusted if the signature is required and
+	// doesn't verify, so don't go any further with the disk.
+	if !report.explainSignature(query, payload, dataPartition) {
+		return report, nil
+	}
+
 	// Check query parameters which are determined from the labels first.
-	if query.OwnHostname {
-		// Try and get this machine's hostname
-		ourHostname, err := os.Hostname()
-		if err != nil {
-			// Can't get hostname, but must match hostname == would always fail
-			return false, err
-		}
-		if label.Hostname != ourHostname {
-			return false, nil
-		}
+	if err := report.explainLabel(query, &label); err != nil {
+		return nil, err
 	}
 
-	if query.OwnMachineId {
-		// Try and get the machine ID
-		ourMachineId, err := util.GetMachineID()
+	// The label is also written to the GPT name of the data partition, and
+	// the two must agree.
+	report.explainPartitionName(&label, dataPartition)
+
+	// Hardware constraints are determined from the disk the label is on.
+	if query.hasHardwareConstraints() {
+		disks, err := this.ParentDisk(labelPath)
 		if err != nil {
-			// Can't get machineId, but must match machineId == would always fail
-			return false, err
+			return nil, err
 		}
-		if label.MachineId != ourMachineId {
-			return false, nil
+		for _, disk := range disks {
+			report.explainHardware(query, disk)
 		}
 	}
 
-	if query.Label != "" {
-		// TODO: cross-match partition label
-		if query.Label != label.Label {
-			return false, nil
-		}
-	}
-
-	// label.Numbering has no query relevance
-
 	// Open the device into a context so we can inspect filesystems/size/etc
 	var dataCtx volumeaccess.VolumeContext
 	if query.EncryptionKey != "" {
@@ -76,65 +156,115 @@ func VolumeQueryMatch(query *VolumeQuery, labelPath string, dataPath string) (bo
 			// label says device is not encrypted. It could be corrupted, but
 			// someone would have to do this intentionally - so assume its a
 			// problem and just fail.
-			return false, nil
+			report.add("encryption-passphrase", "encrypted", "not encrypted", false)
+			return report, nil
 		}
 		var err error
 		dataCtx, err = volumeaccess.OpenEncryptedDevice(query.EncryptionKey, dataPath)
 		if err != nil {
 			// Encryption key does not unlock the encrypted volume
-			return false, nil
+			report.add("encryption-passphrase", "unlocks", fmt.Sprintf("does not unlock: %v", err), false)
+			return report, nil
 		}
+		report.add("encryption-passphrase", "unlocks", "unlocks", true)
 	} else {
 		dataCtx, err = volumeaccess.OpenDevice(dataPath)
 		if err != nil {
-			// Encryption key does not unlock the encrypted volume
-			return false, nil
+			report.add("data-partition", "opens", fmt.Sprintf("could not be opened: %v", err), false)
+			return report, nil
 		}
 	}
 	defer dataCtx.Close()
 
-	// Have to query up the partition now to match these rules.
-	rule, err := GetFullSelectionRuleForDevice(dataCtx.GetDevicePath())
+	// Have to query up the partition now to match these rules. An opened
+	// encrypted device is new since the snapshot was taken, so needs a new
+	// one.
+	rule, err := this.Device(dataCtx.GetDevicePath())
+	if err == errDiskNotFound {
+		rule, err = GetFullSelectionRuleForDevice(dataCtx.GetDevicePath())
+	}
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	sizeStr, found := rule.Attrs["size"]
-	if !found {
-		return false, nil
+	report.explainDevice(query, rule)
+
+	// All single-device constraints are evaluated.
+	return report, nil
+}
+
+// explainLabel evaluates the constraints of a query which are determined from
+// the volume label.
+func (this *MatchReport) explainLabel(query *VolumeQuery, label *VolumeLabel) error {
+	if query.OwnHostname {
+		// Try and get this machine's hostname
+		ourHostname, err := os.Hostname()
+		if err != nil {
+			// Can't get hostname, but must match hostname == would always fail
+			return err
+		}
+		this.add("own-hostname", ourHostname, label.Hostname, label.Hostname == ourHostname)
 	}
 
-	deviceSize, err := strconv.ParseUint(sizeStr, 10, 64)
-	if err != nil {
-		// Might be badly formatted - don't care. We can't match with it,
-		// so fail it.
-		return false, nil
+	if query.OwnMachineId {
+		// Try and get the machine ID
+		ourMachineId, err := util.GetMachineID()
+		if err != nil {
+			// Can't get machineId, but must match machineId == would always fail
+			return err
+		}
+		this.add("own-machine-id", ourMachineId, label.MachineId, label.MachineId == ourMachineId)
 	}
 
-	if query.MinimumSizeBytes > 0 {
-		if deviceSize < query.MinimumSizeBytes {
-			return false, nil
+	if query.Label != "" {
+		// The GPT partition name is cross-checked by explainPartitionName
+		this.add("label", query.Label, label.Label, query.Label == label.Label)
+	}
+
+	// Metadata keys are checked in order so reports are stable.
+	metaKeys := make([]string, 0, len(query.Metadata))
+	for key, _ := range query.Metadata {
+		metaKeys = append(metaKeys, key)
+	}
+	sort.Strings(metaKeys)
+	for _, key := range metaKeys {
+		actual, found := label.Metadata[key]
+		if !found {
+			actual = "unset"
 		}
+		this.add("meta-"+key, query.Metadata[key], actual, found && actual == query.Metadata[key])
 	}
 
-	if query.MaximumSizeBytes > 0 {
-		if deviceSize > query.MaximumSizeBytes {
-			return false, nil
+	// label.Numbering has no query relevance
+	return nil
+}
+
+// explainDevice evaluates the constraints of a query which are determined from
+// the (opened) data device.
+func (this *MatchReport) explainDevice(query *VolumeQuery, rule *DeviceSelectionRule) {
+	deviceSize, found := DeviceSizeBytes(rule)
+	if !found {
+		// Can't determine size - can't match on it - fail this device.
+		this.add("size", "known", "unknown", false)
+	} else {
+		if query.MinimumSizeBytes > 0 {
+			this.add("min-size", fmt.Sprintf(">= %d", query.MinimumSizeBytes),
+				fmt.Sprintf("%d", deviceSize), deviceSize >= query.MinimumSizeBytes)
+		}
+
+		if query.MaximumSizeBytes > 0 {
+			this.add("max-size", fmt.Sprintf("<= %d", query.MaximumSizeBytes),
+				fmt.Sprintf("%d", deviceSize), deviceSize <= query.MaximumSizeBytes)
 		}
 	}
 
 	if query.Filesystem != "" {
+		// Can't determine type - can't match on it - fail this device.
 		deviceFs, found := rule.Properties["ID_FS_TYPE"]
+		actualFs := deviceFs
 		if !found {
-			// Can't determine type - can't match on it - fail this device.
-			return false, nil
-		}
-		if deviceFs != query.Filesystem {
-			// Fail - filesystem does not match.
-			return false, nil
+			actualFs = "unknown"
 		}
+		this.add("filesystem", query.Filesystem, actualFs, found && deviceFs == query.Filesystem)
 	}
-
-	// All single-device constraints are satisifed by this query.
-	return true, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,88 @@
+package volumequery
+
+import (
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+type MatcherTestSuite struct{}
+
+var _ = Suite(&MatcherTestSuite{})
+
+func (this *MatcherTestSuite) TestExplainLabel(c *C) {
+	ourHostname, err := os.Hostname()
+	c.Assert(err, IsNil)
+
+	query := &VolumeQuery{
+		Label:       "data",
+		OwnHostname: true,
+	}
+
+	report := &MatchReport{}
+	c.Assert(report.explainLabel(query, &VolumeLabel{Label: "data", Hostname: ourHostname}), IsNil)
+	c.Check(report.Matched(), Equals, true)
+	c.Check(report.Constraints, DeepEquals, []ConstraintResult{
+		ConstraintResult{Constraint: "own-hostname", Expected: ourHostname, Actual: ourHostname, Passed: true},
+		ConstraintResult{Constraint: "label", Expected: "data", Actual: "data", Passed: true},
+	})
+
+	report = &MatchReport{}
+	c.Assert(report.explainLabel(query, &VolumeLabel{Label: "other", Hostname: ourHostname}), IsNil)
+	c.Check(report.Matched(), Equals, false)
+	c.Check(report.Failed(), DeepEquals, []ConstraintResult{
+		ConstraintResult{Constraint: "label", Expected: "data", Actual: "other", Passed: false},
+	})
+}
+
+func (this *MatcherTestSuite) TestExplainLabel_Metadata(c *C) {
+	query := &VolumeQuery{
+		Metadata: map[string]string{"tier": "hot", "owner": "ops"},
+	}
+
+	report := &MatchReport{}
+	c.Assert(report.explainLabel(query, &VolumeLabel{Metadata: map[string]string{"tier": "hot", "owner": "ops", "rack": "a"}}), IsNil)
+	c.Check(report.Matched(), Equals, true)
+	c.Check(report.Constraints, DeepEquals, []ConstraintResult{
+		ConstraintResult{Constraint: "meta-owner", Expected: "ops", Actual: "ops", Passed: true},
+		ConstraintResult{Constraint: "meta-tier", Expected: "hot", Actual: "hot", Passed: true},
+	})
+
+	report = &MatchReport{}
+	c.Assert(report.explainLabel(query, &VolumeLabel{Metadata: map[string]string{"tier": "cold"}}), IsNil)
+	c.Check(report.Failed(), DeepEquals, []ConstraintResult{
+		ConstraintResult{Constraint: "meta-owner", Expected: "ops", Actual: "unset", Passed: false},
+		ConstraintResult{Constraint: "meta-tier", Expected: "hot", Actual: "cold", Passed: false},
+	})
+}
+
+func (this *MatcherTestSuite) TestExplainDevice(c *C) {
+	rule := &DeviceSelectionRule{
+		Properties: map[string]string{"ID_FS_TYPE": "ext4"},
+		Attrs:      map[string]string{"size": "2048"},
+	}
+
+	query := &VolumeQuery{
+		MinimumSizeBytes: 2 * 1024 * 1024,
+		MaximumSizeBytes: 1024 * 1024 * 1024,
+		Filesystem:       "xfs",
+	}
+
+	report := &MatchReport{}
+	report.explainDevice(query, rule)
+	c.Check(report.Constraints, DeepEquals, []ConstraintResult{
+		ConstraintResult{Constraint: "min-size", Expected: ">= 2097152", Actual: "1048576", Passed: false},
+		ConstraintResult{Constraint: "max-size", Expected: "<= 1073741824", Actual: "1048576", Passed: true},
+		ConstraintResult{Constraint: "filesystem", Expected: "xfs", Actual: "ext4", Passed: false},
+	})
+	c.Check(report.Matched(), Equals, false)
+}
+
+func (this *MatcherTestSuite) TestExplainDevice_UnknownSize(c *C) {
+	// A device of unknown size never matches, even without size limits.
+	report := &MatchReport{}
+	report.explainDevice(&VolumeQuery{}, &DeviceSelectionRule{Properties: map[string]string{}})
+	c.Check(report.Failed(), DeepEquals, []ConstraintResult{
+		ConstraintResult{Constraint: "size", Expected: "known", Actual: "unknown", Passed: false},
+	})
+}
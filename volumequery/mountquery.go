@@ -1,59 +1,264 @@
+// Implements the availability filter which keeps simple away from disks the
+// system is already using - mounted, active as swap, held by device-mapper or
+// md, or claimed by a volume manager - even if they look blank.
+
 package volumequery
 
 import (
-	//linuxproc "github.com/c9s/goprocinfo/linux"
-	//"github.com/wrouesnel/go.log"
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/wrouesnel/docker-simple-disk/fsutil"
+	"github.com/wrouesnel/go.log"
+)
+
+const (
+	// Where to read the active swap devices from.
+	ProcSwaps string = "/proc/swaps"
+)
+
+var (
+	errDiskInUse = DiskFailReason(errors.New("disk or one of its partitions is in use by the system"))
+)
+
+// memberFilesystems are the udev ID_FS_TYPE values which mark a device as a
+// member of a volume manager, whether or not it is currently active.
+var memberFilesystems = map[string]string{
+	"LVM2_member":       "LVM physical volume",
+	"linux_raid_member": "md RAID member",
+	"zfs_member":        "ZFS pool member",
+}
+
+// DiskUsageSource reports which block devices the system is using.
+type DiskUsageSource interface {
+	// InUse returns a description of how each in-use device is being used,
+	// keyed by MAJOR:MINOR device number.
+	InUse() (map[string]string, error)
+}
+
+var (
+	diskUsageSourceMtx sync.RWMutex
+	diskUsageSource    DiskUsageSource = NewSystemDiskUsageSource()
 )
 
-// GetAvailableCandidateDisks returns all disks on the current node which
-// *could* be used and filters the list of possible disks on the basis of
-// whether they are presently mounted and marked exclusive.
-// selectionRules : should be set to the global device candidate rule to use for
-// 					setting
-//func GetAvailableCandidateDisks(selectionRules []DeviceSelectionRule) []string {
-//	// Read the mounts
-//	mounts, err := linuxproc.ReadMounts(ProcMounts)
-//	if err != nil {
-//		log.Errorln("Error reading mounts - no candidate devices will be allowed:", err)
-//		return []string{}
-//	}
-//	// Figure out which disks are already mounted.
-//	inUseDisks := make(map[string]*DeviceSelectionRule)
-//	for _, mnt := range mounts.Mounts {
-//		// Query the partition.
-//		diskDevices, err := GetDiskDeviceFromPartitionPath(mnt.Device)
-//		// Skip this mount but proceed.
-//		if err != nil {
-//			if err == errGotMultipleDisksWhenExpectedOne {
-//				log.Warnln("Found multiple parent disks for mounted device:", mnt.Device)
-//			} else if err == errDiskNotFound {
-//				log.Warnln("Could not find a parent disk for mounted device:", err)
-//			} else {
-//				log.Errorln("Unexpected error when querying parent disks:", err)
-//			}
-//			continue
-//		}
-//
-//		for k, v := range diskDevices {
-//			if _, found := inUseDisks[k]; found {
-//				log.Debugln("Disk already detected as in-use:", k)
-//			} else {
-//				inUseDisks[k] = v
-//			}
-//		}
-//	}
-//
-//
-//	// Read the list of possible disks
-//	disks, err := GetDevicesByDevNode(selectionRules)
-//	if err != nil {
-//		return []string{}
-//	}
-//	// Remove disks which have partitions currently mounted from them
-//	for _, disk := range disks {
-//		// Ugly - feels like there should be a better way, but udev doesn't
-//		// actually get much more specific
-//
-//	}
-//
-//}
\ No newline at end of file
+// SetDiskUsageSource replaces the disk usage source used by all queries.
+func SetDiskUsageSource(source DiskUsageSource) {
+	diskUsageSourceMtx.Lock()
+	defer diskUsageSourceMtx.Unlock()
+	diskUsageSource = source
+}
+
+// GetDiskUsageSource returns the disk usage source used by all queries.
+func GetDiskUsageSource() DiskUsageSource {
+	diskUsageSourceMtx.RLock()
+	defer diskUsageSourceMtx.RUnlock()
+	return diskUsageSource
+}
+
+// StaticDiskUsageSource reports a fixed set of in-use devices. It is used with
+// device snapshots, where the local system's usage doesn't apply.
+type StaticDiskUsageSource struct {
+	inUse map[string]string
+}
+
+// NewStaticDiskUsageSource returns a usage source reporting the given devices
+// (keyed by MAJOR:MINOR) as in use.
+func NewStaticDiskUsageSource(inUse map[string]string) *StaticDiskUsageSource {
+	source := &StaticDiskUsageSource{
+		inUse: make(map[string]string, len(inUse)),
+	}
+	for k, v := range inUse {
+		source.inUse[k] = v
+	}
+	return source
+}
+
+// InUse implements DiskUsageSource
+func (this *StaticDiskUsageSource) InUse() (map[string]string, error) {
+	inUse := make(map[string]string, len(this.inUse))
+	for k, v := range this.inUse {
+		inUse[k] = v
+	}
+	return inUse, nil
+}
+
+// SystemDiskUsageSource reads device usage from the mount table, the active
+// swap list and the sysfs holders of each block device.
+type SystemDiskUsageSource struct {
+	// Mount table to read (normally /proc/self/mountinfo)
+	MountInfoPath string
+	// Active swap list to read (normally /proc/swaps)
+	SwapsPath string
+	// Root of sysfs
+	SysRoot string
+}
+
+// NewSystemDiskUsageSource returns a usage source reading the live system.
+func NewSystemDiskUsageSource() *SystemDiskUsageSource {
+	return &SystemDiskUsageSource{
+		MountInfoPath: fsutil.ProcSelfMountInfo,
+		SwapsPath:     ProcSwaps,
+		SysRoot:       SysfsRoot,
+	}
+}
+
+// blockDevnum returns the MAJOR:MINOR device number of a block device node.
+// Returns false if the path is not a block device.
+func blockDevnum(devicePath string) (string, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(devicePath, &st); err != nil {
+		return "", false
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return "", false
+	}
+	rdev := uint64(st.Rdev)
+	major := ((rdev >> 8) & 0xfff) | ((rdev >> 32) &^ 0xfff)
+	minor := (rdev & 0xff) | ((rdev >> 12) &^ 0xff)
+	return fmt.Sprintf("%d:%d", major, minor), true
+}
+
+// readSwaps returns the paths of the active swap areas from a swaps file.
+func readSwaps(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	swaps := []string{}
+	scanner := bufio.NewScanner(f)
+	// Skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		// Paths are escaped the same way as in mountinfo
+		swaps = append(swaps, strings.Replace(fields[0], "\\040", " ", -1))
+	}
+	return swaps, scanner.Err()
+}
+
+// InUse implements DiskUsageSource
+func (this *SystemDiskUsageSource) InUse() (map[string]string, error) {
+	inUse := make(map[string]string)
+
+	mounts, err := fsutil.ReadMountInfo(this.MountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, mount := range mounts {
+		description := fmt.Sprintf("mounted at %s", mount.Mountpoint)
+		inUse[fmt.Sprintf("%d:%d", mount.Major, mount.Minor)] = description
+		// Some filesystems (i.e. btrfs) report an anonymous device number,
+		// so also check the mount source.
+		if strings.HasPrefix(mount.Source, "/") {
+			if devnum, ok := blockDevnum(mount.Source); ok {
+				inUse[devnum] = description
+			}
+		}
+	}
+
+	swaps, err := readSwaps(this.SwapsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, swap := range swaps {
+		// Swap files live on a filesystem which is already mounted.
+		if devnum, ok := blockDevnum(swap); ok {
+			inUse[devnum] = "active swap"
+		}
+	}
+
+	classDir := filepath.Join(this.SysRoot, "class", "block")
+	entries, err := ioutil.ReadDir(classDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		holders, err := ioutil.ReadDir(filepath.Join(classDir, entry.Name(), "holders"))
+		if err != nil || len(holders) == 0 {
+			continue
+		}
+		devnum, err := ioutil.ReadFile(filepath.Join(classDir, entry.Name(), "dev"))
+		if err != nil {
+			continue
+		}
+		holderNames := []string{}
+		for _, holder := range holders {
+			holderNames = append(holderNames, holder.Name())
+		}
+		inUse[strings.TrimSpace(string(devnum))] = fmt.Sprintf("held by %s", strings.Join(holderNames, ", "))
+	}
+
+	return inUse, nil
+}
+
+// deviceUsage returns how a single device is in use, if it is.
+func (this *DeviceDatabase) deviceUsage(device *DeviceSelectionRule) (string, bool, error) {
+	inUse, err := this.devicesInUse()
+	if err != nil {
+		return "", false, err
+	}
+	if description, found := inUse[deviceDevnum(device)]; found {
+		return description, true, nil
+	}
+	if description, found := memberFilesystems[device.Properties["ID_FS_TYPE"]]; found {
+		return description, true, nil
+	}
+	return "", false, nil
+}
+
+// DiskUsage returns how a disk or any of its partitions is in use by the
+// system. Returns false if the disk is not in use.
+func (this *DeviceDatabase) DiskUsage(diskPath string) (string, bool, error) {
+	disk, err := this.Device(diskPath)
+	if err != nil {
+		return "", false, err
+	}
+	description, inUse, err := this.deviceUsage(disk)
+	if err != nil {
+		return "", false, err
+	}
+	if inUse {
+		return fmt.Sprintf("%s: %s", diskPath, description), true, nil
+	}
+
+	partitions, err := this.Partitions(diskPath)
+	if err != nil {
+		return "", false, err
+	}
+	for partPath, partition := range partitions {
+		description, inUse, err := this.deviceUsage(partition)
+		if err != nil {
+			return "", false, err
+		}
+		if inUse {
+			return fmt.Sprintf("%s: %s", partPath, description), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// checkDiskAvailable replaces the fail reason of a disk with errDiskInUse if
+// the system is using it.
+func (this *DeviceDatabase) checkDiskAvailable(diskPath string, failReason DiskFailReason) (DiskFailReason, error) {
+	description, inUse, err := this.DiskUsage(diskPath)
+	if err != nil {
+		return failReason, err
+	}
+	if inUse {
+		log.Debugln("Disk is in use:", description)
+		return errDiskInUse, nil
+	}
+	return failReason, nil
+}
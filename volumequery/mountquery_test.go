@@ -0,0 +1,142 @@
+package volumequery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type MountQueryTestSuite struct {
+	restore func()
+	devices []*DeviceSelectionRule
+}
+
+var _ = Suite(&MountQueryTestSuite{})
+
+func (this *MountQueryTestSuite) SetUpTest(c *C) {
+	snapshot, err := LoadSnapshotDeviceSource(testSnapshotPath)
+	c.Assert(err, IsNil)
+	this.devices, err = snapshot.Devices()
+	c.Assert(err, IsNil)
+	this.restore = useTestDevices(snapshot)
+}
+
+func (this *MountQueryTestSuite) TearDownTest(c *C) {
+	this.restore()
+}
+
+func (this *MountQueryTestSuite) TestSystemDiskUsageSource(c *C) {
+	root := c.MkDir()
+	source := &SystemDiskUsageSource{
+		MountInfoPath: filepath.Join(root, "mountinfo"),
+		SwapsPath:     filepath.Join(root, "swaps"),
+		SysRoot:       filepath.Join(root, "sys"),
+	}
+
+	c.Assert(ioutil.WriteFile(source.MountInfoPath, []byte(
+		"22 1 8:1 / /mnt/data rw,relatime shared:1 - ext4 /nonexistent/sda1 rw\n"),
+		os.FileMode(0644)), IsNil)
+	// Swap files aren't block devices, so are left to the mount table.
+	c.Assert(ioutil.WriteFile(source.SwapsPath, []byte(
+		"Filename\t\t\t\tType\t\tSize\tUsed\tPriority\n"+
+			"/nonexistent/swapfile                   file\t\t1048572\t0\t-2\n"),
+		os.FileMode(0644)), IsNil)
+
+	// sdc is held by device-mapper, sdd holds nothing.
+	sdc := filepath.Join(source.SysRoot, "class", "block", "sdc")
+	c.Assert(os.MkdirAll(filepath.Join(sdc, "holders", "dm-0"), os.FileMode(0755)), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(sdc, "dev"), []byte("8:32\n"), os.FileMode(0644)), IsNil)
+	sdd := filepath.Join(source.SysRoot, "class", "block", "sdd")
+	c.Assert(os.MkdirAll(filepath.Join(sdd, "holders"), os.FileMode(0755)), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(sdd, "dev"), []byte("8:48\n"), os.FileMode(0644)), IsNil)
+
+	inUse, err := source.InUse()
+	c.Assert(err, IsNil)
+	c.Check(inUse, DeepEquals, map[string]string{
+		"8:1":  "mounted at /mnt/data",
+		"8:32": "held by dm-0",
+	})
+}
+
+func (this *MountQueryTestSuite) TestGetCandidateDisks_RejectsInUseDisks(c *C) {
+	SetDiskUsageSource(NewStaticDiskUsageSource(map[string]string{
+		// Blank disk held by device-mapper
+		"8:0": "held by dm-0",
+		// Foreign partition which is mounted
+		"8:49": "mounted at /mnt",
+	}))
+
+	initialized, uninitialized, rejected, err := GetCandidateDisks(diskRules(), nil, Claimant{})
+	c.Assert(err, IsNil)
+	c.Check(initialized, DeepEquals, []string{"/dev/sdb"})
+	c.Check(uninitialized, DeepEquals, []string{"/dev/sdf"})
+	c.Check(rejected, DeepEquals, []string{"/dev/sda", "/dev/sdc", "/dev/sdd", "/dev/sde"})
+
+	_, failReason, err := CheckIfDiskIsInitialized("/dev/sda")
+	c.Assert(err, IsNil)
+	c.Check(failReason, Equals, errDiskInUse)
+	_, failReason, err = CheckIfDiskIsInitialized("/dev/sdd")
+	c.Assert(err, IsNil)
+	c.Check(failReason, Equals, errDiskInUse)
+
+	isBlank, err := CheckIfDiskIsBlankCandidate("/dev/sda")
+	c.Assert(err, IsNil)
+	c.Check(isBlank, Equals, false)
+}
+
+func (this *MountQueryTestSuite) TestGetCandidateDisks_RejectsInUseSimpleDisks(c *C) {
+	SetDiskUsageSource(NewStaticDiskUsageSource(map[string]string{
+		// Data partition of a simple disk, mounted by another volume
+		"8:18": "mounted at /tmp/docker-simple/vol/0",
+	}))
+
+	initialized, uninitialized, rejected, err := GetCandidateDisks(diskRules(), nil, Claimant{})
+	c.Assert(err, IsNil)
+	c.Check(initialized, IsNil)
+	c.Check(uninitialized, DeepEquals, []string{"/dev/sda", "/dev/sdf"})
+	c.Check(rejected, DeepEquals, []string{"/dev/sdb", "/dev/sdc", "/dev/sdd", "/dev/sde"})
+
+	report, err := GetCandidateReport(diskRules(), nil, Claimant{}, nil)
+	c.Assert(err, IsNil)
+	for _, candidate := range report {
+		if candidate.DiskPath == "/dev/sdb" {
+			c.Check(candidate.FailReason, Equals, errDiskInUse)
+		}
+	}
+
+	// It is still a simple disk to whatever already owns it
+	isInitialized, _, err := CheckIfDiskIsInitialized("/dev/sdb")
+	c.Assert(err, IsNil)
+	c.Check(isInitialized, Equals, true)
+
+	// The label partition is checked too
+	SetDiskUsageSource(NewStaticDiskUsageSource(map[string]string{
+		"8:17": "held by dm-1",
+	}))
+	initialized, _, _, err = GetCandidateDisks(diskRules(), nil, Claimant{})
+	c.Assert(err, IsNil)
+	c.Check(initialized, IsNil)
+}
+
+func (this *MountQueryTestSuite) TestGetCandidateDisks_RejectsVolumeManagerMembers(c *C) {
+	for _, device := range this.devices {
+		if deviceDevnode(device) == "/dev/sdf" {
+			device.Properties["ID_FS_TYPE"] = "LVM2_member"
+		}
+	}
+	SetDeviceSource(NewSnapshotDeviceSource(this.devices))
+
+	_, uninitialized, rejected, err := GetCandidateDisks(diskRules(), nil, Claimant{})
+	c.Assert(err, IsNil)
+	c.Check(uninitialized, DeepEquals, []string{"/dev/sda"})
+	c.Check(rejected, DeepEquals, []string{"/dev/sdc", "/dev/sdd", "/dev/sde", "/dev/sdf"})
+
+	db, err := SnapshotDeviceDatabase()
+	c.Assert(err, IsNil)
+	description, inUse, err := db.DiskUsage("/dev/sdf")
+	c.Assert(err, IsNil)
+	c.Check(inUse, Equals, true)
+	c.Check(description, Equals, "/dev/sdf: LVM physical volume")
+}
@@ -0,0 +1,92 @@
+// Implements collapsing dm-multipath devices. A disk reachable over several
+// paths appears once per path as an sdX device, and once as the dm-* map
+// multipathd assembles from them. Only the map is ever offered as a
+// candidate.
+
+package volumequery
+
+import (
+	"strings"
+
+	"github.com/wrouesnel/go.log"
+)
+
+const (
+	// Prefix of the DM_UUID of multipath maps. The rest is the WWID of the
+	// disk.
+	multipathUUIDPrefix string = "mpath-"
+)
+
+// deviceMultipathMap checks if a device is a multipath map, and returns the
+// WWID of the disk it maps.
+func deviceMultipathMap(device *DeviceSelectionRule) (string, bool) {
+	uuid := device.Properties["DM_UUID"]
+	if !strings.HasPrefix(uuid, multipathUUIDPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(uuid, multipathUUIDPrefix), true
+}
+
+// deviceMapper checks if a device is a device-mapper device.
+func deviceMapper(device *DeviceSelectionRule) bool {
+	return strings.HasPrefix(deviceName(device), "dm-") || device.Properties["DM_UUID"] != "" ||
+		device.Properties["DM_NAME"] != ""
+}
+
+// multipathMember checks if a device is one path of a multipath map, either
+// because udev's multipath rules flagged it, or because it has the WWID of a
+// known map.
+func multipathMember(device *DeviceSelectionRule, wwids map[string]struct{}) bool {
+	if device.Properties["DM_MULTIPATH_DEVICE_PATH"] == "1" {
+		return true
+	}
+	for _, key := range []string{"ID_SERIAL", "ID_WWN_WITH_EXTENSION", "ID_WWN"} {
+		if value := device.Properties[key]; value != "" {
+			if _, found := wwids[value]; found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CandidatePaths returns the sorted device node paths matched by the
+// selection rules, with multipath devices collapsed: paths of a multipath map
+// are dropped in favour of the map, and device-mapper devices which aren't
+// multipath maps (i.e. LVM volumes or our own dm-crypt mappings) are never
+// candidates.
+func (this *DeviceDatabase) CandidatePaths(selectionRules []DeviceSelectionRule) ([]string, error) {
+	diskPaths, err := this.DevicePaths(selectionRules)
+	if err != nil {
+		return nil, err
+	}
+
+	wwids := make(map[string]struct{})
+	for _, device := range this.devices {
+		if wwid, isMap := deviceMultipathMap(device); isMap {
+			wwids[wwid] = struct{}{}
+		}
+	}
+
+	candidates := make([]string, 0, len(diskPaths))
+	for _, diskPath := range diskPaths {
+		device, err := this.Device(diskPath)
+		if err != nil {
+			return nil, err
+		}
+		if _, isMap := deviceMultipathMap(device); isMap {
+			candidates = append(candidates, diskPath)
+			continue
+		}
+		if deviceMapper(device) {
+			log.Debugln("Skipping device-mapper device which is not a multipath map:", diskPath)
+			continue
+		}
+		if multipathMember(device, wwids) {
+			log.Debugln("Skipping multipath member device:", diskPath)
+			continue
+		}
+		candidates = append(candidates, diskPath)
+	}
+	return candidates, nil
+}
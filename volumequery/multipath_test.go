@@ -0,0 +1,144 @@
+package volumequery
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type MultipathTestSuite struct{}
+
+var _ = Suite(&MultipathTestSuite{})
+
+func blockDevice(name string, major string, minor string, properties map[string]string) *DeviceSelectionRule {
+	device := &DeviceSelectionRule{
+		Subsystems: []string{"block"},
+		Name:       []string{name},
+		Properties: map[string]string{
+			"DEVNAME": "/dev/" + name,
+			"MAJOR":   major,
+			"MINOR":   minor,
+		},
+	}
+	for key, value := range properties {
+		device.Properties[key] = value
+	}
+	return device
+}
+
+// multipathTestDevices is an NVMe disk, a virtio disk, a multipath map with
+// two paths and a kpartx partition, and a dm-crypt mapping.
+func multipathTestDevices() []*DeviceSelectionRule {
+	const wwid = "3600508b400105e210000900000490000"
+	return []*DeviceSelectionRule{
+		blockDevice("nvme0n1", "259", "0", map[string]string{
+			"DEVTYPE":   "disk",
+			"ID_SERIAL": "Samsung_SSD_970_EVO_S46ENB0K000001",
+		}),
+		// No ID_PART_ENTRY_DISK or DEVPATH, so only the name finds the disk.
+		blockDevice("nvme0n1p1", "259", "1", map[string]string{
+			"DEVTYPE": "partition",
+			"PARTN":   "1",
+		}),
+		blockDevice("vda", "252", "0", map[string]string{
+			"DEVTYPE": "disk",
+			"DEVPATH": "/devices/pci0000:00/0000:00:05.0/virtio2/block/vda",
+		}),
+		blockDevice("vda1", "252", "1", map[string]string{
+			"DEVTYPE": "partition",
+			"DEVPATH": "/devices/pci0000:00/0000:00:05.0/virtio2/block/vda/vda1",
+		}),
+		blockDevice("sdx", "65", "112", map[string]string{
+			"DEVTYPE":                  "disk",
+			"ID_SERIAL":                wwid,
+			"DM_MULTIPATH_DEVICE_PATH": "1",
+		}),
+		// Not flagged by udev, but has the WWID of the map.
+		blockDevice("sdy", "65", "128", map[string]string{
+			"DEVTYPE":   "disk",
+			"ID_SERIAL": wwid,
+		}),
+		blockDevice("dm-0", "253", "0", map[string]string{
+			"DEVTYPE": "disk",
+			"DM_NAME": "mpatha",
+			"DM_UUID": "mpath-" + wwid,
+		}),
+		blockDevice("dm-2", "253", "2", map[string]string{
+			"DEVTYPE": "disk",
+			"DM_NAME": "mpatha1",
+			"DM_UUID": "part1-mpath-" + wwid,
+		}),
+		blockDevice("dm-1", "253", "1", map[string]string{
+			"DEVTYPE": "disk",
+			"DM_NAME": "luks-4f68bce3",
+			"DM_UUID": "CRYPT-LUKS1-4f68bce3e8cd4db196e7fbcaf984b709-luks-4f68bce3",
+		}),
+	}
+}
+
+func multipathTestRules() []DeviceSelectionRule {
+	return []DeviceSelectionRule{
+		DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{"expr:sd*|nvme*|vd*|dm-*"},
+			Properties: map[string]string{"DEVTYPE": "disk"},
+		},
+	}
+}
+
+func (this *MultipathTestSuite) TestPartitionParents(c *C) {
+	db := NewDeviceDatabase(multipathTestDevices())
+
+	for partitionPath, diskPath := range map[string]string{
+		"/dev/nvme0n1p1": "/dev/nvme0n1",
+		"/dev/vda1":      "/dev/vda",
+		"/dev/dm-2":      "/dev/dm-0",
+	} {
+		disk, err := db.ParentDisk(partitionPath)
+		c.Assert(err, IsNil)
+		_, found := disk[diskPath]
+		c.Check(found, Equals, true, Commentf("%s is not on %s", partitionPath, diskPath))
+
+		partitions, err := db.Partitions(diskPath)
+		c.Assert(err, IsNil)
+		_, found = partitions[partitionPath]
+		c.Check(found, Equals, true, Commentf("%s has no partition %s", diskPath, partitionPath))
+	}
+}
+
+func (this *MultipathTestSuite) TestNameAlternatives(c *C) {
+	db := NewDeviceDatabase(multipathTestDevices())
+
+	paths, err := db.DevicePaths(multipathTestRules())
+	c.Assert(err, IsNil)
+	c.Check(paths, DeepEquals, []string{
+		"/dev/dm-0", "/dev/dm-1", "/dev/dm-2", "/dev/nvme0n1", "/dev/sdx", "/dev/sdy", "/dev/vda",
+	})
+
+	paths, err = db.DevicePaths([]DeviceSelectionRule{
+		DeviceSelectionRule{Name: []string{"expr:nvme*|vd*"}},
+	})
+	c.Assert(err, IsNil)
+	c.Check(paths, DeepEquals, []string{"/dev/nvme0n1", "/dev/nvme0n1p1", "/dev/vda", "/dev/vda1"})
+
+	// Separate globs must all match.
+	paths, err = db.DevicePaths([]DeviceSelectionRule{
+		DeviceSelectionRule{Name: []string{"nvme*", "vd*"}},
+	})
+	c.Assert(err, IsNil)
+	c.Check(paths, HasLen, 0)
+}
+
+func (this *MultipathTestSuite) TestCandidatePaths(c *C) {
+	db := NewDeviceDatabase(multipathTestDevices())
+
+	paths, err := db.CandidatePaths(multipathTestRules())
+	c.Assert(err, IsNil)
+	c.Check(paths, DeepEquals, []string{"/dev/dm-0", "/dev/nvme0n1", "/dev/vda"})
+}
+
+func (this *MultipathTestSuite) TestMultipathIdentity(c *C) {
+	db := NewDeviceDatabase(multipathTestDevices())
+
+	identity, err := db.DiskIdentity("/dev/dm-0")
+	c.Assert(err, IsNil)
+	c.Check(identity, Equals, "mpath:3600508b400105e210000900000490000")
+}
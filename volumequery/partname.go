@@ -0,0 +1,89 @@
+// Implements cross-checking the GPT name of the data partition against the
+// volume label. InitializeBlockDevice writes the label to both, so a disk where
+// they disagree has been tampered with or was only partly relabelled.
+
+package volumequery
+
+import (
+	"github.com/wrouesnel/go.log"
+)
+
+// PartitionNameMismatch is a disk whose data partition GPT name does not match
+// the label in its volume label.
+type PartitionNameMismatch struct {
+	// Label in the volume label
+	Label string `json:"label"`
+	// GPT name of the data partition
+	PartitionName string `json:"partition_name"`
+}
+
+// DevicePartitionName returns the GPT name of a partition. Returns false if
+// udev doesn't know it.
+func DevicePartitionName(rule *DeviceSelectionRule) (string, bool) {
+	if name, found := rule.Properties["ID_PART_ENTRY_NAME"]; found {
+		return name, true
+	}
+	// Set by the kernel, so present without the udev blkid rules
+	if name, found := rule.Properties["PARTNAME"]; found {
+		return name, true
+	}
+	// Partitions created without a name have neither.
+	if _, found := rule.Properties["ID_PART_ENTRY_UUID"]; found {
+		return "", true
+	}
+	return "", false
+}
+
+// DevicePartitionNumber returns the number of a partition in its partition
+// table. Returns a blank string if it is not known.
+func DevicePartitionNumber(rule *DeviceSelectionRule) string {
+	if number := rule.Properties["ID_PART_ENTRY_NUMBER"]; number != "" {
+		return number
+	}
+	return rule.Properties["PARTN"]
+}
+
+// checkPartitionName compares the GPT name of a data partition with the volume
+// label. Returns nil if they match or the name is not known.
+func checkPartitionName(label *VolumeLabel, dataPartition *DeviceSelectionRule) *PartitionNameMismatch {
+	name, found := DevicePartitionName(dataPartition)
+	if !found || name == label.Label {
+		return nil
+	}
+	return &PartitionNameMismatch{
+		Label:         label.Label,
+		PartitionName: name,
+	}
+}
+
+// CheckPartitionName compares the GPT name of the data partition at the given
+// path with the volume label. Returns nil if they match.
+func CheckPartitionName(label *VolumeLabel, dataPath string) (*PartitionNameMismatch, error) {
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return db.CheckPartitionName(label, dataPath)
+}
+
+// CheckPartitionName implements CheckPartitionName against the snapshot.
+func (this *DeviceDatabase) CheckPartitionName(label *VolumeLabel, dataPath string) (*PartitionNameMismatch, error) {
+	dataPartition, err := this.Device(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	return checkPartitionName(label, dataPartition), nil
+}
+
+// explainPartitionName evaluates whether the data partition GPT name matches
+// the volume label. A mismatch always fails the match.
+func (this *MatchReport) explainPartitionName(label *VolumeLabel, dataPartition *DeviceSelectionRule) {
+	mismatch := checkPartitionName(label, dataPartition)
+	if mismatch == nil {
+		return
+	}
+	log.Warnln("Data partition name does not match the volume label:", this.DataPath,
+		"partition name:", mismatch.PartitionName, "label:", mismatch.Label)
+	this.PartitionNameMismatch = mismatch
+	this.add("partition-name", mismatch.Label, mismatch.PartitionName, false)
+}
@@ -0,0 +1,86 @@
+package volumequery
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type PartitionNameTestSuite struct{}
+
+var _ = Suite(&PartitionNameTestSuite{})
+
+func (this *PartitionNameTestSuite) TestDevicePartitionName(c *C) {
+	name, found := DevicePartitionName(&DeviceSelectionRule{Properties: map[string]string{
+		"ID_PART_ENTRY_NAME": "data",
+		"PARTNAME":           "ignored",
+	}})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "data")
+
+	name, found = DevicePartitionName(&DeviceSelectionRule{Properties: map[string]string{"PARTNAME": "data"}})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "data")
+
+	// Unnamed GPT partition
+	name, found = DevicePartitionName(&DeviceSelectionRule{Properties: map[string]string{
+		"ID_PART_ENTRY_UUID": "4f68bce3-e8cd-4db1-96e7-fbcaf984b709",
+	}})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "")
+
+	_, found = DevicePartitionName(&DeviceSelectionRule{Properties: map[string]string{}})
+	c.Check(found, Equals, false)
+}
+
+func (this *PartitionNameTestSuite) TestDevicePartitionNumber(c *C) {
+	c.Check(DevicePartitionNumber(&DeviceSelectionRule{Properties: map[string]string{
+		"ID_PART_ENTRY_NUMBER": "2",
+		"PARTN":                "3",
+	}}), Equals, "2")
+	c.Check(DevicePartitionNumber(&DeviceSelectionRule{Properties: map[string]string{"PARTN": "3"}}), Equals, "3")
+	c.Check(DevicePartitionNumber(&DeviceSelectionRule{Properties: map[string]string{}}), Equals, "")
+}
+
+func (this *PartitionNameTestSuite) TestExplainPartitionName(c *C) {
+	label := &VolumeLabel{Label: "data"}
+
+	report := &MatchReport{DataPath: "/dev/sda2"}
+	report.explainPartitionName(label, &DeviceSelectionRule{Properties: map[string]string{"ID_PART_ENTRY_NAME": "data"}})
+	c.Check(report.Constraints, HasLen, 0)
+	c.Check(report.PartitionNameMismatch, IsNil)
+
+	// Unknown names can't be checked
+	report.explainPartitionName(label, &DeviceSelectionRule{Properties: map[string]string{}})
+	c.Check(report.Constraints, HasLen, 0)
+
+	report.explainPartitionName(label, &DeviceSelectionRule{Properties: map[string]string{"ID_PART_ENTRY_NAME": "scratch"}})
+	c.Check(report.Matched(), Equals, false)
+	c.Check(report.PartitionNameMismatch, DeepEquals, &PartitionNameMismatch{Label: "data", PartitionName: "scratch"})
+	c.Check(report.Constraints, DeepEquals, []ConstraintResult{
+		ConstraintResult{Constraint: "partition-name", Expected: "data", Actual: "scratch", Passed: false},
+	})
+}
+
+func (this *PartitionNameTestSuite) TestCheckPartitionName(c *C) {
+	defer useTestDevices(NewSnapshotDeviceSource([]*DeviceSelectionRule{
+		&DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{"sdq2"},
+			Properties: map[string]string{
+				"DEVNAME":            "/dev/sdq2",
+				"DEVTYPE":            "partition",
+				"MAJOR":              "65",
+				"MINOR":              "2",
+				"ID_PART_ENTRY_NAME": "",
+				"ID_PART_ENTRY_UUID": "4f68bce3-e8cd-4db1-96e7-fbcaf984b709",
+			},
+		},
+	}))()
+
+	mismatch, err := CheckPartitionName(&VolumeLabel{Label: ""}, "/dev/sdq2")
+	c.Assert(err, IsNil)
+	c.Check(mismatch, IsNil)
+
+	mismatch, err = CheckPartitionName(&VolumeLabel{Label: "data"}, "/dev/sdq2")
+	c.Assert(err, IsNil)
+	c.Check(mismatch, DeepEquals, &PartitionNameMismatch{Label: "data", PartitionName: ""})
+}
@@ -1,12 +1,7 @@
 package volumequery
 
 import (
-	"bufio"
 	"encoding/json"
-	"os"
-	"sort"
-
-	"github.com/jochenvg/go-udev"
 
 	"github.com/wrouesnel/docker-simple-disk/volumelabel"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -14,10 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/hashicorp/errwrap"
-	"path"
-	"path/filepath"
-
-	"strings"
+	"reflect"
 )
 
 const SimpleMetadataLabel string = "simple-metadata"
@@ -30,6 +22,29 @@ const (
 	NamingUUID    NamingType = "uuid"
 )
 
+// RemovePolicy is what happens to the disks of a volume when it is removed.
+type RemovePolicy string
+
+const (
+	// Release claims but leave disks initialized with their data intact
+	RemoveKeep RemovePolicy = "keep"
+	// Release claims and reset disks to uninitialized. Data is not destroyed.
+	RemoveRelease RemovePolicy = "release"
+	// Erase the LUKS header of encrypted disks, then reset them
+	RemoveCryptoErase RemovePolicy = "crypto-erase"
+	// Discard or zero the data partition, then reset disks
+	RemoveWipe RemovePolicy = "wipe"
+)
+
+// Valid checks if the remove policy is a known policy.
+func (this RemovePolicy) Valid() bool {
+	switch this {
+	case RemoveKeep, RemoveRelease, RemoveCryptoErase, RemoveWipe:
+		return true
+	}
+	return false
+}
+
 const (
 	VolumeLabelVersion int = 1
 )
@@ -46,6 +61,19 @@ var (
 	errBadGlobPattern                  = errors.New("bad glob pattern")
 )
 
+var (
+	errQueryNoLabel             = errors.New("volume query must specify a label")
+	errQueryBadNamingStyle      = errors.New("volume query specifies an unknown naming style")
+	errQueryBadDiskLimits       = errors.New("volume query min-disks exceeds max-disks")
+	errQueryNegativeDiskLimit   = errors.New("volume query disk limits cannot be negative")
+	errQueryBadPersistNumbering = errors.New("volume query persist-numbering requires numeric naming and max-disks > 0")
+	errQueryBadDynamicInit      = errors.New("volume query dynamic-initialize requires dynamic-mounts")
+	errQueryConflictingOption   = errors.New("volume option conflicts with the value given in the volume name")
+	errQueryBadRemovePolicy     = errors.New("volume query specifies an unknown remove policy")
+	errQueryBadTransport        = errors.New("volume query specifies an unknown transport")
+	errQueryBadHardwareGlob     = errors.New("volume query specifies a bad vendor or model pattern")
+)
+
 type DiskFailReason error
 
 var (
@@ -77,6 +105,9 @@ type VolumeQuery struct {
 	// Should the disk be placed in a subdirectory and dynamically updated
 	// as matching disks are added/removed
 	DynamicMounts bool `volumelabel:"dynamic-mounts"`
+	// Should blank disks be initialized and added to the volume as they
+	// appear with dynamic mounts? Otherwise only initialized disks are added.
+	DynamicInitialize bool `volumelabel:"dynamic-initialize"`
 	// Should disk numbering fields be respected from the label?
 	PersistNumbering bool `volumelabel:"persist-numbering"`
 
@@ -99,16 +130,159 @@ type VolumeQuery struct {
 	// Filesystem which will be created or found
 	Filesystem string `volumelabel:"filesystem"`
 
+	// Disk must (or must not) be rotational media. Unset matches either.
+	Rotational *bool `volumelabel:"rotational"`
+	// How the disk must be attached: sata, sas, nvme, usb, virtio or scsi.
+	Transport Transport `volumelabel:"transport"`
+	// Glob the udev vendor of the disk must match
+	Vendor string `volumelabel:"vendor"`
+	// Glob the udev model of the disk must match
+	Model string `volumelabel:"model"`
+	// Serial number the disk must have
+	Serial string `volumelabel:"serial"`
+	// WWN the disk must have
+	WWN string `volumelabel:"wwn"`
+
 	// Encryption Key - if specified requires a volume be encrypted with the
 	// given key.
 	EncryptionKey string `volumelabel:"encryption-passphrase"`
 	// LUKS cipher to be used if creating a volume. If a passphrase is
 	// specified then uses the LUKS default.
-	EncryptionCipher string `volumelabel:"encryption-hash"`
+	EncryptionCipher string `volumelabel:"encryption-cipher"`
 	// LUKS key size.
 	EncryptionKeySize int `volumelabel:"encryption-key-size"`
 	// LUKS hash function
 	EncryptionHash string `volumelabel:"encryption-hash"`
+
+	// What to do with the volume's disks when it is removed. Blank uses the
+	// driver default.
+	RemovePolicy RemovePolicy `volumelabel:"remove-policy"`
+
+	// Disk label must be signed with the label signing key
+	RequireSignature bool `volumelabel:"require-signature"`
+
+	// Label metadata keys and the values they must have, from meta-<key>
+	// fields. Stamped into the label of disks the query initializes.
+	Metadata map[string]string `volumelabel:"meta-,prefix"`
+}
+
+// NewVolumeQuery returns a VolumeQuery populated with the documented defaults
+// for fields a user does not specify.
+func NewVolumeQuery() VolumeQuery {
+	return VolumeQuery{
+		Exclusive:   true,
+		Basename:    "simple-",
+		NamingStyle: NamingNumeric,
+		MinDisks:    1,
+	}
+}
+
+// VolumelabelMarshal implements volumelabel.Marshaller
+func (this NamingType) VolumelabelMarshal() (string, error) {
+	return string(this), nil
+}
+
+// VolumelabelUnmarshal implements volumelabel.Unmarshaller
+func (this *NamingType) VolumelabelUnmarshal(v string) error {
+	*this = NamingType(v)
+	return nil
+}
+
+// VolumelabelMarshal implements volumelabel.Marshaller
+func (this RemovePolicy) VolumelabelMarshal() (string, error) {
+	return string(this), nil
+}
+
+// VolumelabelUnmarshal implements volumelabel.Unmarshaller
+func (this *RemovePolicy) VolumelabelUnmarshal(v string) error {
+	*this = RemovePolicy(v)
+	return nil
+}
+
+// ParseVolumeQuery parses a docker volume name and any driver options into a
+// VolumeQuery. Options use the same keys as the name but their values are not
+// restricted to what can appear in a volume name (i.e. passphrases). A field
+// may be given in both the name and the options only if both values agree -
+// neither source overrides the other. Fields not specified take their default
+// values.
+func ParseVolumeQuery(name string, options map[string]string) (VolumeQuery, error) {
+	query := NewVolumeQuery()
+	if err := volumelabel.UnmarshalVolumeLabel(name, &query); err != nil {
+		return VolumeQuery{}, err
+	}
+
+	nameFields := volumelabel.ParseVolumeLabelFields(name)
+	for key, value := range options {
+		if _, found := nameFields[key]; !found {
+			continue
+		}
+		// Compare parsed values so equivalent spellings (i.e. "1" and "true")
+		// don't conflict.
+		fromOption := query
+		fromOption.Metadata = copyMetadata(query.Metadata)
+		if err := volumelabel.UnmarshalVolumeLabelOptions(map[string]string{key: value}, &fromOption); err != nil {
+			return VolumeQuery{}, err
+		}
+		if !reflect.DeepEqual(fromOption, query) {
+			return VolumeQuery{}, errwrap.Wrap(errQueryConflictingOption, fmt.Errorf("conflicting option: %s", key))
+		}
+	}
+
+	if err := volumelabel.UnmarshalVolumeLabelOptions(options, &query); err != nil {
+		return VolumeQuery{}, err
+	}
+	return query, nil
+}
+
+// copyMetadata returns a copy of a metadata map, so it can be modified without
+// affecting the original.
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	result := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		result[k] = v
+	}
+	return result
+}
+
+// Validate checks the query is internally consistent and specifies everything
+// required to service a volume.
+func (this *VolumeQuery) Validate() error {
+	if this.Label == "" {
+		return errQueryNoLabel
+	}
+
+	if this.NamingStyle != NamingNumeric && this.NamingStyle != NamingUUID {
+		return errQueryBadNamingStyle
+	}
+
+	if this.MinDisks < 0 || this.MaxDisks < 0 {
+		return errQueryNegativeDiskLimit
+	}
+
+	if this.MaxDisks > 0 && this.MinDisks > this.MaxDisks {
+		return errQueryBadDiskLimits
+	}
+
+	if this.PersistNumbering && (this.NamingStyle != NamingNumeric || this.MaxDisks == 0) {
+		return errQueryBadPersistNumbering
+	}
+
+	if this.DynamicInitialize && !this.DynamicMounts {
+		return errQueryBadDynamicInit
+	}
+
+	if this.RemovePolicy != "" && !this.RemovePolicy.Valid() {
+		return errQueryBadRemovePolicy
+	}
+
+	if err := this.validateHardware(); err != nil {
+		return err
+	}
+
+	return nil
 }
 
 // VolumeQueryValue implements flag parsing for VolumeQuery's
@@ -148,40 +322,29 @@ type VolumeLabel struct {
 	Encrypted bool `json:"encrypted"`
 	// Extra metadata
 	Metadata map[string]string `json:"metadata"`
+	// Signature of the other fields, if the label was written with a signing
+	// key. Not part of what is signed (see canonicalLabelPayload).
+	Signature string `json:"signature,omitempty"`
 }
 
-// Serializes the label to it's null-terminated JSON form
+// Serializes the label to it's JSON form, as stored in a label slot
 func SerializeVolumeLabel(label *VolumeLabel) ([]byte, error) {
 	serialized, err := json.Marshal(label)
 	if err != nil {
 		return []byte{}, err
 	}
-	serialized = append(serialized, byte(0))
+	if len(serialized) > LabelSlotMaxPayload {
+		return []byte{}, errLabelTooLarge
+	}
 	return serialized, nil
 }
 
-// DeserializeVolumeLabel reads a given path for a null terminated VolumeLabel
+// DeserializeVolumeLabel reads the VolumeLabel from the newest valid slot of a
+// label partition (or a legacy null terminated label), migrating it to the
+// current VolumeLabelVersion if it is older.
 func DeserializeVolumeLabel(path string) (VolumeLabel, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return VolumeLabel{}, err
-	}
-
-	rdr := bufio.NewReader(f)
-	rawData, err := rdr.ReadBytes(byte(0))
-	if err != nil {
-		return VolumeLabel{}, err
-	}
-	// rawData includes the trailing null, which will choke the parser.
-	rawData = rawData[:len(rawData)-1]
-
-	volLabel := VolumeLabel{}
-
-	if err := json.Unmarshal(rawData, &volLabel); err != nil {
-		return VolumeLabel{}, err
-	}
-
-	return volLabel, nil
+	volLabel, _, err := ReadVolumeLabel(path)
+	return volLabel, err
 }
 
 // Struct representing a disk which is able to be used by the plugin
@@ -222,344 +385,120 @@ func NewDeviceSelectionRule() DeviceSelectionRule {
 	}
 }
 
-// selectionRuleForDevicePath generates the selection rule set which would
-// query up a disk path.
-func selectionRuleForDevicePath(devicePath string) []DeviceSelectionRule {
-	return []DeviceSelectionRule{
-		DeviceSelectionRule{
-			Properties: map[string]string{
-				"DEVNAME": devicePath,
-			},
-		},
-	}
+// deviceDevnode returns the device node path of a device.
+func deviceDevnode(device *DeviceSelectionRule) string {
+	return device.Properties["DEVNAME"]
 }
 
-// deviceToSelectionRule converts a udev Device to a selection rule.
-func deviceToSelectionRule(device *udev.Device) *DeviceSelectionRule {
-	fixedRule := new(DeviceSelectionRule)
+// deviceName returns the kernel name of a device.
+func deviceName(device *DeviceSelectionRule) string {
+	if len(device.Name) == 0 {
+		return ""
+	}
+	return device.Name[0]
+}
 
-	// Currently looks like no way to actually get this?
-	fixedRule.Name = []string{path.Base(device.Syspath())}
+// ruleMatchesDevice checks if a device (as a full selection rule) is matched
+// by a selection rule. Every field of the rule is a list of expressions (see
+// ruleexpr.go) and all of them must be satisfied.
+func ruleMatchesDevice(rule *DeviceSelectionRule, device *DeviceSelectionRule) (bool, error) {
+	// Filter mismatching subsystems and names. Every expression must match
+	// (i.e. sd* and !sda). Alternatives are a single expression (i.e.
+	// sd*|nvme*|vd*).
+	deviceSubsystem := ""
+	if len(device.Subsystems) > 0 {
+		deviceSubsystem = device.Subsystems[0]
+	}
+	if matched, err := matchRuleExprs(rule.Subsystems, deviceSubsystem); err != nil || !matched {
+		return false, err
+	}
+	if matched, err := matchRuleExprs(rule.Name, deviceName(device)); err != nil || !matched {
+		return false, err
+	}
 
-	fixedRule.Attrs = make(map[string]string)
-	for attrName, _ := range device.Sysattrs() {
-		fixedRule.Attrs[attrName] = device.SysattrValue(attrName)
+	// Filter mismatching tags. Each tag expression must match one of the
+	// device tags, or none of them if it is negated.
+	if matched, err := matchRuleTags(rule.Tag, device.Tag); err != nil || !matched {
+		return false, err
 	}
-	fixedRule.Properties = device.Properties()
-	fixedRule.Subsystems = []string{device.Subsystem()}
 
-	fixedRule.Tag = []string{}
-	for tagName, _ := range device.Tags() {
-		fixedRule.Tag = append(fixedRule.Tag, tagName)
+	// Filter mismatching properties and sysattrs. Every key glob must match
+	// at least a key. Then its value expression must match the given value.
+	// This is probably the most inefficient search space.
+	if matched, err := matchRuleMap(rule.Properties, device.Properties, nil); err != nil || !matched {
+		return false, err
+	}
+	// The size sysattr is compared in bytes, not sectors.
+	if matched, err := matchRuleMap(rule.Attrs, device.Attrs,
+		map[string]ruleNumberParser{"size": parseSizeSectors}); err != nil || !matched {
+		return false, err
 	}
 
-	return fixedRule
+	// Got through every check and the device still matched.
+	return true, nil
 }
 
 // getDevicesByDevNode takes a list of udev selection rules while will be
 // applied individually and the list of devices appended and returned. The
 // final list is deduplicated on the basis of DevPath (i.e. /dev/<device>)
-// The list is returned as a list of *udev.Device nodes.
+// The list is returned as full selection rules for each device.
 //
 // Usage: multiple rules can have varying levels of specificity - devices
 // matched by a less specific rule are deduplicated on the basis of device path.
 //
 // Performance note: udev is weird about rule application - adding a match for
 // properties is an OR operation, not an AND which doesn't suite our purposes
-// at all, so this function just dumps the DB and implements it's own filtering.
-// This implements glob matching so it should broadly follow what's possible.
+// at all, so this function just snapshots the DB (from the current
+// DeviceSource) and implements it's own filtering. This implements glob
+// matching so it should broadly follow what's possible. Callers doing many
+// lookups should take a DeviceDatabase snapshot once and use it directly.
 func getDevicesByDevNode(selectionRules []DeviceSelectionRule) (map[string]*DeviceSelectionRule, error) {
-	udevCtx := udev.Udev{}
-
-	// Deduplicates the device paths we've already seen.
-	devPaths := make(map[string]*DeviceSelectionRule)
-
-	deviceEnumerator := udevCtx.NewEnumerate()
-	// Only match initialized devices (global rule)
-	if err := deviceEnumerator.AddMatchIsInitialized(); err != nil {
-		return nil, err
-	}
-
-	devices, err := deviceEnumerator.Devices()
+	db, err := SnapshotDeviceDatabase()
 	if err != nil {
-		return nil, errwrap.Wrap(errUdevDatabaseLookup, err)
-	}
-
-	// Filter the database snapshot by the selection rules from udev
-	for _, rule := range selectionRules {
-		var currentDevices []*udev.Device
-		var nextDevices []*udev.Device
-
-		// Filter mismatching subsystems
-		currentDevices = devices[:] // Special: load the entire list
-		nextDevices = make([]*udev.Device, 0, len(currentDevices))
-		for _, device := range currentDevices {
-			deviceMatch, err := func(device *udev.Device) (bool, error) {
-				for _, subsystem := range rule.Subsystems {
-					matched, err := filepath.Match(subsystem, device.Subsystem())
-					if err != nil {
-						return false, errwrap.Wrap(errBadGlobPattern, err)
-					}
-					// Any match failure cancels the device out of the set
-					if !matched {
-						return false, nil
-					}
-				}
-				// Got through rules with no failed matches.
-				return true, nil
-			}(device)
-			// Fail on an error
-			if err != nil {
-				return nil, err
-			}
-			if deviceMatch {
-				nextDevices = append(nextDevices, device)
-			}
-		}
-
-		// Filter mismatching names
-		currentDevices = nextDevices[:]
-		nextDevices = make([]*udev.Device, 0, len(currentDevices))
-		for _, device := range currentDevices {
-			deviceMatch, err := func(device *udev.Device) (bool, error) {
-				for _, name := range rule.Name {
-					deviceName := filepath.Base(device.Syspath())
-					matched, err := filepath.Match(name, deviceName)
-					if err != nil {
-						return false, errwrap.Wrap(errBadGlobPattern, err)
-					}
-					// Any match failure cancels the device out of the set
-					if !matched {
-						return false, nil
-					}
-				}
-				// Got through rules with no failed matches.
-				return true, nil
-			}(device)
-			// Fail on an error
-			if err != nil {
-				return nil, err
-			}
-			if deviceMatch {
-				nextDevices = append(nextDevices, device)
-			}
-		}
-
-		// Filter mismatching tags
-		currentDevices = nextDevices[:]
-		nextDevices = make([]*udev.Device, 0, len(currentDevices))
-		for _, device := range currentDevices {
-			deviceMatch, err := func(device *udev.Device) (bool, error) {
-				// Each tag rule must match at least 1 device tag
-				for _, tag := range rule.Tag {
-					for deviceTag, _ := range device.Tags() {
-						matched, err := filepath.Match(tag, deviceTag)
-						if err != nil {
-							return false, errwrap.Wrap(errBadGlobPattern, err)
-						}
-						// If the match failed, then this tag rule is not
-						// satisfied, and so the device is not statisfied.
-						if !matched {
-							return false, nil
-						}
-					}
-				}
-				// Got through and matched all tags. Device matches.
-				return true, nil
-			}(device)
-			// Fail on an error
-			if err != nil {
-				return nil, err
-			}
-			if deviceMatch {
-				nextDevices = append(nextDevices, device)
-			}
-		}
-
-		// Filter mismatching properties
-		currentDevices = nextDevices[:]
-		nextDevices = make([]*udev.Device, 0, len(currentDevices))
-		for _, device := range currentDevices {
-			// Use this closure to handle the complex rules.
-			deviceMatch, err := func(device *udev.Device) (bool, error) {
-				// Every key glob must match at least a key.
-				// Then it's value glob must match the given value.
-				// This is probably the most inefficient search space.
-				for keyGlob, valueGlob := range rule.Properties {
-					globMatch := false
-					for deviceKey, deviceValue := range device.Properties() {
-						keyMatched, err := filepath.Match(keyGlob, deviceKey)
-						if err != nil {
-							return false, errwrap.Wrap(errBadGlobPattern, err)
-						}
-						// Didn't match this key - try others
-						if !keyMatched {
-							continue
-						}
-						// Key glob matched. Does the value glob match its value?
-						valueMatched, err := filepath.Match(valueGlob, deviceValue)
-						if err != nil {
-							return false, errwrap.Wrap(errBadGlobPattern, err)
-						}
-						// Matched on the value, so can break loop and mark
-						// glob success
-						if valueMatched {
-							globMatch = true
-							break
-						}
-					}
-
-					if !globMatch {
-						// Glob match failed for this property rule, so it
-						// cancels the device out of the set.
-						return false, nil
-					}
-				}
-				// Got through every check and the device still matched.
-				return true, nil
-			}(device)
-			// Fail on an error
-			if err != nil {
-				return nil, err
-			}
-			if deviceMatch {
-				nextDevices = append(nextDevices, device)
-			}
-		}
-		currentDevices = nextDevices[:]
-
-		// currentDevices is now the remaining devices which survived our rules.
-		// Figure out if we have new devices.
-		for _, device := range currentDevices {
-			if _, found := devPaths[device.Devnode()]; !found {
-				devPaths[device.Devnode()] = deviceToSelectionRule(device)
-			}
-		}
+		return nil, err
 	}
-	return devPaths, nil
+	return db.Match(selectionRules)
 }
 
 // GetFullSelectionRulesForDevice queries a device by device path and returns a
 // selection rule block which would uniquely match it. Mostly useful for
 // simplectl to crosscheck rules.
 func GetFullSelectionRuleForDevice(diskPath string) (*DeviceSelectionRule, error) {
-	// This function uses targeted device selction rules
-	devices, err := getDevicesByDevNode(selectionRuleForDevicePath(diskPath))
+	db, err := SnapshotDeviceDatabase()
 	if err != nil {
 		return nil, err
 	}
-
-	if len(devices) > 1 {
-		return nil, errGotMultipleDisksWhenExpectedOne
-	}
-
-	for _, device := range devices {
-		return device, nil
-	}
-
-	return nil, errDiskNotFound
+	return db.Device(diskPath)
 }
 
 // GetDevicePaths returns a sorted list of disk devices which are matched by
 // the DeviceSelectionRule
 func GetDevicePaths(selectionRules []DeviceSelectionRule) ([]string, error) {
-	devNodes := []string{}
-	devices, err := getDevicesByDevNode(selectionRules)
+	db, err := SnapshotDeviceDatabase()
 	if err != nil {
 		return []string{}, err
 	}
-
-	for devNode, _ := range devices {
-		devNodes = append(devNodes, devNode)
-	}
-
-	// Sort the list
-	sort.Strings(devNodes)
-
-	return devNodes, nil
+	return db.DevicePaths(selectionRules)
 }
 
 // GetPartitionDevicesFromDiskPath takes a disk path and returns the device
 // path deduplicated list of partitions on the disk.
 func GetPartitionDevicesFromDiskPath(diskPath string) (map[string]*DeviceSelectionRule, error) {
-	// This function uses targeted device selction rules
-	devices, err := getDevicesByDevNode(selectionRuleForDevicePath(diskPath))
+	db, err := SnapshotDeviceDatabase()
 	if err != nil {
 		return nil, err
 	}
-	// Check only 1 disk was returned (doesn't make much sense otherwise so
-	// we rule it out here explicitely.
-	if len(devices) > 1 {
-		return nil, errGotMultipleDisksWhenExpectedOne
-	}
-
-	partDiskVal := ""
-	for _, device := range devices {
-		partDiskVal = fmt.Sprintf("%s:%s",
-			device.Properties["MAJOR"], device.Properties["MINOR"])
-	}
-	if partDiskVal == "" {
-		return nil, errDiskNotFound
-	}
-
-	// Okay, query up the partitions
-	partitionRules := []DeviceSelectionRule{
-		DeviceSelectionRule{
-			Properties: map[string]string{
-				"ID_PART_ENTRY_DISK": partDiskVal,
-				"DEVTYPE":            "partition",
-			},
-		},
-	}
-
-	partitionDevices, err := getDevicesByDevNode(partitionRules)
-
-	return partitionDevices, nil
+	return db.Partitions(diskPath)
 }
 
 // GetDiskDeviceFromPartitionPath takes a partition path and tries to query the
 // disk it is attached to by device number. It is guaranteed to only ever return
 // the one device.
 func GetDiskDeviceFromPartitionPath(partitionPath string) (map[string]*DeviceSelectionRule, error) {
-	// This function uses targeted device selction rules
-	partDevices, err := getDevicesByDevNode(selectionRuleForDevicePath(partitionPath))
+	db, err := SnapshotDeviceDatabase()
 	if err != nil {
 		return nil, err
 	}
-
-	var major, minor string
-	for _, partDev := range partDevices {
-		diskTuple := strings.Split(partDev.Properties["ID_PART_ENTRY_DISK"], ":")
-
-		// If found major minor and do not have agreement, error.
-		if (major != "" && major != diskTuple[0]) || minor != "" && minor != diskTuple[1] {
-			return nil, errGotMultipleDisksWhenExpectedOne
-		}
-
-		if major == "" && minor == "" {
-			major = diskTuple[0]
-			minor = diskTuple[1]
-		}
-	}
-
-	// Query up the disk from the major/minor number
-	diskRules := []DeviceSelectionRule{
-		DeviceSelectionRule{
-			Properties: map[string]string{
-				"MAJOR": major,
-				"MINOR": minor,
-			},
-		},
-	}
-	diskDevices, err := getDevicesByDevNode(diskRules)
-	if len(diskDevices) == 0 {
-		return nil, errDiskNotFound
-	}
-
-	if len(diskDevices) > 1 {
-		return nil, errGotMultipleDisksWhenExpectedOne
-	}
-
-	return diskDevices, nil
+	return db.ParentDisk(partitionPath)
 }
 
@@ -1,98 +1,317 @@
 /*
-	Test functions for the udev API querying
+	Test functions for the udev API querying. Queries run against a snapshot of
+	a fabricated disk layout (testdata/devices.json) rather than the host:
+
+		sda	blank disk
+		sdb	initialized simple disk (sdb1 label, sdb2 data)
+		sdc	disk with a filesystem and no partitions
+		sdd	disk with a foreign partition (sdd1)
+		sde	disk with an empty partition table
+		sdf	blank disk with no serial or WWN
 */
 
 package volumequery
 
 import (
+	"sort"
+	"strings"
 	"testing"
+
 	. "gopkg.in/check.v1"
-	"strings"
 )
 
 // Hook up gocheck into the "go test" runner.
 func Test(t *testing.T) { TestingT(t) }
 
-type QueryTestSuite struct{}
+const testSnapshotPath string = "testdata/devices.json"
+
+// useTestDevices points device queries at the given source with no disks in
+// use. The returned function restores the previous sources.
+func useTestDevices(source DeviceSource) func() {
+	previous := GetDeviceSource()
+	previousUsage := GetDiskUsageSource()
+	SetDeviceSource(source)
+	SetDiskUsageSource(NewStaticDiskUsageSource(nil))
+	return func() {
+		SetDeviceSource(previous)
+		SetDiskUsageSource(previousUsage)
+	}
+}
+
+// useTestSnapshot points device queries at the test snapshot (see
+// useTestDevices).
+func useTestSnapshot(c *C) func() {
+	snapshot, err := LoadSnapshotDeviceSource(testSnapshotPath)
+	c.Assert(err, IsNil)
+	return useTestDevices(snapshot)
+}
+
+type QueryTestSuite struct {
+	restore func()
+}
 
 var _ = Suite(&QueryTestSuite{})
 
-func (this *QueryTestSuite) TestGetDevicesByDevNode_FindingDisks(c *C) {
-	// Run a query with some rules which generally work
+func (this *QueryTestSuite) SetUpTest(c *C) {
+	this.restore = useTestSnapshot(c)
+}
 
-	// We should always be able to find something looking a bit disk-like in
-	// our test environment.
-	rules := []DeviceSelectionRule{
+func (this *QueryTestSuite) TearDownTest(c *C) {
+	this.restore()
+}
+
+// diskRules are the default rules the driver uses to find disks.
+func diskRules() []DeviceSelectionRule {
+	return []DeviceSelectionRule{
 		DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{"sd*"},
 			Properties: map[string]string{
-				"DEVNAME": "/dev/?d[a-z]",
 				"DEVTYPE": "disk",
 			},
 		},
 	}
+}
 
-	diskDevices, err := getDevicesByDevNode(rules)
-	disks := []string{}
-	for _, v := range diskDevices {
-		disks = append(disks, v.Devnode())
+func sortedKeys(devices map[string]*DeviceSelectionRule) []string {
+	keys := []string{}
+	for k, _ := range devices {
+		keys = append(keys, k)
 	}
-	c.Assert(err, IsNil)                 // Check it works
-	c.Assert(len(disks), Not(Equals), 0) // Check we can find disks with search logic
-	c.Logf("Found disks: %s", strings.Join(disks," "))
+	sort.Strings(keys)
+	return keys
 }
 
-func (this *QueryTestSuite) TestGetDevicesByDevNode_WithComplexRules(c *C) {
-	// Check that all the property fields work (don't expect to return any result
+func (this *QueryTestSuite) TestGetDevicesByDevNode_FindingDisks(c *C) {
 	rules := []DeviceSelectionRule{
 		DeviceSelectionRule{
-			Subsystems: []string{"block"},
-			Name:       []string{"sda"},
-			Tag:        []string{},
 			Properties: map[string]string{
 				"DEVNAME": "/dev/?d[a-z]",
 				"DEVTYPE": "disk",
 			},
-			Attrs: map[string]string{},
 		},
 	}
 
 	diskDevices, err := getDevicesByDevNode(rules)
-	disks := []string{}
-	for _, v := range diskDevices {
-		disks = append(disks, v.Devnode())
-	}
-	c.Assert(err, IsNil) // Check it works
-	c.Assert(len(disks), Not(Equals), 0) // Check we can find disks with search logic
-	c.Logf("Found disks: %s", strings.Join(disks," "))
+	c.Assert(err, IsNil)
+	disks := sortedKeys(diskDevices)
+	c.Check(disks, DeepEquals, []string{"/dev/sda", "/dev/sdb", "/dev/sdc", "/dev/sdd", "/dev/sde", "/dev/sdf"})
+	c.Logf("Found disks: %s", strings.Join(disks, " "))
 }
 
-func (this *QueryTestSuite) TestGetPartitionsFromDiskPath(c *C) {
-	// Find something disk like and get partitions from it.
+func (this *QueryTestSuite) TestGetDevicesByDevNode_WithComplexRules(c *C) {
+	// Check that all the property fields work
 	rules := []DeviceSelectionRule{
 		DeviceSelectionRule{
+			Subsystems: []string{"block"},
+			Name:       []string{"sdb"},
+			Tag:        []string{"sys*"},
 			Properties: map[string]string{
 				"DEVNAME": "/dev/?d[a-z]",
 				"DEVTYPE": "disk",
 			},
+			Attrs: map[string]string{},
 		},
 	}
 
 	diskDevices, err := getDevicesByDevNode(rules)
-	disks := []string{}
-	for _, v := range diskDevices {
-		disks = append(disks, v.Devnode())
+	c.Assert(err, IsNil)
+	c.Check(sortedKeys(diskDevices), DeepEquals, []string{"/dev/sdb"})
+	c.Check(diskDevices["/dev/sdb"].Properties["ID_SERIAL"], Equals, "SIMPLE_DISK_B")
+}
+
+func (this *QueryTestSuite) TestGetDevicesByDevNode_DeduplicatesAcrossRules(c *C) {
+	rules := []DeviceSelectionRule{
+		DeviceSelectionRule{Name: []string{"sda"}},
+		DeviceSelectionRule{Name: []string{"sd[ab]"}, Properties: map[string]string{"DEVTYPE": "disk"}},
+		DeviceSelectionRule{Subsystems: []string{"net"}},
+	}
+
+	diskDevices, err := getDevicesByDevNode(rules)
+	c.Assert(err, IsNil)
+	// The net device has no device node so is never returned.
+	c.Check(sortedKeys(diskDevices), DeepEquals, []string{"/dev/sda", "/dev/sdb"})
+}
+
+func (this *QueryTestSuite) TestGetDevicesByDevNode_BadGlob(c *C) {
+	rules := []DeviceSelectionRule{
+		DeviceSelectionRule{Name: []string{"sd["}},
 	}
+
+	_, err := getDevicesByDevNode(rules)
+	c.Check(err, NotNil)
+}
+
+func (this *QueryTestSuite) TestGetPartitionsFromDiskPath(c *C) {
+	partitions, err := GetPartitionDevicesFromDiskPath("/dev/sdb")
 	c.Assert(err, IsNil)
-	c.Assert(len(disks), Not(Equals), 0, Commentf("Need at least 1 disk to pass this check."))
+	c.Check(sortedKeys(partitions), DeepEquals, []string{"/dev/sdb1", "/dev/sdb2"})
 
-	allpartitions := []string{}
+	partitions, err = GetPartitionDevicesFromDiskPath("/dev/sda")
+	c.Assert(err, IsNil)
+	c.Check(partitions, HasLen, 0)
+
+	_, err = GetPartitionDevicesFromDiskPath("/dev/sdz")
+	c.Check(err, NotNil)
+}
 
-	for _, disk := range disks {
-		partitions, err := GetPartitionDevicesFromDiskPath(disk)
-		c.Assert(err, IsNil, Commentf("Error querying %v for partitions: %v", disk, err))
-		allpartitions = append(allpartitions, partitions...)
+func (this *QueryTestSuite) TestGetDiskDeviceFromPartitionPath(c *C) {
+	disks, err := GetDiskDeviceFromPartitionPath("/dev/sdb2")
+	c.Assert(err, IsNil)
+	c.Check(sortedKeys(disks), DeepEquals, []string{"/dev/sdb"})
+
+	disks, err = GetDiskDeviceFromPartitionPath("/dev/sdd1")
+	c.Assert(err, IsNil)
+	c.Check(sortedKeys(disks), DeepEquals, []string{"/dev/sdd"})
+
+	_, err = GetDiskDeviceFromPartitionPath("/dev/sdz1")
+	c.Check(err, NotNil)
+}
+
+func (this *QueryTestSuite) TestCheckAndGetInitializedDisk(c *C) {
+	isInitialized, failReason, labelPath, dataPath, err := checkAndGetInitializedDisk("/dev/sdb")
+	c.Assert(err, IsNil)
+	c.Check(isInitialized, Equals, true)
+	c.Check(failReason, IsNil)
+	c.Check(labelPath, Equals, "/dev/sdb1")
+	c.Check(dataPath, Equals, "/dev/sdb2")
+
+	expected := map[string]DiskFailReason{
+		"/dev/sda": errBlankDisk,
+		"/dev/sdc": errHasAFilesystem,
+		"/dev/sdd": errCouldNotFindLabelPartition,
+		"/dev/sde": errHasPartitionTable,
+		"/dev/sdf": errBlankDisk,
+	}
+	for diskPath, expectedReason := range expected {
+		isInitialized, failReason, _, _, err := checkAndGetInitializedDisk(diskPath)
+		c.Assert(err, IsNil)
+		c.Check(isInitialized, Equals, false, Commentf(diskPath))
+		c.Check(failReason, Equals, expectedReason, Commentf(diskPath))
+	}
+
+	_, _, _, _, err = checkAndGetInitializedDisk("/dev/sdz")
+	c.Check(err, NotNil)
+}
+
+func (this *QueryTestSuite) TestGetCandidateDisks(c *C) {
+	initialized, uninitialized, rejected, err := GetCandidateDisks(diskRules(), nil, Claimant{})
+	c.Assert(err, IsNil)
+	c.Check(initialized, DeepEquals, []string{"/dev/sdb"})
+	c.Check(uninitialized, DeepEquals, []string{"/dev/sda", "/dev/sdf"})
+	c.Check(rejected, DeepEquals, []string{"/dev/sdc", "/dev/sdd", "/dev/sde"})
+}
+
+func (this *QueryTestSuite) TestGetCandidateDisks_WithLedger(c *C) {
+	ledger := NewClaimLedger()
+	identity, err := GetDiskIdentity("/dev/sda")
+	c.Assert(err, IsNil)
+	c.Assert(ledger.Claim([]string{identity}, Claimant{Volume: "other", Exclusive: true}), IsNil)
+
+	initialized, uninitialized, rejected, err := GetCandidateDisks(diskRules(), ledger, Claimant{Volume: "mine", Exclusive: true})
+	c.Assert(err, IsNil)
+	c.Check(initialized, DeepEquals, []string{"/dev/sdb"})
+	// sda is claimed, and sdf has no stable identity to claim it by.
+	c.Check(uninitialized, HasLen, 0)
+	c.Check(rejected, DeepEquals, []string{"/dev/sda", "/dev/sdc", "/dev/sdd", "/dev/sde", "/dev/sdf"})
+}
+
+func (this *QueryTestSuite) TestGetDiskIdentity(c *C) {
+	identity, err := GetDiskIdentity("/dev/sda")
+	c.Assert(err, IsNil)
+	c.Check(identity, Equals, IdentityPrefixWWN+"0x5000000000000a")
+
+	identity, err = GetDiskIdentity("/dev/sdb")
+	c.Assert(err, IsNil)
+	c.Check(identity, Equals, IdentityPrefixSerial+"SIMPLE_DISK_B")
+
+	identity, err = GetDiskIdentity("/dev/sdf")
+	c.Assert(err, IsNil)
+	c.Check(identity, Equals, "")
+}
+
+func (this *QueryTestSuite) TestSnapshotDeviceSourceReturnsCopies(c *C) {
+	devices, err := GetDeviceSource().Devices()
+	c.Assert(err, IsNil)
+	for _, device := range devices {
+		device.Properties["DEVNAME"] = ""
 	}
 
-	c.Assert(len(allpartitions), Not(Equals), 0, Commentf("Need at least 1 partition on a disk to pass this check."))
-	c.Logf("Found partitions: %s", strings.Join(allpartitions, " "))
-}
\ No newline at end of file
+	diskDevices, err := getDevicesByDevNode(diskRules())
+	c.Assert(err, IsNil)
+	c.Check(diskDevices, HasLen, 6)
+}
+
+func (this *QueryTestSuite) TestParseVolumeQuery_MergesOptions(c *C) {
+	query, err := ParseVolumeQuery("label.data_max-disks.2", map[string]string{
+		"encryption-passphrase": "s3cret_with.symbols!",
+		"naming-style":          "uuid",
+	})
+	c.Assert(err, IsNil)
+	c.Check(query.Label, Equals, "data")
+	c.Check(query.MaxDisks, Equals, int32(2))
+	c.Check(query.EncryptionKey, Equals, "s3cret_with.symbols!")
+	c.Check(query.NamingStyle, Equals, NamingUUID)
+	// Unspecified fields keep their defaults
+	c.Check(query.Exclusive, Equals, true)
+	c.Check(query.Basename, Equals, "simple-")
+}
+
+func (this *QueryTestSuite) TestParseVolumeQuery_AgreeingDuplicateIsAccepted(c *C) {
+	query, err := ParseVolumeQuery("label.data_exclusive.false", map[string]string{
+		"label":     "data",
+		"exclusive": "0",
+	})
+	c.Assert(err, IsNil)
+	c.Check(query.Exclusive, Equals, false)
+}
+
+func (this *QueryTestSuite) TestParseVolumeQuery_ConflictingDuplicateIsRejected(c *C) {
+	_, err := ParseVolumeQuery("label.data", map[string]string{
+		"label": "other",
+	})
+	c.Check(err, NotNil)
+}
+
+func (this *QueryTestSuite) TestParseVolumeQuery_Metadata(c *C) {
+	query, err := ParseVolumeQuery("label.data_meta-tier.hot", map[string]string{
+		"meta-owner": "Ops Team",
+		"meta-tier":  "hot",
+	})
+	c.Assert(err, IsNil)
+	c.Check(query.Metadata, DeepEquals, map[string]string{"tier": "hot", "owner": "Ops Team"})
+
+	_, err = ParseVolumeQuery("label.data_meta-tier.hot", map[string]string{
+		"meta-tier": "cold",
+	})
+	c.Check(err, NotNil)
+}
+
+func (this *QueryTestSuite) TestParseVolumeQuery_UnknownOptionIsRejected(c *C) {
+	_, err := ParseVolumeQuery("label.data", map[string]string{
+		"no-such-field": "1",
+	})
+	c.Check(err, NotNil)
+}
+
+func (this *QueryTestSuite) TestValidate_RemovePolicy(c *C) {
+	query, err := ParseVolumeQuery("label.data_remove-policy.crypto-erase", nil)
+	c.Assert(err, IsNil)
+	c.Check(query.RemovePolicy, Equals, RemoveCryptoErase)
+	c.Check(query.Validate(), IsNil)
+
+	query.RemovePolicy = ""
+	c.Check(query.Validate(), IsNil, Commentf("Blank remove policy uses the driver default"))
+
+	query.RemovePolicy = "shred"
+	c.Check(query.Validate(), NotNil)
+}
+
+func (this *QueryTestSuite) TestValidate_DynamicInitialize(c *C) {
+	query, err := ParseVolumeQuery("label.data_dynamic-initialize.true", nil)
+	c.Assert(err, IsNil)
+	c.Check(query.Validate(), Equals, errQueryBadDynamicInit)
+
+	query.DynamicMounts = true
+	c.Check(query.Validate(), IsNil)
+}
@@ -0,0 +1,323 @@
+// Implements the value expressions of device selection rules. Every pattern in
+// a selection rule (names, subsystems, tags, and the values of properties and
+// sysattrs) is a glob (as filepath.Match), or an expression if it starts with
+// "expr:":
+//
+//	expr:glob	the value matches the glob
+//	expr:a|b|c	the value matches any of the alternatives
+//	expr:>N >=N <N <=N =N	the value is a number which compares with N. N
+//			may have a K, M, G, T or P suffix (powers of 1024).
+//	expr:!expr	the value doesn't match expr
+//
+// Negation applies to the whole expression, so "expr:!a|b" matches neither a
+// nor b. Each alternative is a glob or a comparison. Plain globs never get
+// expression syntax, so globs which start with "!", "<", ">" or "=", or
+// contain "|", match literally as they always have.
+
+package volumequery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+)
+
+const (
+	// Prefix which marks a selection rule pattern as an expression
+	RuleExprPrefix string = "expr:"
+)
+
+var (
+	errBadRuleExpression = errors.New("bad selection rule expression")
+	errBadRuleNumber     = errors.New("bad number in selection rule comparison")
+)
+
+// Comparison operators, longest first so ">=" isn't parsed as ">".
+var ruleComparisons = []string{">=", "<=", ">", "<", "="}
+
+// Multipliers of the unit suffixes accepted in comparisons.
+var ruleUnits = map[byte]uint64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+	'P': 1 << 50,
+}
+
+// ruleNumberParser parses a device value for a numeric comparison.
+type ruleNumberParser func(value string) (uint64, bool)
+
+// parseRuleNumber parses a number with an optional unit suffix.
+func parseRuleNumber(value string) (uint64, bool) {
+	value = strings.TrimSpace(value)
+	multiplier := uint64(1)
+	if len(value) > 0 {
+		suffix := strings.ToUpper(value[len(value)-1:])[0]
+		if unit, found := ruleUnits[suffix]; found {
+			multiplier = unit
+			value = value[:len(value)-1]
+		}
+	}
+	number, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if number > 0 && multiplier > (^uint64(0))/number {
+		return 0, false
+	}
+	return number * multiplier, true
+}
+
+// parseSizeSectors parses the size sysattr into bytes, so size comparisons
+// can be written in bytes rather than 512-byte sectors.
+func parseSizeSectors(value string) (uint64, bool) {
+	return DeviceSizeBytes(&DeviceSelectionRule{Attrs: map[string]string{"size": value}})
+}
+
+// ruleExprBody returns the body of a pattern which is an expression.
+func ruleExprBody(pattern string) (string, bool) {
+	if !strings.HasPrefix(pattern, RuleExprPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(pattern, RuleExprPrefix), true
+}
+
+// ruleExprNegated checks if a pattern is a negated expression.
+func ruleExprNegated(pattern string) bool {
+	body, isExpr := ruleExprBody(pattern)
+	return isExpr && strings.HasPrefix(body, "!")
+}
+
+// matchRuleTerm matches a value against a single alternative.
+func matchRuleTerm(term string, value string, parseNumber ruleNumberParser) (bool, error) {
+	for _, op := range ruleComparisons {
+		if !strings.HasPrefix(term, op) {
+			continue
+		}
+		limit, ok := parseRuleNumber(term[len(op):])
+		if !ok {
+			return false, errwrap.Wrap(errBadRuleNumber, fmt.Errorf("%q", term))
+		}
+		number, ok := parseNumber(value)
+		if !ok {
+			// Values which aren't numbers never compare.
+			return false, nil
+		}
+		switch op {
+		case ">=":
+			return number >= limit, nil
+		case "<=":
+			return number <= limit, nil
+		case ">":
+			return number > limit, nil
+		case "<":
+			return number < limit, nil
+		}
+		return number == limit, nil
+	}
+
+	matched, err := filepath.Match(term, value)
+	if err != nil {
+		return false, errwrap.Wrap(errBadGlobPattern, err)
+	}
+	return matched, nil
+}
+
+// matchRuleExpr matches a value against a pattern, which is a glob unless it
+// is an expression.
+func matchRuleExpr(pattern string, value string, parseNumber ruleNumberParser) (bool, error) {
+	expr, isExpr := ruleExprBody(pattern)
+	if !isExpr {
+		matched, err := filepath.Match(pattern, value)
+		if err != nil {
+			return false, errwrap.Wrap(errBadGlobPattern, err)
+		}
+		return matched, nil
+	}
+
+	negated := strings.HasPrefix(expr, "!")
+	if negated {
+		expr = expr[1:]
+	}
+	if expr == "" {
+		return false, errwrap.Wrap(errBadRuleExpression, errors.New("empty expression"))
+	}
+
+	matched := false
+	for _, term := range strings.Split(expr, "|") {
+		termMatched, err := matchRuleTerm(term, value, parseNumber)
+		if err != nil {
+			return false, err
+		}
+		if termMatched {
+			matched = true
+			break
+		}
+	}
+	return matched != negated, nil
+}
+
+// matchRuleExprs matches a single device value (i.e. the kernel name) against
+// a list of expressions. Every expression must match, as every glob always
+// had to, so "sd*" "expr:!sda" is every sd* disk except sda. Alternatives are
+// written as a single expression (i.e. "expr:sd*|nvme*").
+func matchRuleExprs(exprs []string, value string) (bool, error) {
+	for _, expr := range exprs {
+		matched, err := matchRuleExpr(expr, value, parseRuleNumber)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// ruleValue is a device value with how to parse it for comparisons.
+type ruleValue struct {
+	value       string
+	parseNumber ruleNumberParser
+}
+
+// matchRuleValues matches an expression against every value a device has for
+// it (i.e. its tags, or every property a key glob matched). An expression must
+// match at least one of the values, and a negated expression must match all of
+// them, so a negated expression is satisfied by a device without the value.
+func matchRuleValues(expr string, values []ruleValue) (bool, error) {
+	negated := ruleExprNegated(expr)
+	for _, value := range values {
+		matched, err := matchRuleExpr(expr, value.value, value.parseNumber)
+		if err != nil {
+			return false, err
+		}
+		if matched && !negated {
+			return true, nil
+		}
+		if !matched && negated {
+			return false, nil
+		}
+	}
+	return negated, nil
+}
+
+// matchRuleTags matches the tag expressions of a selection rule against the
+// tags of a device. Every expression must be satisfied.
+func matchRuleTags(exprs []string, tags []string) (bool, error) {
+	values := make([]ruleValue, 0, len(tags))
+	for _, tag := range tags {
+		values = append(values, ruleValue{tag, parseRuleNumber})
+	}
+	for _, expr := range exprs {
+		matched, err := matchRuleValues(expr, values)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchRuleMap matches the key glob to value expression maps of a selection
+// rule against the properties or sysattrs of a device. Keys in parseNumbers
+// are parsed with the given parser for comparisons.
+func matchRuleMap(rules map[string]string, values map[string]string, parseNumbers map[string]ruleNumberParser) (bool, error) {
+	for keyGlob, expr := range rules {
+		matchedValues := []ruleValue{}
+		for key, value := range values {
+			keyMatched, err := filepath.Match(keyGlob, key)
+			if err != nil {
+				return false, errwrap.Wrap(errBadGlobPattern, err)
+			}
+			if !keyMatched {
+				continue
+			}
+			parseNumber, found := parseNumbers[key]
+			if !found {
+				parseNumber = parseRuleNumber
+			}
+			matchedValues = append(matchedValues, ruleValue{value, parseNumber})
+		}
+
+		matched, err := matchRuleValues(expr, matchedValues)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// validateRuleExpr checks a pattern parses.
+func validateRuleExpr(pattern string) error {
+	expr, isExpr := ruleExprBody(pattern)
+	if !isExpr {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errwrap.Wrap(errBadGlobPattern, err)
+		}
+		return nil
+	}
+
+	expr = strings.TrimPrefix(expr, "!")
+	if expr == "" {
+		return errwrap.Wrap(errBadRuleExpression, errors.New("empty expression"))
+	}
+	for _, term := range strings.Split(expr, "|") {
+		if _, err := matchRuleTerm(term, "", parseRuleNumber); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks every expression in a selection rule parses.
+func (this *DeviceSelectionRule) Validate() error {
+	for _, exprs := range [][]string{this.Subsystems, this.Name, this.Tag} {
+		for _, expr := range exprs {
+			if err := validateRuleExpr(expr); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rules := range []map[string]string{this.Properties, this.Attrs} {
+		for keyGlob, expr := range rules {
+			if _, err := filepath.Match(keyGlob, ""); err != nil {
+				return errwrap.Wrap(errBadGlobPattern, err)
+			}
+			if err := validateRuleExpr(expr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateSelectionRules checks every rule in a list of selection rules.
+func ValidateSelectionRules(selectionRules []DeviceSelectionRule) error {
+	for idx, _ := range selectionRules {
+		if err := selectionRules[idx].Validate(); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("selection rule %d: {{err}}", idx), err)
+		}
+	}
+	return nil
+}
+
+// LoadSelectionRules reads a JSON list of selection rules (as accepted by
+// simplectl raw-udev-query) from a file, and validates them.
+func LoadSelectionRules(path string) ([]DeviceSelectionRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	selectionRules := []DeviceSelectionRule{}
+	if err := json.NewDecoder(f).Decode(&selectionRules); err != nil {
+		return nil, err
+	}
+	if err := ValidateSelectionRules(selectionRules); err != nil {
+		return nil, err
+	}
+	return selectionRules, nil
+}
@@ -0,0 +1,238 @@
+package volumequery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/errwrap"
+	. "gopkg.in/check.v1"
+)
+
+type RuleExprTestSuite struct{}
+
+var _ = Suite(&RuleExprTestSuite{})
+
+func (this *RuleExprTestSuite) TestParseRuleNumber(c *C) {
+	for value, expected := range map[string]uint64{
+		"0":    0,
+		"512":  512,
+		"4k":   4096,
+		"1M":   1 << 20,
+		"2G":   2 << 30,
+		"1T":   1 << 40,
+		" 3P ": 3 << 50,
+	} {
+		number, ok := parseRuleNumber(value)
+		c.Check(ok, Equals, true, Commentf("%q", value))
+		c.Check(number, Equals, expected, Commentf("%q", value))
+	}
+
+	for _, value := range []string{"", "T", "1.5T", "-1", "1X", "100000000P"} {
+		_, ok := parseRuleNumber(value)
+		c.Check(ok, Equals, false, Commentf("%q", value))
+	}
+}
+
+func (this *RuleExprTestSuite) TestMatchRuleExpr(c *C) {
+	for _, t := range []struct {
+		expr    string
+		value   string
+		matched bool
+	}{
+		{"sd*", "sda", true},
+		{"sd*", "nvme0n1", false},
+		{"expr:!sda", "sda", false},
+		{"expr:!sda", "sdb", true},
+		{"expr:ata|scsi", "scsi", true},
+		{"expr:ata|scsi", "usb", false},
+		{"expr:!ata|scsi", "scsi", false},
+		{"expr:!ata|scsi", "usb", true},
+		{"expr:>1T", "2199023255552", true},
+		{"expr:>1T", "1099511627776", false},
+		{"expr:>=1T", "1099511627776", true},
+		{"expr:<4k", "512", true},
+		{"expr:<=4k", "4096", true},
+		{"expr:=0", "0", true},
+		{"expr:=0|>2", "3", true},
+		{"expr:>0", "not-a-number", false},
+		{"expr:!>0", "not-a-number", true},
+	} {
+		matched, err := matchRuleExpr(t.expr, t.value, parseRuleNumber)
+		c.Assert(err, IsNil)
+		c.Check(matched, Equals, t.matched, Commentf("%q against %q", t.expr, t.value))
+	}
+}
+
+func (this *RuleExprTestSuite) TestPlainGlobsMatchLiterally(c *C) {
+	// Patterns without the expression prefix are globs, as they were before
+	// expressions existed.
+	for _, t := range []struct {
+		pattern string
+		value   string
+		matched bool
+	}{
+		{"!sda", "!sda", true},
+		{"!sda", "sdb", false},
+		{"ata|scsi", "ata|scsi", true},
+		{"ata|scsi", "ata", false},
+		{">1T", ">1T", true},
+		{">1T", "2199023255552", false},
+		{"=*", "=foo", true},
+		{"<[ab]>", "<a>", true},
+	} {
+		matched, err := matchRuleExpr(t.pattern, t.value, parseRuleNumber)
+		c.Assert(err, IsNil)
+		c.Check(matched, Equals, t.matched, Commentf("%q against %q", t.pattern, t.value))
+	}
+
+	// They never fail to parse as expressions.
+	rule := DeviceSelectionRule{
+		Name:       []string{"!sda", ">"},
+		Properties: map[string]string{"ID_MODEL": "Disk|1", "ID_SERIAL": "<*"},
+		Attrs:      map[string]string{"size": ">1X"},
+	}
+	c.Check(rule.Validate(), IsNil)
+	c.Check(ruleExprNegated("!sda"), Equals, false)
+}
+
+func (this *RuleExprTestSuite) TestMatchRuleExprs(c *C) {
+	exprs := []string{"expr:sd*|nvme*", "expr:!sda"}
+	for value, expected := range map[string]bool{
+		"sdb":     true,
+		"nvme0n1": true,
+		"sda":     false,
+		"vda":     false,
+	} {
+		matched, err := matchRuleExprs(exprs, value)
+		c.Assert(err, IsNil)
+		c.Check(matched, Equals, expected, Commentf("%q", value))
+	}
+
+	// Only negated expressions match anything else.
+	matched, err := matchRuleExprs([]string{"expr:!sda"}, "vda")
+	c.Assert(err, IsNil)
+	c.Check(matched, Equals, true)
+
+	matched, err = matchRuleExprs([]string{}, "vda")
+	c.Assert(err, IsNil)
+	c.Check(matched, Equals, true)
+}
+
+func (this *RuleExprTestSuite) TestMultiplePlainGlobsMustAllMatch(c *C) {
+	// Rules with several name or subsystem globs have always required every
+	// one of them to match.
+	device := &DeviceSelectionRule{
+		Subsystems: []string{"block"},
+		Name:       []string{"sdb"},
+	}
+	for _, t := range []struct {
+		rule    DeviceSelectionRule
+		matched bool
+	}{
+		{DeviceSelectionRule{Name: []string{"sd*", "*b"}}, true},
+		{DeviceSelectionRule{Name: []string{"sd*", "*a"}}, false},
+		{DeviceSelectionRule{Name: []string{"sd*", "nvme*"}}, false},
+		{DeviceSelectionRule{Subsystems: []string{"block", "b*"}}, true},
+		{DeviceSelectionRule{Subsystems: []string{"block", "net"}}, false},
+	} {
+		matched, err := ruleMatchesDevice(&t.rule, device)
+		c.Assert(err, IsNil)
+		c.Check(matched, Equals, t.matched, Commentf("%+v", t.rule))
+	}
+}
+
+func (this *RuleExprTestSuite) TestRuleMatchesDevice(c *C) {
+	device := &DeviceSelectionRule{
+		Subsystems: []string{"block"},
+		Name:       []string{"sdb"},
+		Tag:        []string{"systemd"},
+		Properties: map[string]string{
+			"DEVTYPE":  "disk",
+			"ID_BUS":   "scsi",
+			"ID_MODEL": "Disk|1",
+		},
+		Attrs: map[string]string{
+			// 2TiB in sectors
+			"size":      "4294967296",
+			"removable": "0",
+		},
+	}
+
+	for _, t := range []struct {
+		rule    DeviceSelectionRule
+		matched bool
+	}{
+		// Plain globs keep working
+		{DeviceSelectionRule{Name: []string{"sd*"}, Properties: map[string]string{"DEVTYPE": "disk"}}, true},
+		{DeviceSelectionRule{Name: []string{"sd*"}, Properties: map[string]string{"DEVTYPE": "partition"}}, false},
+		// Plain values with expression characters match literally
+		{DeviceSelectionRule{Properties: map[string]string{"ID_MODEL": "Disk|1"}}, true},
+		{DeviceSelectionRule{Properties: map[string]string{"ID_MODEL": "Disk"}}, false},
+		{DeviceSelectionRule{Properties: map[string]string{"ID_BUS": "!usb"}}, false},
+		// sd* except the boot disk
+		{DeviceSelectionRule{Name: []string{"sd*", "expr:!sda"}}, true},
+		{DeviceSelectionRule{Name: []string{"sd*", "expr:!sdb"}}, false},
+		// ID_BUS=ata OR ID_BUS=scsi, size > 1T
+		{DeviceSelectionRule{Properties: map[string]string{"ID_BUS": "expr:ata|scsi"}, Attrs: map[string]string{"size": "expr:>1T"}}, true},
+		{DeviceSelectionRule{Properties: map[string]string{"ID_BUS": "expr:ata|scsi"}, Attrs: map[string]string{"size": "expr:>2T"}}, false},
+		// Size globs still see sectors
+		{DeviceSelectionRule{Attrs: map[string]string{"size": "4294967296"}}, true},
+		// Negated properties are satisfied by devices without them
+		{DeviceSelectionRule{Properties: map[string]string{"ID_FS_TYPE": "expr:!*"}}, true},
+		{DeviceSelectionRule{Properties: map[string]string{"ID_FS_TYPE": "*"}}, false},
+		{DeviceSelectionRule{Properties: map[string]string{"ID_BUS": "expr:!usb"}}, true},
+		{DeviceSelectionRule{Attrs: map[string]string{"removable": "expr:!1"}}, true},
+		{DeviceSelectionRule{Tag: []string{"systemd"}}, true},
+		{DeviceSelectionRule{Tag: []string{"expr:!systemd"}}, false},
+		{DeviceSelectionRule{Tag: []string{"uaccess"}}, false},
+		{DeviceSelectionRule{Subsystems: []string{"expr:!block"}}, false},
+	} {
+		matched, err := ruleMatchesDevice(&t.rule, device)
+		c.Assert(err, IsNil)
+		c.Check(matched, Equals, t.matched, Commentf("%+v", t.rule))
+	}
+}
+
+func (this *RuleExprTestSuite) TestValidate(c *C) {
+	rule := DeviceSelectionRule{
+		Name:       []string{"sd*", "expr:!sda"},
+		Properties: map[string]string{"ID_BUS": "expr:ata|scsi"},
+		Attrs:      map[string]string{"size": "expr:>=1T"},
+	}
+	c.Check(rule.Validate(), IsNil)
+
+	for _, rule := range []DeviceSelectionRule{
+		DeviceSelectionRule{Name: []string{"expr:!"}},
+		DeviceSelectionRule{Name: []string{"expr:*|[sd"}},
+		DeviceSelectionRule{Attrs: map[string]string{"size": "expr:>1X"}},
+		DeviceSelectionRule{Properties: map[string]string{"[ID": "ata"}},
+	} {
+		c.Check(rule.Validate(), NotNil, Commentf("%+v", rule))
+	}
+
+	err := ValidateSelectionRules([]DeviceSelectionRule{rule, DeviceSelectionRule{Attrs: map[string]string{"size": "expr:>1X"}}})
+	c.Assert(err, NotNil)
+	c.Check(errwrap.Contains(err, errBadRuleNumber.Error()), Equals, true)
+}
+
+func (this *RuleExprTestSuite) TestLoadSelectionRules(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "rules.json")
+	c.Assert(ioutil.WriteFile(path, []byte(`[
+		{"Subsystems": ["block"], "Name": ["sd*", "expr:!sda"], "Properties": {"DEVTYPE": "disk"}},
+		{"Name": ["nvme*"], "Attrs": {"size": "expr:>100G"}}
+	]`), os.FileMode(0644)), IsNil)
+
+	rules, err := LoadSelectionRules(path)
+	c.Assert(err, IsNil)
+	c.Assert(rules, HasLen, 2)
+	c.Check(rules[0].Name, DeepEquals, []string{"sd*", "expr:!sda"})
+	c.Check(rules[1].Attrs, DeepEquals, map[string]string{"size": "expr:>100G"})
+
+	for _, bad := range []string{`[{"Name": ["[sd"]}]`, `[{"Name": ["expr:sd*|[a"]}]`} {
+		c.Assert(ioutil.WriteFile(path, []byte(bad), os.FileMode(0644)), IsNil)
+		_, err = LoadSelectionRules(path)
+		c.Check(err, NotNil, Commentf("%s", bad))
+	}
+}
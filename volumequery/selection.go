@@ -0,0 +1,235 @@
+// Implements the selection engine which picks the set of disks a volume is
+// assembled from out of the candidate disks.
+
+package volumequery
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/wrouesnel/go.log"
+)
+
+var (
+	errNotEnoughDisks = errors.New("not enough disks satisfy the volume query")
+)
+
+const (
+	// Units of the udev size attribute of block devices.
+	SysfsSectorSize uint64 = 512
+)
+
+// DeviceSizeBytes returns the size of a block device from its udev size
+// attribute. Returns false if the size is unknown.
+func DeviceSizeBytes(rule *DeviceSelectionRule) (uint64, bool) {
+	sizeStr, found := rule.Attrs["size"]
+	if !found {
+		return 0, false
+	}
+	sectors, err := strconv.ParseUint(sizeStr, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return sectors * SysfsSectorSize, true
+}
+
+// SelectionCandidate is a disk being considered for a volume.
+type SelectionCandidate struct {
+	// Disk device path
+	DiskPath string
+	// Disk serial number, if known
+	Serial string
+	// Disk size
+	SizeBytes uint64
+	// Whether the disk is already initialized. Initialized candidates are
+	// assumed to have matched the query.
+	Initialized bool
+}
+
+// sizeFits checks if a candidate satisfies the size limits of a query.
+func sizeFits(query *VolumeQuery, candidate SelectionCandidate) bool {
+	if query.MinimumSizeBytes > 0 && candidate.SizeBytes < query.MinimumSizeBytes {
+		return false
+	}
+	if query.MaximumSizeBytes > 0 && candidate.SizeBytes > query.MaximumSizeBytes {
+		return false
+	}
+	return true
+}
+
+// bestFit orders candidates smallest first, then by serial and finally by
+// device path so selection is deterministic. Picking the smallest disks which
+// satisfy a query leaves larger disks for queries which need them.
+type bestFit []SelectionCandidate
+
+func (this bestFit) Len() int      { return len(this) }
+func (this bestFit) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this bestFit) Less(i, j int) bool {
+	if this[i].SizeBytes != this[j].SizeBytes {
+		return this[i].SizeBytes < this[j].SizeBytes
+	}
+	if this[i].Serial != this[j].Serial {
+		return this[i].Serial < this[j].Serial
+	}
+	return this[i].DiskPath < this[j].DiskPath
+}
+
+// SelectCandidates picks the disks a volume should be assembled from.
+//
+// Initialized candidates are always preferred, up to max-disks. Blank
+// candidates are only selected to make up a shortfall against min-disks, and
+// never if the query requires initialized disks. Blank candidates must also
+// satisfy the query's size limits (initialized candidates are size checked
+// when they are matched). Within each group candidates are ranked best-fit:
+// smallest size first, then by serial, then by device path.
+//
+// Returns an error if fewer than min-disks candidates qualify.
+func SelectCandidates(query *VolumeQuery, candidates []SelectionCandidate) ([]SelectionCandidate, error) {
+	initialized := []SelectionCandidate{}
+	blank := []SelectionCandidate{}
+	for _, candidate := range candidates {
+		if candidate.Initialized {
+			initialized = append(initialized, candidate)
+		} else if !query.Initialized && sizeFits(query, candidate) {
+			blank = append(blank, candidate)
+		}
+	}
+	sort.Sort(bestFit(initialized))
+	sort.Sort(bestFit(blank))
+
+	selected := initialized
+	if query.MaxDisks > 0 && len(selected) > int(query.MaxDisks) {
+		selected = selected[:query.MaxDisks]
+	}
+
+	for _, candidate := range blank {
+		if len(selected) >= int(query.MinDisks) {
+			break
+		}
+		selected = append(selected, candidate)
+	}
+
+	if len(selected) < int(query.MinDisks) {
+		return nil, errwrap.Wrap(errNotEnoughDisks,
+			fmt.Errorf("volume requires %d disks but only %d matching and %d blank disks qualify",
+				query.MinDisks, len(initialized), len(blank)))
+	}
+
+	return selected, nil
+}
+
+// DiskMatcher decides if an initialized disk matches a volume query.
+type DiskMatcher func(query *VolumeQuery, diskPath string) (bool, error)
+
+// MatchInitializedDisk is the DiskMatcher which matches a disk's label and
+// data partition against the query with VolumeQueryMatch.
+func MatchInitializedDisk(query *VolumeQuery, diskPath string) (bool, error) {
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return false, err
+	}
+	return db.MatchInitializedDisk(query, diskPath)
+}
+
+// MatchInitializedDisk implements MatchInitializedDisk against the snapshot.
+// It is a DiskMatcher bound to the snapshot.
+func (this *DeviceDatabase) MatchInitializedDisk(query *VolumeQuery, diskPath string) (bool, error) {
+	labelPath, dataPath, err := this.DiskLabelAndVolumePath(diskPath)
+	if err != nil {
+		return false, err
+	}
+	return this.VolumeQueryMatch(query, labelPath, dataPath)
+}
+
+// GetSelectionCandidate queries the serial and size of a disk.
+func GetSelectionCandidate(diskPath string, initialized bool) (SelectionCandidate, error) {
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return SelectionCandidate{}, err
+	}
+	return db.SelectionCandidate(diskPath, initialized)
+}
+
+// SelectionCandidate implements GetSelectionCandidate against the snapshot.
+func (this *DeviceDatabase) SelectionCandidate(diskPath string, initialized bool) (SelectionCandidate, error) {
+	rule, err := this.Device(diskPath)
+	if err != nil {
+		return SelectionCandidate{}, err
+	}
+	size, _ := DeviceSizeBytes(rule)
+	return SelectionCandidate{
+		DiskPath:    diskPath,
+		Serial:      rule.Properties["ID_SERIAL"],
+		SizeBytes:   size,
+		Initialized: initialized,
+	}, nil
+}
+
+// SelectDisks takes the initialized and uninitialized candidate disks (i.e.
+// from GetCandidateDisks) and picks the disks a volume should be assembled
+// from with SelectCandidates. Initialized disks which the matcher rejects,
+// blank disks which don't satisfy the query's hardware constraints, and disks
+// which can't be inspected are skipped.
+func SelectDisks(query *VolumeQuery, initialized []string, uninitialized []string, matcher DiskMatcher) ([]string, error) {
+	db, err := SnapshotDeviceDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return db.SelectDisks(query, initialized, uninitialized, matcher)
+}
+
+// SelectDisks implements SelectDisks against the snapshot. Pass
+// db.MatchInitializedDisk as the matcher to match against the same snapshot.
+func (this *DeviceDatabase) SelectDisks(query *VolumeQuery, initialized []string, uninitialized []string, matcher DiskMatcher) ([]string, error) {
+	candidates := []SelectionCandidate{}
+
+	for _, diskPath := range initialized {
+		isMatch, err := matcher(query, diskPath)
+		if err != nil {
+			log.Warnln("Skipping initialized disk which could not be matched:", diskPath, err)
+			continue
+		}
+		if !isMatch {
+			continue
+		}
+		candidate, err := this.SelectionCandidate(diskPath, true)
+		if err != nil {
+			log.Warnln("Skipping initialized disk which could not be inspected:", diskPath, err)
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	if !query.Initialized {
+		for _, diskPath := range uninitialized {
+			rule, err := this.Device(diskPath)
+			if err != nil {
+				log.Warnln("Skipping blank disk which could not be inspected:", diskPath, err)
+				continue
+			}
+			if !HardwareMatch(query, rule) {
+				continue
+			}
+			candidate, err := this.SelectionCandidate(diskPath, false)
+			if err != nil {
+				log.Warnln("Skipping blank disk which could not be inspected:", diskPath, err)
+				continue
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	selected, err := SelectCandidates(query, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	diskPaths := make([]string, 0, len(selected))
+	for _, candidate := range selected {
+		diskPaths = append(diskPaths, candidate.DiskPath)
+	}
+	return diskPaths, nil
+}
@@ -0,0 +1,113 @@
+package volumequery
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type SelectionTestSuite struct{}
+
+var _ = Suite(&SelectionTestSuite{})
+
+func candidatePaths(candidates []SelectionCandidate) []string {
+	paths := []string{}
+	for _, candidate := range candidates {
+		paths = append(paths, candidate.DiskPath)
+	}
+	return paths
+}
+
+func (this *SelectionTestSuite) TestPrefersInitializedDisks(c *C) {
+	query := NewVolumeQuery()
+	query.MinDisks = 2
+
+	selected, err := SelectCandidates(&query, []SelectionCandidate{
+		{DiskPath: "/dev/sda", SizeBytes: 100},
+		{DiskPath: "/dev/sdb", SizeBytes: 200, Initialized: true},
+		{DiskPath: "/dev/sdc", SizeBytes: 300, Initialized: true},
+	})
+	c.Assert(err, IsNil)
+	c.Check(candidatePaths(selected), DeepEquals, []string{"/dev/sdb", "/dev/sdc"})
+}
+
+func (this *SelectionTestSuite) TestBlankDisksOnlyMakeUpShortfall(c *C) {
+	query := NewVolumeQuery()
+	query.MinDisks = 2
+
+	selected, err := SelectCandidates(&query, []SelectionCandidate{
+		{DiskPath: "/dev/sda", SizeBytes: 100},
+		{DiskPath: "/dev/sdb", SizeBytes: 100},
+		{DiskPath: "/dev/sdc", SizeBytes: 300, Initialized: true},
+	})
+	c.Assert(err, IsNil)
+	c.Check(candidatePaths(selected), DeepEquals, []string{"/dev/sdc", "/dev/sda"})
+}
+
+func (this *SelectionTestSuite) TestNoBlankDisksWhenInitializedRequired(c *C) {
+	query := NewVolumeQuery()
+	query.Initialized = true
+
+	_, err := SelectCandidates(&query, []SelectionCandidate{
+		{DiskPath: "/dev/sda", SizeBytes: 100},
+	})
+	c.Check(err, NotNil)
+}
+
+func (this *SelectionTestSuite) TestStopsAtMaxDisks(c *C) {
+	query := NewVolumeQuery()
+	query.MaxDisks = 2
+
+	selected, err := SelectCandidates(&query, []SelectionCandidate{
+		{DiskPath: "/dev/sda", SizeBytes: 300, Initialized: true},
+		{DiskPath: "/dev/sdb", SizeBytes: 200, Initialized: true},
+		{DiskPath: "/dev/sdc", SizeBytes: 100, Initialized: true},
+	})
+	c.Assert(err, IsNil)
+	c.Check(candidatePaths(selected), DeepEquals, []string{"/dev/sdc", "/dev/sdb"})
+}
+
+func (this *SelectionTestSuite) TestBestFitRanksBySizeThenSerial(c *C) {
+	query := NewVolumeQuery()
+	query.MinDisks = 3
+	query.MinimumSizeBytes = 150
+
+	selected, err := SelectCandidates(&query, []SelectionCandidate{
+		{DiskPath: "/dev/sda", SizeBytes: 500, Serial: "A"},
+		{DiskPath: "/dev/sdb", SizeBytes: 200, Serial: "Z"},
+		{DiskPath: "/dev/sdc", SizeBytes: 100, Serial: "B"},
+		{DiskPath: "/dev/sdd", SizeBytes: 200, Serial: "C"},
+	})
+	c.Assert(err, IsNil)
+	c.Check(candidatePaths(selected), DeepEquals, []string{"/dev/sdd", "/dev/sdb", "/dev/sda"})
+}
+
+func (this *SelectionTestSuite) TestFailsBelowMinDisks(c *C) {
+	query := NewVolumeQuery()
+	query.MinDisks = 2
+	query.MaximumSizeBytes = 150
+
+	_, err := SelectCandidates(&query, []SelectionCandidate{
+		{DiskPath: "/dev/sda", SizeBytes: 100},
+		{DiskPath: "/dev/sdb", SizeBytes: 200},
+	})
+	c.Check(err, NotNil)
+}
+
+func (this *SelectionTestSuite) TestZeroMinDisksSelectsNothingBlank(c *C) {
+	query := NewVolumeQuery()
+	query.MinDisks = 0
+
+	selected, err := SelectCandidates(&query, []SelectionCandidate{
+		{DiskPath: "/dev/sda", SizeBytes: 100},
+	})
+	c.Assert(err, IsNil)
+	c.Check(selected, HasLen, 0)
+}
+
+func (this *SelectionTestSuite) TestDeviceSizeBytes(c *C) {
+	size, found := DeviceSizeBytes(&DeviceSelectionRule{Attrs: map[string]string{"size": "2048"}})
+	c.Check(found, Equals, true)
+	c.Check(size, Equals, uint64(2048*512))
+
+	_, found = DeviceSizeBytes(&DeviceSelectionRule{Attrs: map[string]string{}})
+	c.Check(found, Equals, false)
+}
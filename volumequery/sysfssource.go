@@ -0,0 +1,227 @@
+// Implements a device source which reads sysfs and the udev database files
+// directly, so the device database can be read without cgo and libudev.
+
+package volumequery
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Default paths read by the sysfs device source.
+	SysfsRoot    string = "/sys"
+	UdevDataRoot string = "/run/udev/data"
+	DevRoot      string = "/dev"
+)
+
+var (
+	errMalformedUevent = errors.New("malformed uevent file")
+)
+
+// SysfsDeviceSource reads block devices from sysfs and their udev properties
+// and tags from the udev database in /run/udev/data. It produces the same
+// properties, sysattrs and tags as the libudev device source. Only block
+// devices are read.
+type SysfsDeviceSource struct {
+	// Root of sysfs
+	SysRoot string
+	// Directory holding the udev database files
+	UdevDataRoot string
+	// Directory device nodes are created in
+	DevRoot string
+}
+
+// NewSysfsDeviceSource returns a device source reading the live system.
+func NewSysfsDeviceSource() *SysfsDeviceSource {
+	return &SysfsDeviceSource{
+		SysRoot:      SysfsRoot,
+		UdevDataRoot: UdevDataRoot,
+		DevRoot:      DevRoot,
+	}
+}
+
+// readKeyValueFile reads a file of KEY=VALUE lines.
+func readKeyValueFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, errMalformedUevent
+		}
+		values[kv[0]] = kv[1]
+	}
+	return values, scanner.Err()
+}
+
+// readSysattrs reads the attribute files of a sysfs device directory the way
+// libudev lists them: readable regular files other than uevent and dev, with
+// trailing newlines removed. HardwareSysattrs are read as well.
+func readSysattrs(syspath string) map[string]string {
+	attrs := make(map[string]string)
+
+	entries, err := ioutil.ReadDir(syspath)
+	if err != nil {
+		return attrs
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "uevent" || name == "dev" {
+			continue
+		}
+		if !entry.Mode().IsRegular() || entry.Mode().Perm()&0444 == 0 {
+			continue
+		}
+		value, err := ioutil.ReadFile(filepath.Join(syspath, name))
+		if err != nil {
+			// Some attributes error on read (i.e. unsupported by the
+			// device). libudev skips them too.
+			continue
+		}
+		attrs[name] = strings.TrimRight(string(value), "\n")
+	}
+	for _, name := range HardwareSysattrs {
+		if value, err := ioutil.ReadFile(filepath.Join(syspath, name)); err == nil {
+			attrs[name] = strings.TrimRight(string(value), "\n")
+		}
+	}
+	return attrs
+}
+
+// readUdevData reads a udev database file into the device's properties and
+// tags. Returns false if the device has no database entry (i.e. udev has not
+// initialized it).
+func (this *SysfsDeviceSource) readUdevData(devnum string, device *DeviceSelectionRule) (bool, error) {
+	f, err := os.Open(filepath.Join(this.UdevDataRoot, "b"+devnum))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	devlinks := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+		value := line[2:]
+		switch line[0] {
+		case 'E':
+			kv := strings.SplitN(value, "=", 2)
+			if len(kv) == 2 {
+				device.Properties[kv[0]] = kv[1]
+			}
+		case 'G':
+			device.Tag = append(device.Tag, value)
+		case 'S':
+			devlinks = append(devlinks, filepath.Join(this.DevRoot, value))
+		case 'I':
+			device.Properties["USEC_INITIALIZED"] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	if len(devlinks) > 0 {
+		device.Properties["DEVLINKS"] = strings.Join(devlinks, " ")
+	}
+	if len(device.Tag) > 0 {
+		device.Properties["TAGS"] = ":" + strings.Join(device.Tag, ":") + ":"
+	}
+	return true, nil
+}
+
+// readDevice reads a block device by its sysfs class entry. Returns nil if the
+// device has not been initialized by udev.
+func (this *SysfsDeviceSource) readDevice(name string) (*DeviceSelectionRule, error) {
+	devnumBytes, err := ioutil.ReadFile(filepath.Join(this.SysRoot, "class", "block", name, "dev"))
+	if err != nil {
+		return nil, err
+	}
+	devnum := strings.TrimSpace(string(devnumBytes))
+
+	// /sys/dev/block/<maj>:<min> links to the device directory
+	syspath, err := filepath.EvalSymlinks(filepath.Join(this.SysRoot, "dev", "block", devnum))
+	if err != nil {
+		return nil, err
+	}
+
+	uevent, err := readKeyValueFile(filepath.Join(syspath, "uevent"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", syspath, err)
+	}
+
+	device := &DeviceSelectionRule{
+		Subsystems: []string{"block"},
+		Name:       []string{filepath.Base(syspath)},
+		Tag:        []string{},
+		Properties: make(map[string]string),
+		Attrs:      readSysattrs(syspath),
+	}
+
+	for k, v := range uevent {
+		device.Properties[k] = v
+	}
+	device.Properties["SUBSYSTEM"] = "block"
+	if sysRoot, err := filepath.EvalSymlinks(this.SysRoot); err == nil {
+		if devpath, err := filepath.Rel(sysRoot, syspath); err == nil {
+			device.Properties["DEVPATH"] = "/" + devpath
+		}
+	}
+	if devname, found := uevent["DEVNAME"]; found {
+		device.Properties["DEVNAME"] = filepath.Join(this.DevRoot, devname)
+	}
+
+	initialized, err := this.readUdevData(devnum, device)
+	if err != nil {
+		return nil, err
+	}
+	if !initialized {
+		return nil, nil
+	}
+	return device, nil
+}
+
+// Devices implements DeviceSource
+func (this *SysfsDeviceSource) Devices() ([]*DeviceSelectionRule, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(this.SysRoot, "class", "block"))
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]*DeviceSelectionRule, 0, len(entries))
+	for _, entry := range entries {
+		device, err := this.readDevice(entry.Name())
+		if os.IsNotExist(err) {
+			// Device went away while we were reading it.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		// Only initialized devices, as with the udev source.
+		if device != nil {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
@@ -0,0 +1,166 @@
+package volumequery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type SysfsSourceTestSuite struct {
+	source *SysfsDeviceSource
+}
+
+var _ = Suite(&SysfsSourceTestSuite{})
+
+// fakeBlockDevice describes a block device to create in a fake sysfs tree.
+type fakeBlockDevice struct {
+	// Path of the device directory below /sys/devices
+	devpath string
+	devnum  string
+	uevent  string
+	attrs   map[string]string
+	// Contents of the udev database file. Empty if udev hasn't initialized
+	// the device.
+	udevData string
+}
+
+func writeFakeFile(c *C, path string, contents string) {
+	c.Assert(os.MkdirAll(filepath.Dir(path), os.FileMode(0755)), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(contents), os.FileMode(0644)), IsNil)
+}
+
+// SetUpTest builds a fake sysfs and udev database with an initialized simple
+// disk and a disk which udev hasn't initialized yet.
+func (this *SysfsSourceTestSuite) SetUpTest(c *C) {
+	root := c.MkDir()
+	this.source = &SysfsDeviceSource{
+		SysRoot:      filepath.Join(root, "sys"),
+		UdevDataRoot: filepath.Join(root, "run", "udev", "data"),
+		DevRoot:      "/dev",
+	}
+
+	devices := []fakeBlockDevice{
+		fakeBlockDevice{
+			devpath: "devices/pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0/block/sda",
+			devnum:  "8:0",
+			uevent:  "MAJOR=8\nMINOR=0\nDEVNAME=sda\nDEVTYPE=disk\n",
+			attrs:   map[string]string{"size": "7814037168", "removable": "0", "queue/rotational": "1"},
+			udevData: "S:disk/by-id/ata-TEST_DISK_0001\n" +
+				"S:disk/by-id/wwn-0x5000000000000001\n" +
+				"I:1234567\n" +
+				"E:ID_SERIAL=TEST_DISK_0001\n" +
+				"E:ID_WWN=0x5000000000000001\n" +
+				"E:ID_PART_TABLE_TYPE=gpt\n" +
+				"G:systemd\n",
+		},
+		fakeBlockDevice{
+			devpath: "devices/pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0/block/sda/sda1",
+			devnum:  "8:1",
+			uevent:  "MAJOR=8\nMINOR=1\nDEVNAME=sda1\nDEVTYPE=partition\nPARTN=1\n",
+			attrs:   map[string]string{"size": "2048", "partition": "1"},
+			udevData: "E:ID_PART_ENTRY_DISK=8:0\n" +
+				"E:ID_PART_ENTRY_NAME=" + SimpleMetadataLabel + "\n" +
+				"E:ID_PART_ENTRY_TYPE=" + SimpleMetadataUUID + "\n" +
+				"G:systemd\n",
+		},
+		fakeBlockDevice{
+			devpath: "devices/pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0/block/sda/sda2",
+			devnum:  "8:2",
+			uevent:  "MAJOR=8\nMINOR=2\nDEVNAME=sda2\nDEVTYPE=partition\nPARTN=2\n",
+			attrs:   map[string]string{"size": "7814035120", "partition": "2"},
+			udevData: "E:ID_PART_ENTRY_DISK=8:0\n" +
+				"E:ID_PART_ENTRY_NAME=data\n" +
+				"E:ID_FS_TYPE=ext4\n" +
+				"E:ID_FS_USAGE=filesystem\n" +
+				"G:systemd\n",
+		},
+		fakeBlockDevice{
+			devpath: "devices/pci0000:00/0000:00:1f.2/ata2/host1/target1:0:0/1:0:0:0/block/sdb",
+			devnum:  "8:16",
+			uevent:  "MAJOR=8\nMINOR=16\nDEVNAME=sdb\nDEVTYPE=disk\n",
+			attrs:   map[string]string{"size": "7814037168"},
+		},
+	}
+
+	for _, device := range devices {
+		syspath := filepath.Join(this.source.SysRoot, device.devpath)
+		writeFakeFile(c, filepath.Join(syspath, "uevent"), device.uevent)
+		writeFakeFile(c, filepath.Join(syspath, "dev"), device.devnum+"\n")
+		for name, value := range device.attrs {
+			writeFakeFile(c, filepath.Join(syspath, name), value+"\n")
+		}
+		if device.udevData != "" {
+			writeFakeFile(c, filepath.Join(this.source.UdevDataRoot, "b"+device.devnum), device.udevData)
+		}
+
+		for _, link := range []string{
+			filepath.Join(this.source.SysRoot, "class", "block", filepath.Base(device.devpath)),
+			filepath.Join(this.source.SysRoot, "dev", "block", device.devnum),
+		} {
+			c.Assert(os.MkdirAll(filepath.Dir(link), os.FileMode(0755)), IsNil)
+			c.Assert(os.Symlink(syspath, link), IsNil)
+		}
+	}
+}
+
+func (this *SysfsSourceTestSuite) TestDevices(c *C) {
+	devices, err := this.source.Devices()
+	c.Assert(err, IsNil)
+
+	byName := make(map[string]*DeviceSelectionRule)
+	for _, device := range devices {
+		byName[deviceDevnode(device)] = device
+	}
+	// sdb has no udev database entry so isn't initialized.
+	c.Assert(sortedKeys(byName), DeepEquals, []string{"/dev/sda", "/dev/sda1", "/dev/sda2"})
+
+	sda := byName["/dev/sda"]
+	c.Check(sda.Name, DeepEquals, []string{"sda"})
+	c.Check(sda.Subsystems, DeepEquals, []string{"block"})
+	c.Check(sda.Tag, DeepEquals, []string{"systemd"})
+	// Only the hardware sysattrs are read from below the top level.
+	c.Check(sda.Attrs, DeepEquals, map[string]string{"size": "7814037168", "removable": "0", "queue/rotational": "1"})
+	c.Check(sda.Properties, DeepEquals, map[string]string{
+		"MAJOR":              "8",
+		"MINOR":              "0",
+		"DEVNAME":            "/dev/sda",
+		"DEVTYPE":            "disk",
+		"SUBSYSTEM":          "block",
+		"DEVPATH":            "/devices/pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0/block/sda",
+		"DEVLINKS":           "/dev/disk/by-id/ata-TEST_DISK_0001 /dev/disk/by-id/wwn-0x5000000000000001",
+		"USEC_INITIALIZED":   "1234567",
+		"ID_SERIAL":          "TEST_DISK_0001",
+		"ID_WWN":             "0x5000000000000001",
+		"ID_PART_TABLE_TYPE": "gpt",
+		"TAGS":               ":systemd:",
+	})
+
+	sda1 := byName["/dev/sda1"]
+	c.Check(sda1.Properties["DEVTYPE"], Equals, "partition")
+	c.Check(sda1.Properties["ID_PART_ENTRY_DISK"], Equals, "8:0")
+	c.Check(sda1.Attrs["partition"], Equals, "1")
+}
+
+func (this *SysfsSourceTestSuite) TestQueriesRunAgainstSysfs(c *C) {
+	defer useTestDevices(this.source)()
+
+	initialized, uninitialized, _, err := GetCandidateDisks(diskRules(), nil, Claimant{})
+	c.Assert(err, IsNil)
+	c.Check(initialized, DeepEquals, []string{"/dev/sda"})
+	c.Check(uninitialized, HasLen, 0)
+
+	partitions, err := GetPartitionDevicesFromDiskPath("/dev/sda")
+	c.Assert(err, IsNil)
+	c.Check(sortedKeys(partitions), DeepEquals, []string{"/dev/sda1", "/dev/sda2"})
+}
+
+func (this *SysfsSourceTestSuite) TestNewDeviceSourceForBackend(c *C) {
+	source, err := NewDeviceSourceForBackend(DeviceBackendSysfs)
+	c.Assert(err, IsNil)
+	c.Check(source, FitsTypeOf, &SysfsDeviceSource{})
+
+	_, err = NewDeviceSourceForBackend("hal")
+	c.Check(err, Equals, errUnknownDeviceBackend)
+}
@@ -0,0 +1,76 @@
+//go:build cgo
+// +build cgo
+
+package volumequery
+
+import (
+	"path"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/jochenvg/go-udev"
+)
+
+// DefaultDeviceBackend is the device backend used unless another is selected.
+const DefaultDeviceBackend string = DeviceBackendUdev
+
+func newUdevBackend() (DeviceSource, error) {
+	return NewUdevDeviceSource(), nil
+}
+
+// UdevDeviceSource reads the live device database with libudev.
+type UdevDeviceSource struct{}
+
+// NewUdevDeviceSource returns a device source backed by libudev.
+func NewUdevDeviceSource() *UdevDeviceSource {
+	return &UdevDeviceSource{}
+}
+
+// deviceToSelectionRule converts a udev Device to a selection rule.
+func deviceToSelectionRule(device *udev.Device) *DeviceSelectionRule {
+	fixedRule := new(DeviceSelectionRule)
+
+	// Currently looks like no way to actually get this?
+	fixedRule.Name = []string{path.Base(device.Syspath())}
+
+	fixedRule.Attrs = make(map[string]string)
+	for attrName, _ := range device.Sysattrs() {
+		fixedRule.Attrs[attrName] = device.SysattrValue(attrName)
+	}
+	// Sysattrs only lists the top level of the device directory.
+	for _, attrName := range HardwareSysattrs {
+		if value := device.SysattrValue(attrName); value != "" {
+			fixedRule.Attrs[attrName] = value
+		}
+	}
+	fixedRule.Properties = device.Properties()
+	fixedRule.Subsystems = []string{device.Subsystem()}
+
+	fixedRule.Tag = []string{}
+	for tagName, _ := range device.Tags() {
+		fixedRule.Tag = append(fixedRule.Tag, tagName)
+	}
+
+	return fixedRule
+}
+
+// Devices implements DeviceSource
+func (this *UdevDeviceSource) Devices() ([]*DeviceSelectionRule, error) {
+	udevCtx := udev.Udev{}
+
+	deviceEnumerator := udevCtx.NewEnumerate()
+	// Only match initialized devices (global rule)
+	if err := deviceEnumerator.AddMatchIsInitialized(); err != nil {
+		return nil, err
+	}
+
+	devices, err := deviceEnumerator.Devices()
+	if err != nil {
+		return nil, errwrap.Wrap(errUdevDatabaseLookup, err)
+	}
+
+	rules := make([]*DeviceSelectionRule, 0, len(devices))
+	for _, device := range devices {
+		rules = append(rules, deviceToSelectionRule(device))
+	}
+	return rules, nil
+}
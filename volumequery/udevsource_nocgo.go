@@ -0,0 +1,12 @@
+//go:build !cgo
+// +build !cgo
+
+package volumequery
+
+// DefaultDeviceBackend is the device backend used unless another is selected.
+// Without cgo libudev is unavailable, so sysfs is read directly.
+const DefaultDeviceBackend string = DeviceBackendSysfs
+
+func newUdevBackend() (DeviceSource, error) {
+	return nil, errDeviceBackendUnavailable
+}
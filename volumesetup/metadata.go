@@ -0,0 +1,46 @@
+package volumesetup
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-simple-disk/volumelabel"
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+var (
+	errBadMetadataKey = errors.New("metadata keys must be valid volume label field names")
+)
+
+// SetVolumeLabelMetadata updates the metadata of the volume label at the given
+// label partition. Keys with a blank value are removed. A signed label is
+// re-signed, so the signing key must be configured to change it (see
+// WriteVolumeLabel).
+func SetVolumeLabelMetadata(labelDevice string, metadata map[string]string) error {
+	for key, _ := range metadata {
+		if !volumelabel.VolumeFieldKeyValid(key) {
+			return errwrap.Wrap(errBadMetadataKey, fmt.Errorf("bad metadata key: %q", key))
+		}
+	}
+
+	label, err := volumequery.DeserializeVolumeLabel(labelDevice)
+	if err != nil {
+		return err
+	}
+	if label.Metadata == nil {
+		label.Metadata = make(map[string]string)
+	}
+	for key, value := range metadata {
+		if value == "" {
+			delete(label.Metadata, key)
+		} else {
+			label.Metadata[key] = value
+		}
+	}
+
+	log.Infoln("Updating volume label metadata", labelDevice)
+	return WriteVolumeLabel(labelDevice, &label)
+}
@@ -0,0 +1,87 @@
+package volumesetup
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/wrouesnel/go.log"
+	"github.com/wrouesnel/go.sysutil/executil"
+
+	"github.com/wrouesnel/docker-simple-disk/volumelabel"
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+var (
+	errPartitionRenameFailed   = errors.New("failed to rename partition")
+	errPartitionNumberUnknown  = errors.New("partition number is not known")
+	errInvalidPartitionName    = errors.New("partition name is not a valid volume label")
+	errUnknownPartitionNameSrc = errors.New("unknown partition name repair source")
+)
+
+// PartitionNameSource is which of the volume label and the data partition GPT
+// name is trusted when repairing a disk where they disagree.
+type PartitionNameSource string
+
+const (
+	// Rename the data partition to the label in the volume label
+	RepairFromLabel PartitionNameSource = "label"
+	// Rewrite the volume label with the data partition name
+	RepairFromPartition PartitionNameSource = "partition"
+)
+
+// SetPartitionName sets the GPT name of a partition of the given disk.
+func SetPartitionName(blockDevice string, partitionDevice string, name string) error {
+	partition, err := volumequery.GetFullSelectionRuleForDevice(partitionDevice)
+	if err != nil {
+		return err
+	}
+	number := volumequery.DevicePartitionNumber(partition)
+	if number == "" {
+		return errwrap.Wrap(errPartitionRenameFailed, errPartitionNumberUnknown)
+	}
+
+	log.Infoln("Renaming partition", partitionDevice, "to", name)
+	if err := executil.CheckExec("sgdisk", "-c", fmt.Sprintf("%s:%s", number, name), blockDevice); err != nil {
+		return errwrap.Wrap(errPartitionRenameFailed, err)
+	}
+	if err := executil.CheckExec("partprobe", blockDevice); err != nil {
+		return errwrap.Wrap(errPartProbeFailed, err)
+	}
+	return nil
+}
+
+// RepairPartitionName makes the data partition GPT name and the volume label
+// of an initialized disk agree again, taking the name from the given source.
+// Disks where they already agree are left alone.
+func RepairPartitionName(blockDevice string, source PartitionNameSource) error {
+	labelDevice, dataDevice, err := volumequery.GetDiskLabelAndVolumePath(blockDevice)
+	if err != nil {
+		return err
+	}
+	label, err := volumequery.DeserializeVolumeLabel(labelDevice)
+	if err != nil {
+		return err
+	}
+	mismatch, err := volumequery.CheckPartitionName(&label, dataDevice)
+	if err != nil {
+		return err
+	}
+	if mismatch == nil {
+		log.Infoln("Data partition name already matches the volume label:", blockDevice)
+		return nil
+	}
+
+	switch source {
+	case RepairFromLabel:
+		return SetPartitionName(blockDevice, dataDevice, label.Label)
+	case RepairFromPartition:
+		if !volumelabel.VolumeFieldValueValid(mismatch.PartitionName) {
+			return errwrap.Wrap(errInvalidPartitionName, fmt.Errorf("%q", mismatch.PartitionName))
+		}
+		log.Infoln("Relabelling", blockDevice, "from", label.Label, "to", mismatch.PartitionName)
+		label.Label = mismatch.PartitionName
+		return WriteVolumeLabel(labelDevice, &label)
+	}
+	return errUnknownPartitionNameSrc
+}
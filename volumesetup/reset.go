@@ -0,0 +1,113 @@
+package volumesetup
+
+import (
+	"errors"
+	"os"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/wrouesnel/go.log"
+	"github.com/wrouesnel/go.sysutil/executil"
+
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+var (
+	errCryptoEraseFailed   = errors.New("failed to erase LUKS header")
+	errWipeFailed          = errors.New("failed to discard or zero data partition")
+	errLabelEraseFailed    = errors.New("failed to erase label partition")
+	errResetFailed         = errors.New("failed to reset disk to uninitialized")
+	errUnknownRemovePolicy = errors.New("unknown remove policy")
+)
+
+// Size of the label partition in bytes.
+const partitionLabelSizeBytes int = PartitionLabelSize * 1024 * 1024
+
+// CryptoEraseDevice destroys the LUKS keyslots of an encrypted device,
+// rendering its data unrecoverable.
+func CryptoEraseDevice(dataDevice string) error {
+	log.Infoln("Erasing LUKS keyslots of", dataDevice)
+	if err := executil.CheckExec("cryptsetup", "luksErase", "--batch-mode", dataDevice); err != nil {
+		return errwrap.Wrap(errCryptoEraseFailed, err)
+	}
+	return nil
+}
+
+// WipeDevice discards every block of a device. If the device does not support
+// discard, it is zeroed instead.
+func WipeDevice(dataDevice string) error {
+	log.Infoln("Discarding", dataDevice)
+	err := executil.CheckExec("blkdiscard", dataDevice)
+	if err == nil {
+		return nil
+	}
+	log.Warnln("Discard failed, zeroing instead:", dataDevice, err)
+
+	if err := executil.CheckExec("blkdiscard", "--zeroout", dataDevice); err != nil {
+		return errwrap.Wrap(errWipeFailed, err)
+	}
+	return nil
+}
+
+// ResetBlockDevice returns an initialized disk to the uninitialized pool,
+// first destroying its data according to the remove policy. The label
+// partition is zeroed and the partition table removed. Disks which are
+// already blank are left alone.
+func ResetBlockDevice(blockDevice string, policy volumequery.RemovePolicy) error {
+	isBlank, err := volumequery.CheckIfDiskIsBlankCandidate(blockDevice)
+	if err != nil {
+		return err
+	}
+	if isBlank {
+		log.Infoln("Disk is already uninitialized:", blockDevice)
+		return nil
+	}
+
+	labelDevice, dataDevice, err := volumequery.GetDiskLabelAndVolumePath(blockDevice)
+	if err != nil {
+		return err
+	}
+
+	switch policy {
+	case volumequery.RemoveKeep:
+		return nil
+	case volumequery.RemoveRelease:
+	case volumequery.RemoveCryptoErase:
+		label, err := volumequery.DeserializeVolumeLabel(labelDevice)
+		if err != nil {
+			return err
+		}
+		if label.Encrypted {
+			if err := CryptoEraseDevice(dataDevice); err != nil {
+				return err
+			}
+		} else {
+			// Still honour the request to destroy the data.
+			log.Warnln("Disk is not encrypted, wiping instead of crypto-erasing:", blockDevice)
+			if err := WipeDevice(dataDevice); err != nil {
+				return err
+			}
+		}
+	case volumequery.RemoveWipe:
+		if err := WipeDevice(dataDevice); err != nil {
+			return err
+		}
+	default:
+		return errUnknownRemovePolicy
+	}
+
+	log.Infoln("Erasing label partition", labelDevice)
+	if err := WriteAndSyncExistingFile(labelDevice, make([]byte, partitionLabelSizeBytes), os.FileMode(0600)); err != nil {
+		return errwrap.Wrap(errLabelEraseFailed, err)
+	}
+
+	log.Infoln("Removing partition table from", blockDevice)
+	if err := executil.CheckExec("sgdisk", "-Z", blockDevice); err != nil {
+		return errwrap.Wrap(errResetFailed, err)
+	}
+
+	if err := executil.CheckExec("partprobe", blockDevice); err != nil {
+		return errwrap.Wrap(errPartProbeFailed, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package volumesetup
+
+import (
+	"errors"
+
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+var (
+	errSigningKeyRequired  = errors.New("a label signing key must be configured to sign labels")
+	errSignedLabelNeedsKey = errors.New("volume label is signed, so a label signing key must be configured to rewrite it")
+)
+
+// SignExistingVolumeLabel signs the volume label at the given label partition
+// with the configured signing key, for disks initialized before signing was
+// set up. The label is trusted as it is, so only sign disks known to be ours.
+func SignExistingVolumeLabel(labelDevice string) error {
+	if volumequery.GetLabelSigningKey() == nil {
+		return errSigningKeyRequired
+	}
+	label, err := volumequery.DeserializeVolumeLabel(labelDevice)
+	if err != nil {
+		return err
+	}
+	log.Infoln("Signing volume label", labelDevice)
+	// WriteVolumeLabel signs with the configured key.
+	return WriteVolumeLabel(labelDevice, &label)
+}
@@ -0,0 +1,53 @@
+package volumesetup
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-simple-disk/volumequery"
+)
+
+var (
+	errLabelUpgradeVerifyFailed = errors.New("volume label did not read back as written after upgrade")
+)
+
+// UpgradeVolumeLabel rewrites the volume label at the given label partition
+// with the current label version, if it was written with an older one. The
+// label is migrated and serialized in full before anything is written, then
+// written with a single synced write and read back to verify it. Returns the
+// version the label was written with. Labels from newer versions of simple
+// are refused and left untouched, as are signed labels if no signing key is
+// configured.
+func UpgradeVolumeLabel(labelDevice string, dryRun bool) (int, error) {
+	label, fromVersion, err := volumequery.ReadVolumeLabel(labelDevice)
+	if err != nil {
+		return fromVersion, err
+	}
+	if fromVersion == volumequery.VolumeLabelVersion {
+		return fromVersion, nil
+	}
+	// Upgrading rewrites the label, which needs the key to re-sign it.
+	if label.Signature != "" && volumequery.GetLabelSigningKey() == nil {
+		return fromVersion, errSignedLabelNeedsKey
+	}
+	if dryRun {
+		return fromVersion, nil
+	}
+
+	log.Infoln("Upgrading volume label", labelDevice, "from version", fromVersion, "to", volumequery.VolumeLabelVersion)
+	if err := WriteVolumeLabel(labelDevice, &label); err != nil {
+		return fromVersion, err
+	}
+
+	written, _, err := volumequery.ReadVolumeLabel(labelDevice)
+	if err != nil {
+		return fromVersion, errwrap.Wrap(errLabelUpgradeVerifyFailed, err)
+	}
+	if !reflect.DeepEqual(written, label) {
+		return fromVersion, errLabelUpgradeVerifyFailed
+	}
+	return fromVersion, nil
+}
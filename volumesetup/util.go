@@ -23,4 +23,25 @@ func WriteAndSyncExistingFile(filename string, data []byte, perm os.FileMode) er
 		err = err1
 	}
 	return err
-}
\ No newline at end of file
+}
+
+// WriteAndSyncExistingFileAt writes data at the given offset of a file without
+// truncating it, and calls sync, ensuring data is written to the device if it
+// exits successfully.
+func WriteAndSyncExistingFileAt(filename string, data []byte, offset int64, perm os.FileMode) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	n, err := f.WriteAt(data, offset)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
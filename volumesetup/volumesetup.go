@@ -28,6 +28,48 @@ const (
 	PartitionLabelInitialOffset int = 1
 )
 
+// WriteVolumeLabel serializes a volume label and writes it to the given label
+// partition. The label is written to the next label slot with the next
+// generation, so the slot holding the current label is never overwritten. If a
+// label signing key is configured the label is signed first.
+func WriteVolumeLabel(labelDevice string, label *volumequery.VolumeLabel) error {
+	if key := volumequery.GetLabelSigningKey(); key != nil {
+		binding, err := volumequery.LabelSignatureBinding(labelDevice)
+		if err != nil {
+			return errwrap.Wrap(errCouldNotWriteVolumeLabel, err)
+		}
+		if err := volumequery.SignVolumeLabel(label, key, binding); err != nil {
+			return errwrap.Wrap(errCouldNotWriteVolumeLabel, err)
+		}
+	} else if label.Signature != "" {
+		// The old signature wouldn't verify against the rewritten label.
+		return errSignedLabelNeedsKey
+	}
+
+	log.Debugln("Serializing volume label")
+	labelBytes, err := volumequery.SerializeVolumeLabel(label)
+	if err != nil {
+		return errwrap.Wrap(errCouldNotWriteVolumeLabel, err)
+	}
+
+	f, err := os.Open(labelDevice)
+	if err != nil {
+		return errwrap.Wrap(errCouldNotWriteVolumeLabel, err)
+	}
+	slotIdx, generation := volumequery.NextLabelSlot(volumequery.ReadLabelSlots(f))
+	f.Close()
+
+	slotBytes, err := volumequery.EncodeLabelSlot(generation, labelBytes)
+	if err != nil {
+		return errwrap.Wrap(errCouldNotWriteVolumeLabel, err)
+	}
+	log.Debugln("Writing label to slot", slotIdx, "generation", generation)
+	if err := WriteAndSyncExistingFileAt(labelDevice, slotBytes, volumequery.LabelSlotOffset(slotIdx), os.FileMode(0600)); err != nil {
+		return errwrap.Wrap(errCouldNotWriteVolumeLabel, err)
+	}
+	return nil
+}
+
 // Initialize a block device as a docker-simple-disk device based on a volume
 // query. This function will forcibly overwrite any partition table already
 // present.
@@ -87,6 +129,10 @@ func InitializeBlockDevice(blockDevice string, inputQuery volumequery.VolumeQuer
 		Encrypted: isEncrypted,
 		Metadata: make(map[string]string),
 	}
+	// Stamp the query's meta- fields so the same query matches the disk.
+	for k, v := range inputQuery.Metadata {
+		label.Metadata[k] = v
+	}
 
 	log.Infoln("Checking new device is initialized")
 	labelDevice, dataDevice, err := volumequery.GetDiskLabelAndVolumePath(blockDevice)
@@ -96,14 +142,8 @@ func InitializeBlockDevice(blockDevice string, inputQuery volumequery.VolumeQuer
 	log.Infoln("Disk Device", blockDevice, "has label device", labelDevice, "and data device", dataDevice)
 
 	log.Infoln("Writing label content to:", labelDevice)
-	log.Debugln("Serializing volume label")
-	labelBytes, err := volumequery.SerializeVolumeLabel(&label)
-	if err != nil {
-		return errwrap.Wrap(errCouldNotWriteVolumeLabel, err)
-	}
-	log.Debugln("Writing label")
-	if err := WriteAndSyncExistingFile(labelDevice, labelBytes, os.FileMode(0600)); err != nil {
-		return errwrap.Wrap(errCouldNotWriteVolumeLabel, err)
+	if err := WriteVolumeLabel(labelDevice, &label); err != nil {
+		return err
 	}
 
 	log.Infoln("Setting up data volume")
@@ -147,7 +187,7 @@ func InitializeBlockDevice(blockDevice string, inputQuery volumequery.VolumeQuer
 		defer func() {
 			log.Infoln("Closing the encrypted device")
 			if err := luksCtx.Close(); err != nil {
-				log.Errorln("Error closing the encrypted device. Context may leak.")
+				log.Errorln("Error closing the encrypted device. Context may leak:", err)
 			}
 		}()
 		// TODO: does this *ever* change across linux distros? How do you detect if it does?